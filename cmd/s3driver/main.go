@@ -19,9 +19,15 @@ package main
 import (
 	"flag"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/yandex-cloud/k8s-csi-s3/pkg/driver"
+	"github.com/yandex-cloud/k8s-csi-s3/pkg/mounter"
+	"github.com/yandex-cloud/k8s-csi-s3/pkg/s3"
 )
 
 func init() {
@@ -31,15 +37,91 @@ func init() {
 var (
 	endpoint = flag.String("endpoint", "unix://tmp/csi.sock", "CSI endpoint")
 	nodeID   = flag.String("nodeid", "", "node id")
+	mode     = flag.String("mode", driver.ModeAll, "services to serve: controller, node or all")
+
+	shutdownTimeout = flag.Duration("shutdown-timeout", 20*time.Second, "how long to wait for requests in progress on SIGTERM, should be shorter than terminationGracePeriodSeconds")
+
+	configFile = flag.String("config", "", "driver configuration file with defaults and backend profiles, reloaded on SIGHUP")
+
+	abortUploadsOlderThan = flag.Duration("abort-uploads-older-than", 0, "abort multipart uploads older than this in the volumes of the configured backends, e.g. 24h, 0 disables it")
+	abortUploadsInterval  = flag.Duration("abort-uploads-interval", time.Hour, "interval of checking volumes for old multipart uploads")
+
+	metricsAddress = flag.String("metrics-address", "", "serve metrics in the Prometheus format at /metrics and in expvar format at /debug/vars on this address, e.g. :9810")
+
+	printCredentials = flag.String("print-credentials", "", "print volume keys from this file as an AWS credential_process and exit")
 )
 
 func main() {
 	flag.Parse()
 
+	if *printCredentials != "" {
+		if err := mounter.PrintCredentials(os.Stdout, *printCredentials); err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	}
+
+	if *metricsAddress != "" {
+		http.Handle("/metrics", s3.MetricsHandler())
+		go func() {
+			log.Fatal(http.ListenAndServe(*metricsAddress, nil))
+		}()
+	}
+
+	var config *driver.Config
+	if *configFile != "" {
+		var err error
+		if config, err = driver.LoadConfig(*configFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	driver, err := driver.New(*nodeID, *endpoint)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if err = driver.SetMode(*mode); err != nil {
+		log.Fatal(err)
+	}
+	if config != nil {
+		driver.Configure(config)
+		go reloadConfig(*configFile, driver.Configure)
+	}
+	if *abortUploadsOlderThan > 0 {
+		if *abortUploadsInterval <= 0 {
+			log.Fatal("--abort-uploads-interval must be positive")
+		}
+		driver.AbortOldUploads(*abortUploadsOlderThan, *abortUploadsInterval)
+	}
+	go shutdownOnSignal(*shutdownTimeout, driver.Shutdown)
 	driver.Run()
 	os.Exit(0)
 }
+
+// shutdownOnSignal shuts the driver down gracefully on SIGTERM or SIGINT.
+// Another signal stops it right away.
+func shutdownOnSignal(timeout time.Duration, shutdown func(timeout time.Duration)) {
+	term := make(chan os.Signal, 2)
+	signal.Notify(term, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-term
+	log.Printf("Received %v, waiting up to %v for requests in progress", sig, timeout)
+	go shutdown(timeout)
+	sig = <-term
+	log.Fatalf("Received %v again, exiting", sig)
+}
+
+// reloadConfig applies the configuration file again on every SIGHUP.
+// An invalid file is reported and the previous configuration is kept.
+func reloadConfig(path string, configure func(cfg *driver.Config)) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		config, err := driver.LoadConfig(path)
+		if err != nil {
+			log.Printf("Keeping the previous configuration: %v", err)
+			continue
+		}
+		configure(config)
+		log.Printf("Reloaded configuration from %s", path)
+	}
+}
@@ -0,0 +1,333 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/yandex-cloud/k8s-csi-s3/pkg/mounter"
+	"github.com/yandex-cloud/k8s-csi-s3/pkg/s3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gopkg.in/yaml.v2"
+)
+
+// Config is the driver configuration file. Its defaults and backend profiles
+// hold the same settings as secrets and StorageClass parameters, which
+// override them.
+type Config struct {
+	// Defaults apply to every volume. The "backend" key selects the profile
+	// of volumes which don't select one.
+	Defaults map[string]string `yaml:"defaults"`
+	// Backends are named profiles selected by the "backend" key of the
+	// StorageClass parameters or the secret, applied on top of the defaults
+	Backends map[string]map[string]string `yaml:"backends"`
+
+	Timeouts struct {
+		// Mount is how long to wait for a mounter to mount a volume
+		Mount time.Duration `yaml:"mount"`
+		// ClientCache is how long the controller reuses S3 clients
+		ClientCache time.Duration `yaml:"clientCache"`
+	} `yaml:"timeouts"`
+
+	Naming struct {
+		// VolumePrefix is prepended to the names of created buckets and prefixes
+		VolumePrefix string `yaml:"volumePrefix"`
+	} `yaml:"naming"`
+
+	// MountOptionPolicies add to the built-in mount option policies of the
+	// mounters. Denied options are denied in addition to the built-in ones.
+	MountOptionPolicies map[string]mounter.OptionPolicy `yaml:"mountOptionPolicies"`
+
+	// PluginDir overrides the PLUGIN_DIR environment variable
+	PluginDir string `yaml:"pluginDir"`
+
+	// Credentials limit which credentials providers and parameters of them
+	// secrets may select
+	Credentials struct {
+		// Providers may be selected in addition to "secret"
+		Providers []string `yaml:"providers"`
+		// EnvPrefixes may be selected with "credentialsEnvPrefix"
+		EnvPrefixes []string `yaml:"envPrefixes"`
+		// FilePaths may be selected with "credentialsPath"
+		FilePaths []string `yaml:"filePaths"`
+		// VaultAddress is the Vault URL, VAULT_ADDR by default
+		VaultAddress string `yaml:"vaultAddress"`
+	} `yaml:"credentials"`
+}
+
+const (
+	backendKey = "backend"
+	// backendFeaturesKey lists the probed features of the backend in the
+	// volume context confirmed by ValidateVolumeCapabilities
+	backendFeaturesKey = "backendFeatures"
+	// IDs of volumes created on a backend start with its name and this
+	// separator, which bucket names can't contain
+	backendSeparator = ":"
+	// Bucket names are at most 63 characters long, and names which don't fit
+	// are replaced with 40 characters of their SHA-1 after the prefix
+	maxVolumePrefixLength = 23
+)
+
+var (
+	volumePrefixPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]*$`)
+	backendNamePattern  = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+)
+
+// Keys are only taken from secrets, never from the configuration file
+var credentialKeys = []string{"accessKeyID", "secretAccessKey", "sessionToken", "clientKey", "vaultToken"}
+
+var (
+	configMu      sync.RWMutex
+	currentConfig = &Config{}
+)
+
+// driverConfig returns the configuration in effect
+func driverConfig() *Config {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return currentConfig
+}
+
+func setConfig(cfg *Config) {
+	configMu.Lock()
+	defer configMu.Unlock()
+	currentConfig = cfg
+}
+
+// LoadConfig reads and validates the configuration file
+func LoadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &Config{}
+	if err = yaml.UnmarshalStrict(data, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	if err = cfg.validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+func (cfg *Config) validate() error {
+	if cfg.Timeouts.Mount < 0 || cfg.Timeouts.ClientCache < 0 {
+		return fmt.Errorf("timeouts must not be negative")
+	}
+	prefix := cfg.Naming.VolumePrefix
+	if prefix != "" && (!volumePrefixPattern.MatchString(prefix) || len(prefix) > maxVolumePrefixLength) {
+		return fmt.Errorf("volume prefix %q must be at most %d lowercase letters, digits, dots and dashes",
+			prefix, maxVolumePrefixLength)
+	}
+	if err := cfg.providerSettings().Validate(); err != nil {
+		return err
+	}
+	for mounterType := range cfg.MountOptionPolicies {
+		if !isMounterType(mounterType) {
+			return fmt.Errorf("mount option policy of unknown mounter %q", mounterType)
+		}
+	}
+	if name := cfg.Defaults[backendKey]; name != "" && cfg.Backends[name] == nil {
+		return fmt.Errorf("default backend %q is not defined", name)
+	}
+	names := []string{""}
+	for name, backend := range cfg.Backends {
+		if !backendNamePattern.MatchString(name) {
+			return fmt.Errorf("backend name %q must only contain letters, digits, dots, dashes and underscores", name)
+		}
+		if _, ok := backend[backendKey]; ok {
+			return fmt.Errorf("backend %q must not select another backend", name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		profile, err := cfg.profile(name)
+		if err != nil {
+			return err
+		}
+		if err = cfg.validateProfile(profile); err != nil {
+			if name == "" {
+				return fmt.Errorf("defaults: %w", err)
+			}
+			return fmt.Errorf("backend %q: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func (cfg *Config) validateProfile(profile map[string]string) error {
+	for _, key := range credentialKeys {
+		if _, ok := profile[key]; ok {
+			return fmt.Errorf("%s must be set in secrets", key)
+		}
+	}
+	mounterType := profile[mounter.TypeKey]
+	if mounterType != "" && !isMounterType(mounterType) {
+		return fmt.Errorf("unknown mounter %q", mounterType)
+	}
+	options := parseMountOptions(profile[mounter.OptionsKey])
+	if err := cfg.optionPolicy(mounterType).Check(mounterType, options); err != nil {
+		return err
+	}
+	return s3.ValidateSettings(profile)
+}
+
+func isMounterType(name string) bool {
+	for _, mounterType := range mounter.Types {
+		if name == mounterType {
+			return true
+		}
+	}
+	return false
+}
+
+// backendName returns the backend of a volume: the one recorded in its ID,
+// or else the one selected by the volume context, the secret or the defaults
+func (cfg *Config) backendName(volumeID string, secrets, volumeContext map[string]string) string {
+	if name, _ := splitVolumeBackend(volumeID); name != "" {
+		return name
+	}
+	for _, settings := range []map[string]string{volumeContext, secrets, cfg.Defaults} {
+		if name := settings[backendKey]; name != "" {
+			return name
+		}
+	}
+	return ""
+}
+
+// profile returns the defaults with the settings of the named backend, or
+// of the default backend if name is empty
+func (cfg *Config) profile(name string) (map[string]string, error) {
+	if name == "" {
+		name = cfg.Defaults[backendKey]
+	}
+	profile := make(map[string]string)
+	for k, v := range cfg.Defaults {
+		if k != backendKey {
+			profile[k] = v
+		}
+	}
+	if name == "" {
+		return profile, nil
+	}
+	backend, ok := cfg.Backends[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown backend %q", name)
+	}
+	for k, v := range backend {
+		profile[k] = v
+	}
+	return profile, nil
+}
+
+// optionPolicy returns the built-in mount option policy of the mounter
+// type extended by the configured one
+func (cfg *Config) optionPolicy(mounterType string) mounter.OptionPolicy {
+	if mounterType == "" {
+		// the first one is the default mounter
+		mounterType = mounter.Types[0]
+	}
+	policy := mounter.DefaultOptionPolicy(mounterType)
+	configured, ok := cfg.MountOptionPolicies[mounterType]
+	if !ok {
+		return policy
+	}
+	if len(configured.Allow) > 0 {
+		policy.Allow = configured.Allow
+	}
+	policy.Deny = append(append([]string{}, policy.Deny...), configured.Deny...)
+	return policy
+}
+
+func (cfg *Config) providerSettings() s3.ProviderSettings {
+	return s3.ProviderSettings{
+		Providers:    cfg.Credentials.Providers,
+		EnvPrefixes:  cfg.Credentials.EnvPrefixes,
+		FilePaths:    cfg.Credentials.FilePaths,
+		VaultAddress: cfg.Credentials.VaultAddress,
+	}
+}
+
+func (cfg *Config) configureProviders() {
+	s3.ConfigureProviders(cfg.providerSettings())
+}
+
+func (cfg *Config) clientCacheTTL() time.Duration {
+	if cfg.Timeouts.ClientCache > 0 {
+		return cfg.Timeouts.ClientCache
+	}
+	return clientCacheTTL
+}
+
+// Configure applies the configuration. It may be called again to reload it.
+func (s3 *driver) Configure(cfg *Config) {
+	setConfig(cfg)
+	mounter.Configure(mounter.Settings{
+		MountTimeout: cfg.Timeouts.Mount,
+		PluginDir:    cfg.PluginDir,
+	})
+	for _, mounterType := range mounter.Types {
+		mounter.SetOptionPolicy(mounterType, cfg.optionPolicy(mounterType))
+	}
+	s3.clients.SetTTL(cfg.clientCacheTTL())
+	cfg.configureProviders()
+}
+
+// applyProfile merges the backend profile of a volume into its secrets and
+// volume context. The secrets override the connection settings of the
+// profile, the volume context overrides its mounter, mount options and
+// bucket. Mount options of the profile only apply to its own mounter.
+// volumeID is empty for volumes which aren't created yet.
+func applyProfile(volumeID string, secrets, volumeContext map[string]string) (map[string]string, map[string]string, error) {
+	cfg := driverConfig()
+	profile, err := cfg.profile(cfg.backendName(volumeID, secrets, volumeContext))
+	if err != nil {
+		return nil, nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	mergedSecrets := make(map[string]string, len(profile)+len(secrets))
+	for k, v := range profile {
+		if k != mounter.OptionsKey && k != mounter.BucketKey {
+			mergedSecrets[k] = v
+		}
+	}
+	for k, v := range secrets {
+		mergedSecrets[k] = v
+	}
+
+	mergedContext := make(map[string]string, len(volumeContext)+3)
+	for k, v := range volumeContext {
+		mergedContext[k] = v
+	}
+	keys := []string{mounter.BucketKey}
+	if mounterType := volumeContext[mounter.TypeKey]; mounterType == "" || mounterType == profile[mounter.TypeKey] {
+		keys = append(keys, mounter.TypeKey, mounter.OptionsKey)
+	}
+	for _, k := range keys {
+		if mergedContext[k] == "" && profile[k] != "" {
+			mergedContext[k] = profile[k]
+		}
+	}
+	return mergedSecrets, mergedContext, nil
+}
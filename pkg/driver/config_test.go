@@ -0,0 +1,177 @@
+package driver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/yandex-cloud/k8s-csi-s3/pkg/mounter"
+	"github.com/yandex-cloud/k8s-csi-s3/pkg/s3"
+)
+
+var _ = Describe("Config", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "csi-s3-config")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+		setConfig(&Config{})
+	})
+
+	load := func(data string) (*Config, error) {
+		path := filepath.Join(dir, "config.yaml")
+		Expect(ioutil.WriteFile(path, []byte(data), 0600)).To(Succeed())
+		return LoadConfig(path)
+	}
+
+	It("reads defaults, backends and timeouts", func() {
+		cfg, err := load(`
+defaults:
+  backend: yandex
+  mounter: geesefs
+  options: --memory-limit 1000
+backends:
+  yandex:
+    endpoint: https://storage.yandexcloud.net
+  minio:
+    endpoint: https://minio.example.com
+    mounter: rclone
+timeouts:
+  mount: 30s
+naming:
+  volumePrefix: k8s-
+`)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cfg.Timeouts.Mount).To(Equal(30 * time.Second))
+		Expect(cfg.clientCacheTTL()).To(Equal(clientCacheTTL))
+		profile, err := cfg.profile("")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(profile).To(Equal(map[string]string{
+			"mounter":  "geesefs",
+			"options":  "--memory-limit 1000",
+			"endpoint": "https://storage.yandexcloud.net",
+		}))
+		profile, err = cfg.profile("minio")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(profile["mounter"]).To(Equal("rclone"))
+		Expect(profile["endpoint"]).To(Equal("https://minio.example.com"))
+	})
+
+	It("rejects invalid files", func() {
+		for _, data := range []string{
+			"timeout:\n  mount: 30s\n",
+			"timeouts:\n  mount: -1s\n",
+			"naming:\n  volumePrefix: K8S_\n",
+			"defaults:\n  backend: missing\n",
+			"defaults:\n  mounter: goofys\n",
+			"defaults:\n  accessKeyID: id\n",
+			"defaults:\n  options: --log-file /etc/passwd\n",
+			"backends:\n  minio:\n    client: boto\n",
+			"backends:\n  minio:\n    backend: yandex\n",
+			"backends:\n  minio:s3:\n    endpoint: https://minio.example.com\n",
+			"mountOptionPolicies:\n  goofys:\n    deny: [--cache]\n",
+			"credentials:\n  providers: [keychain]\n",
+			"credentials:\n  filePaths: [/]\n",
+		} {
+			_, err := load(data)
+			Expect(err).To(HaveOccurred(), data)
+		}
+	})
+
+	It("reads the allowed credentials providers", func() {
+		cfg, err := load(`
+credentials:
+  providers: [env, vault]
+  envPrefixes: [TEAM_A_]
+  vaultAddress: https://vault.example.com:8200
+`)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cfg.providerSettings()).To(Equal(s3.ProviderSettings{
+			Providers:    []string{"env", "vault"},
+			EnvPrefixes:  []string{"TEAM_A_"},
+			VaultAddress: "https://vault.example.com:8200",
+		}))
+	})
+
+	It("extends the built-in mount option policies", func() {
+		cfg, err := load(`
+mountOptionPolicies:
+  rclone:
+    deny: [--read-only]
+`)
+		Expect(err).NotTo(HaveOccurred())
+		policy := cfg.optionPolicy("rclone")
+		Expect(policy.Deny).To(ContainElement("--read-only"))
+		Expect(policy.Deny).To(ContainElement("--config"))
+		Expect(cfg.optionPolicy("s3fs")).To(Equal(mounter.DefaultOptionPolicy("s3fs")))
+	})
+
+	Describe("applyProfile", func() {
+		BeforeEach(func() {
+			setConfig(&Config{
+				Defaults: map[string]string{"mounter": "geesefs", "options": "--memory-limit 1000", "region": "ru-central1"},
+				Backends: map[string]map[string]string{
+					"minio": {"endpoint": "https://minio.example.com", "bucket": "shared"},
+				},
+			})
+		})
+
+		It("lets secrets and the volume context override the profile", func() {
+			secrets, volumeContext, err := applyProfile("",
+				map[string]string{"accessKeyID": "id", "region": "us-east-1"},
+				map[string]string{"backend": "minio"},
+			)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(secrets).To(Equal(map[string]string{
+				"accessKeyID": "id",
+				"region":      "us-east-1",
+				"endpoint":    "https://minio.example.com",
+				"mounter":     "geesefs",
+			}))
+			Expect(volumeContext).To(Equal(map[string]string{
+				"backend": "minio",
+				"bucket":  "shared",
+				"mounter": "geesefs",
+				"options": "--memory-limit 1000",
+			}))
+		})
+
+		It("doesn't apply mount options to other mounters", func() {
+			_, volumeContext, err := applyProfile("", nil, map[string]string{"mounter": "rclone"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(volumeContext).To(Equal(map[string]string{"mounter": "rclone"}))
+		})
+
+		It("selects the backend from the secret without a volume context", func() {
+			secrets, _, err := applyProfile("", map[string]string{"backend": "minio"}, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(secrets["endpoint"]).To(Equal("https://minio.example.com"))
+		})
+
+		It("selects the backend recorded in the volume ID first", func() {
+			secrets, _, err := applyProfile("minio:shared/pvc-1", nil, map[string]string{"backend": "other"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(secrets["endpoint"]).To(Equal("https://minio.example.com"))
+		})
+
+		It("rejects unknown backends", func() {
+			_, _, err := applyProfile("", nil, map[string]string{"backend": "ceph"})
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	It("prefixes volume names", func() {
+		Expect(sanitizeVolumeID("k8s-", "PVC-1")).To(Equal("k8s-pvc-1"))
+		long := sanitizeVolumeID("k8s-", string(make([]byte, 80)))
+		Expect(long).To(HavePrefix("k8s-"))
+		Expect(len(long)).To(Equal(44))
+	})
+})
@@ -22,8 +22,11 @@ import (
 	"fmt"
 	"io"
 	"path"
+	"sort"
 	"strings"
+	"time"
 
+	"github.com/yandex-cloud/k8s-csi-s3/pkg/errdefs"
 	"github.com/yandex-cloud/k8s-csi-s3/pkg/mounter"
 	"github.com/yandex-cloud/k8s-csi-s3/pkg/s3"
 	"github.com/golang/glog"
@@ -37,12 +40,26 @@ import (
 
 type controllerServer struct {
 	*csicommon.DefaultControllerServer
+	clients *s3.ClientCache
+	// uploads is nil unless old multipart uploads are aborted
+	uploads *uploadsJanitor
+}
+
+// Requests with the same secret reuse S3 clients for this long
+const clientCacheTTL = 5 * time.Minute
+
+func newClientCache() *s3.ClientCache {
+	return s3.NewClientCache(clientCacheTTL)
 }
 
 func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
-	params := req.GetParameters()
+	secrets, params, err := applyProfile("", req.GetSecrets(), req.GetParameters())
+	if err != nil {
+		return nil, err
+	}
+	config := driverConfig()
 	capacityBytes := int64(req.GetCapacityRange().GetRequiredBytes())
-	volumeID := sanitizeVolumeID(req.GetName())
+	volumeID := sanitizeVolumeID(config.Naming.VolumePrefix, req.GetName())
 	bucketName := volumeID
 	prefix := ""
 
@@ -52,6 +69,11 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 		prefix = volumeID
 		volumeID = path.Join(bucketName, prefix)
 	}
+	// DeleteVolume gets neither the parameters nor the volume context, so the
+	// backend of the volume is recorded in its ID
+	if backend := config.backendName("", req.GetSecrets(), req.GetParameters()); backend != "" {
+		volumeID = backend + backendSeparator + volumeID
+	}
 
 	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME); err != nil {
 		glog.V(3).Infof("invalid create volume req: %v", req)
@@ -65,34 +87,67 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 	if req.GetVolumeCapabilities() == nil {
 		return nil, status.Error(codes.InvalidArgument, "Volume Capabilities missing in request")
 	}
+	// Reject StorageClasses with forbidden mount options early
+	if err := checkMountOptions(params); err != nil {
+		return nil, err
+	}
 
 	glog.V(4).Infof("Got a request to create volume %s", volumeID)
 
-	client, err := s3.NewClientFromSecret(req.GetSecrets())
+	secrets = volumeSecrets(secrets, params)
+	client, err := cs.clients.Get(ctx, secrets)
 	if err != nil {
-		return nil, fmt.Errorf("failed to initialize S3 client: %s", err)
+		return nil, s3Error(err, "failed to initialize S3 client")
 	}
-
-	exists, err := client.BucketExists(bucketName)
+	if client.Config().Anonymous {
+		return nil, status.Error(codes.InvalidArgument, "anonymous volumes can only be provisioned statically")
+	}
+	// mounters reject settings they don't support, such as s3fs temporary keys
+	meta, err := getMeta(bucketName, prefix, params)
 	if err != nil {
-		return nil, fmt.Errorf("failed to check if bucket %s exists: %v", volumeID, err)
+		return nil, err
+	}
+	if _, err = mounter.New(meta, client.Config()); err != nil {
+		return nil, errdefs.Wrap(errdefs.InvalidArgument, err)
 	}
 
-	if !exists {
-		if err = client.CreateBucket(bucketName); err != nil {
-			return nil, fmt.Errorf("failed to create bucket %s: %v", bucketName, err)
+	bucketStatus, err := client.GetBucketStatus(ctx, bucketName)
+	switch bucketStatus {
+	case s3.BucketInaccessible:
+		// creating a bucket which may exist would fail too
+		return nil, s3Error(err, "bucket %s is inaccessible", bucketName)
+	case s3.BucketNotFound:
+		if err = client.CreateBucket(ctx, bucketName); err != nil {
+			return nil, s3Error(err, "failed to create bucket %s", bucketName)
 		}
 	}
 
-	if err = client.CreatePrefix(bucketName, prefix); err != nil {
-		return nil, fmt.Errorf("failed to create prefix %s: %v", prefix, err)
+	if err = client.CreatePrefix(ctx, bucketName, prefix); err != nil {
+		return nil, s3Error(err, "failed to create prefix %s", prefix)
+	}
+
+	// the metadata object lets the uploads janitor find the volume
+	meta.CapacityBytes = capacityBytes
+	if err = client.SetFSMeta(ctx, meta); err != nil {
+		return nil, s3Error(err, "failed to write the metadata of volume %s", volumeID)
+	}
+	// later requests pick strategies which the backend supports
+	s3.StartCapabilitiesProbe(client, bucketName, prefix)
+
+	if err = s3.CreateScopedCredentials(ctx, client, bucketName, prefix); err != nil {
+		return nil, s3Error(err, "failed to create scoped credentials of volume %s", volumeID)
+	}
+
+	if err = s3.GrantVolumeAccess(ctx, client, bucketName, prefix); err != nil {
+		return nil, s3Error(err, "failed to grant access to volume %s", volumeID)
 	}
 
 	glog.V(4).Infof("create volume %s", volumeID)
+	s3.SetVolumeEndpoint(volumeID, client.Config().Endpoint)
 	// DeleteVolume lacks VolumeContext, but publish&unpublish requests have it,
-	// so we don't need to store additional metadata anywhere
+	// so mounters don't need the stored metadata
 	context := make(map[string]string)
-	for k, v := range params {
+	for k, v := range req.GetParameters() {
 		context[k] = v
 	}
 	context["capacity"] = fmt.Sprintf("%v", capacityBytes)
@@ -120,21 +175,30 @@ func (cs *controllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVol
 	}
 	glog.V(4).Infof("Deleting volume %s", volumeID)
 
-	client, err := s3.NewClientFromSecret(req.GetSecrets())
+	// the volume ID records the backend, since there's no volume context
+	secrets, _, err := applyProfile(volumeID, req.GetSecrets(), nil)
+	if err != nil {
+		return nil, err
+	}
+	client, err := cs.clients.Get(ctx, secrets)
 	if err != nil {
-		return nil, fmt.Errorf("failed to initialize S3 client: %s", err)
+		return nil, s3Error(err, "failed to initialize S3 client")
 	}
 
+	ctx = s3.WithDeleteProgress(ctx, func(removed int) {
+		glog.V(5).Infof("Removed %d objects of volume %s", removed, volumeID)
+	})
+
 	var deleteErr error
 	if prefix == "" {
 		// prefix is empty, we delete the whole bucket
-		if err := client.RemoveBucket(bucketName); err != nil && err.Error() != "The specified bucket does not exist" {
-			deleteErr = err
+		if err := client.RemoveBucket(ctx, bucketName); err != nil {
+			deleteErr = s3Error(err, "unable to remove bucket")
 		}
 		glog.V(4).Infof("Bucket %s removed", bucketName)
 	} else {
-		if err := client.RemovePrefix(bucketName, prefix); err != nil {
-			deleteErr = fmt.Errorf("unable to remove prefix: %w", err)
+		if err := client.RemovePrefix(ctx, bucketName, prefix); err != nil {
+			deleteErr = s3Error(err, "unable to remove prefix")
 		}
 		glog.V(4).Infof("Prefix %s removed", prefix)
 	}
@@ -143,6 +207,14 @@ func (cs *controllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVol
 		return nil, deleteErr
 	}
 
+	if err = s3.RevokeVolumeAccess(ctx, client, bucketName, prefix); err != nil {
+		return nil, s3Error(err, "failed to revoke access to volume %s", volumeID)
+	}
+	if err = s3.RevokeScopedCredentials(ctx, client, bucketName, prefix); err != nil {
+		return nil, s3Error(err, "failed to revoke scoped credentials of volume %s", volumeID)
+	}
+	s3.ForgetVolumeEndpoint(volumeID)
+
 	return &csi.DeleteVolumeResponse{}, nil
 }
 
@@ -156,16 +228,19 @@ func (cs *controllerServer) ValidateVolumeCapabilities(ctx context.Context, req
 	}
 	bucketName, _ := volumeIDToBucketPrefix(req.GetVolumeId())
 
-	client, err := s3.NewClientFromSecret(req.GetSecrets())
+	secrets, volumeContext, err := applyProfile(req.GetVolumeId(), req.GetSecrets(), req.GetVolumeContext())
 	if err != nil {
-		return nil, fmt.Errorf("failed to initialize S3 client: %s", err)
+		return nil, err
 	}
-	exists, err := client.BucketExists(bucketName)
+	client, err := cs.clients.Get(ctx, volumeSecrets(secrets, volumeContext))
 	if err != nil {
-		return nil, err
+		return nil, s3Error(err, "failed to initialize S3 client")
 	}
-
-	if !exists {
+	bucketStatus, err := client.GetBucketStatus(ctx, bucketName)
+	switch bucketStatus {
+	case s3.BucketInaccessible:
+		return nil, s3Error(err, "bucket of volume with id %s is inaccessible", req.GetVolumeId())
+	case s3.BucketNotFound:
 		// return an error if the bucket of the requested volume does not exist
 		return nil, status.Error(codes.NotFound, fmt.Sprintf("bucket of volume with id %s does not exist", req.GetVolumeId()))
 	}
@@ -182,6 +257,7 @@ func (cs *controllerServer) ValidateVolumeCapabilities(ctx context.Context, req
 
 	return &csi.ValidateVolumeCapabilitiesResponse{
 		Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
+			VolumeContext: confirmedVolumeContext(client, req.GetVolumeContext()),
 			VolumeCapabilities: []*csi.VolumeCapability{
 				{
 					AccessMode: supportedAccessMode,
@@ -191,23 +267,62 @@ func (cs *controllerServer) ValidateVolumeCapabilities(ctx context.Context, req
 	}, nil
 }
 
+// confirmedVolumeContext returns the volume context with the optional
+// features of the backend, if they have been probed, as a sorted comma
+// separated list in backendFeatures
+func confirmedVolumeContext(client s3.Client, volumeContext map[string]string) map[string]string {
+	caps, ok := s3.EndpointCapabilities(client.Config().Endpoint)
+	if !ok {
+		return volumeContext
+	}
+	confirmed := make(map[string]string, len(volumeContext)+1)
+	for k, v := range volumeContext {
+		confirmed[k] = v
+	}
+	var features []string
+	for name, supported := range caps.Features() {
+		if supported {
+			features = append(features, name)
+		}
+	}
+	sort.Strings(features)
+	confirmed[backendFeaturesKey] = strings.Join(features, ",")
+	return confirmed
+}
+
 func (cs *controllerServer) ControllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
 	return &csi.ControllerExpandVolumeResponse{}, status.Error(codes.Unimplemented, "ControllerExpandVolume is not implemented")
 }
 
-func sanitizeVolumeID(volumeID string) string {
-	volumeID = strings.ToLower(volumeID)
+// s3Error adds context to an S3 error, which is returned with the gRPC code of its kind
+func s3Error(err error, format string, args ...interface{}) error {
+	return errdefs.Wrapf(s3.ClassifyError(err), format, args...)
+}
+
+func sanitizeVolumeID(prefix, volumeID string) string {
+	volumeID = strings.ToLower(prefix + volumeID)
 	if len(volumeID) > 63 {
 		h := sha1.New()
 		io.WriteString(h, volumeID)
-		volumeID = hex.EncodeToString(h.Sum(nil))
+		volumeID = prefix + hex.EncodeToString(h.Sum(nil))
 	}
 	return volumeID
 }
 
+// splitVolumeBackend returns the backend recorded in the volume ID, if any,
+// and the rest of the ID
+func splitVolumeBackend(volumeID string) (string, string) {
+	bucketName := strings.SplitN(volumeID, "/", 2)[0]
+	if i := strings.Index(bucketName, backendSeparator); i >= 0 {
+		return volumeID[:i], volumeID[i+len(backendSeparator):]
+	}
+	return "", volumeID
+}
+
 // volumeIDToBucketPrefix returns the bucket name and prefix based on the volumeID.
 // Prefix is empty if volumeID does not have a slash in the name.
 func volumeIDToBucketPrefix(volumeID string) (string, string) {
+	_, volumeID = splitVolumeBackend(volumeID)
 	// if the volumeID has a slash in it, this volume is
 	// stored under a certain prefix within the bucket.
 	splitVolumeID := strings.SplitN(volumeID, "/", 2)
@@ -0,0 +1,164 @@
+package driver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	csicommon "github.com/kubernetes-csi/drivers/pkg/csi-common"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/yandex-cloud/k8s-csi-s3/pkg/s3"
+	"github.com/yandex-cloud/k8s-csi-s3/pkg/s3/s3test"
+	"golang.org/x/net/context"
+)
+
+// endpointRecorder is an S3 endpoint without any buckets which counts requests
+type endpointRecorder struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests int
+}
+
+func newEndpointRecorder() *endpointRecorder {
+	e := &endpointRecorder{}
+	e.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e.mu.Lock()
+		e.requests++
+		e.mu.Unlock()
+		w.Header().Set("Content-Type", "application/xml")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`<Error><Code>NoSuchBucket</Code><Message>The specified bucket does not exist</Message></Error>`))
+	}))
+	return e
+}
+
+func (e *endpointRecorder) count() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.requests
+}
+
+var _ = Describe("Volume backends", func() {
+	var (
+		cs               *controllerServer
+		yandex, minio    *endpointRecorder
+		secrets          = map[string]string{"accessKeyID": "id", "secretAccessKey": "secret"}
+		volumeCapability = []*csi.VolumeCapability{{
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+		}}
+	)
+
+	BeforeEach(func() {
+		yandex, minio = newEndpointRecorder(), newEndpointRecorder()
+		setConfig(&Config{
+			Defaults: map[string]string{"backend": "yandex", "addressingStyle": "path"},
+			Backends: map[string]map[string]string{
+				"yandex": {"endpoint": yandex.URL},
+				"minio":  {"endpoint": minio.URL},
+			},
+		})
+		d := csicommon.NewCSIDriver(driverName, vendorVersion, "test-node")
+		d.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{
+			csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+		})
+		cs = &controllerServer{DefaultControllerServer: csicommon.NewDefaultControllerServer(d), clients: newClientCache()}
+	})
+
+	AfterEach(func() {
+		setConfig(&Config{})
+		yandex.Close()
+		minio.Close()
+	})
+
+	It("records the backend in the volume ID", func() {
+		backend, rest := splitVolumeBackend("minio:shared/pvc-1")
+		Expect(backend).To(Equal("minio"))
+		Expect(rest).To(Equal("shared/pvc-1"))
+		bucketName, prefix := volumeIDToBucketPrefix("minio:shared/pvc-1")
+		Expect(bucketName).To(Equal("shared"))
+		Expect(prefix).To(Equal("pvc-1"))
+		backend, _ = splitVolumeBackend("shared/pvc:1")
+		Expect(backend).To(BeEmpty())
+	})
+
+	It("deletes volumes on the backend they were created on", func() {
+		_, err := cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{
+			VolumeId: "minio:pvc-1",
+			Secrets:  secrets,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(minio.count()).NotTo(BeZero())
+		Expect(yandex.count()).To(BeZero())
+	})
+
+	It("validates volumes on the backend they were created on", func() {
+		_, err := cs.ValidateVolumeCapabilities(context.Background(), &csi.ValidateVolumeCapabilitiesRequest{
+			VolumeId:           "minio:pvc-1",
+			Secrets:            secrets,
+			VolumeCapabilities: volumeCapability,
+		})
+		Expect(err).To(HaveOccurred())
+		Expect(minio.count()).NotTo(BeZero())
+		Expect(yandex.count()).To(BeZero())
+	})
+
+	It("uses the default backend for volumes without one in the ID", func() {
+		_, err := cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: "pvc-1", Secrets: secrets})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(yandex.count()).NotTo(BeZero())
+		Expect(minio.count()).To(BeZero())
+	})
+})
+
+var _ = Describe("Backend capabilities", func() {
+	var (
+		cs   *controllerServer
+		fake *s3test.Server
+	)
+
+	BeforeEach(func() {
+		fake = s3test.NewServer()
+		fake.CreateBucket("shared", false)
+		d := csicommon.NewCSIDriver(driverName, vendorVersion, "test-node")
+		d.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{
+			csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+		})
+		cs = &controllerServer{DefaultControllerServer: csicommon.NewDefaultControllerServer(d), clients: newClientCache()}
+	})
+
+	AfterEach(func() {
+		fake.Close()
+	})
+
+	It("probes the backend in the created volume and confirms its features", func() {
+		secrets := map[string]string{"accessKeyID": "id", "secretAccessKey": "secret", "endpoint": fake.URL}
+		volumeCapabilities := []*csi.VolumeCapability{{
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+		}}
+		resp, err := cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+			Name:               "pvc-1",
+			Parameters:         map[string]string{"bucket": "shared"},
+			Secrets:            secrets,
+			VolumeCapabilities: volumeCapabilities,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Eventually(func() bool {
+			_, ok := s3.EndpointCapabilities(fake.URL)
+			return ok
+		}).Should(BeTrue())
+		Expect(fake.Keys("shared")).To(Equal([]string{"pvc-1/", "pvc-1/.metadata.json"}))
+
+		validated, err := cs.ValidateVolumeCapabilities(context.Background(), &csi.ValidateVolumeCapabilitiesRequest{
+			VolumeId:           resp.GetVolume().GetVolumeId(),
+			VolumeContext:      resp.GetVolume().GetVolumeContext(),
+			Secrets:            secrets,
+			VolumeCapabilities: volumeCapabilities,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(validated.GetConfirmed().GetVolumeContext()).To(HaveKeyWithValue(backendFeaturesKey,
+			"conditionalWrites,multiObjectDelete,objectLock,tagging"))
+		Expect(validated.GetConfirmed().GetVolumeContext()).To(HaveKeyWithValue("bucket", "shared"))
+	})
+})
@@ -0,0 +1,163 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/yandex-cloud/k8s-csi-s3/pkg/mounter"
+	"golang.org/x/net/context"
+)
+
+const (
+	credentialsCheckInterval = time.Minute
+	// Renew temporary credentials of mounted volumes this long before they expire
+	credentialsRenewWindow = 10 * time.Minute
+)
+
+// stagedVolume is stored next to the credentials of the volume, so that
+// the refresher can renew them after the node plugin restarts
+type stagedVolume struct {
+	VolumeID      string            `json:"volumeID"`
+	VolumeContext map[string]string `json:"volumeContext"`
+	Secrets       map[string]string `json:"secrets"`
+	Expires       time.Time         `json:"expires"`
+	// ScopedAccessKeyID is the key which the node obtained for the volume
+	// with scoped credentials, it's removed when the volume is unstaged
+	ScopedAccessKeyID string `json:"scopedAccessKeyID,omitempty"`
+}
+
+// due tells if the keys of the volume have to be renewed
+func (vol *stagedVolume) due() bool {
+	return !vol.Expires.IsZero() && time.Until(vol.Expires) < credentialsRenewWindow
+}
+
+// credentialsRefresher renews temporary credentials which the node plugin
+// obtained for staged volumes by assuming a role
+type credentialsRefresher struct {
+	mu      sync.Mutex
+	volumes map[string]*stagedVolume
+}
+
+// newCredentialsRefresher returns a refresher which tracks the volumes
+// tracked before the node plugin restarted
+func newCredentialsRefresher() *credentialsRefresher {
+	r := &credentialsRefresher{
+		volumes: make(map[string]*stagedVolume),
+	}
+	states, err := mounter.ReadVolumeStates()
+	if err != nil {
+		glog.Errorf("s3: failed to read the states of staged volumes: %v", err)
+	}
+	for _, state := range states {
+		vol := &stagedVolume{}
+		if err = json.Unmarshal(state, vol); err != nil || vol.VolumeID == "" {
+			glog.Errorf("s3: invalid state of a staged volume: %v", err)
+			continue
+		}
+		r.volumes[vol.VolumeID] = vol
+	}
+	return r
+}
+
+// save stores the volume so that it's still tracked after a restart
+func (r *credentialsRefresher) save(vol *stagedVolume) {
+	state, err := json.Marshal(vol)
+	if err == nil {
+		err = mounter.WriteVolumeState(vol.VolumeID, state)
+	}
+	if err != nil {
+		glog.Errorf("s3: failed to store the state of volume %s: %v", vol.VolumeID, err)
+	}
+}
+
+// track starts renewing credentials of the volume if they expire and keeps
+// the scoped keys of the volume until it's unstaged
+func (r *credentialsRefresher) track(vol *stagedVolume) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if vol.Expires.IsZero() && vol.ScopedAccessKeyID == "" {
+		if _, ok := r.volumes[vol.VolumeID]; ok {
+			delete(r.volumes, vol.VolumeID)
+			if err := mounter.RemoveVolumeState(vol.VolumeID); err != nil {
+				glog.Errorf("s3: failed to remove the state of volume %s: %v", vol.VolumeID, err)
+			}
+		}
+		return
+	}
+	tracked := *vol
+	r.volumes[vol.VolumeID] = &tracked
+	r.save(&tracked)
+}
+
+// get returns a copy of the tracked state of the volume or nil
+func (r *credentialsRefresher) get(volumeID string) *stagedVolume {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	vol, ok := r.volumes[volumeID]
+	if !ok {
+		return nil
+	}
+	tracked := *vol
+	return &tracked
+}
+
+func (r *credentialsRefresher) forget(volumeID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.volumes, volumeID)
+	if err := mounter.RemoveVolumeState(volumeID); err != nil {
+		glog.Errorf("s3: failed to remove the state of volume %s: %v", volumeID, err)
+	}
+}
+
+func (r *credentialsRefresher) run() {
+	for range time.Tick(credentialsCheckInterval) {
+		r.refresh()
+	}
+}
+
+func (r *credentialsRefresher) refresh() {
+	var due []stagedVolume
+	r.mu.Lock()
+	for _, vol := range r.volumes {
+		if vol.due() {
+			due = append(due, *vol)
+		}
+	}
+	r.mu.Unlock()
+
+	for i := range due {
+		prev := &due[i]
+		vol := *prev
+		if err := updateCredentials(context.Background(), &vol, prev); err != nil {
+			glog.Errorf("s3: failed to renew credentials of volume %s: %v", vol.VolumeID, err)
+			continue
+		}
+		r.mu.Lock()
+		// the volume may have been unstaged in the meantime
+		if tracked, ok := r.volumes[vol.VolumeID]; ok {
+			tracked.Expires = vol.Expires
+			tracked.ScopedAccessKeyID = vol.ScopedAccessKeyID
+			r.save(tracked)
+		}
+		r.mu.Unlock()
+	}
+}
@@ -0,0 +1,81 @@
+package driver
+
+import (
+	"io/ioutil"
+	"os"
+	"time"
+
+	"golang.org/x/net/context"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("credentialsRefresher", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "csi-s3-credentials")
+		Expect(err).NotTo(HaveOccurred())
+		os.Setenv("CREDENTIALS_DIR", dir)
+	})
+
+	AfterEach(func() {
+		os.Unsetenv("CREDENTIALS_DIR")
+		os.RemoveAll(dir)
+	})
+
+	It("keeps tracking staged volumes after a restart", func() {
+		expires := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+		secrets := map[string]string{"awsRoleArn": "arn:aws:iam::123456789012:role/csi-s3"}
+		volumeContext := map[string]string{"mounter": "geesefs"}
+		newCredentialsRefresher().track(&stagedVolume{
+			VolumeID:      "bucket/pvc-1",
+			VolumeContext: volumeContext,
+			Secrets:       secrets,
+			Expires:       expires,
+		})
+
+		r := newCredentialsRefresher()
+		Expect(r.volumes).To(HaveKey("bucket/pvc-1"))
+		vol := r.volumes["bucket/pvc-1"]
+		Expect(vol.Secrets).To(Equal(secrets))
+		Expect(vol.VolumeContext).To(Equal(volumeContext))
+		Expect(vol.Expires.Equal(expires)).To(BeTrue())
+
+		r.forget("bucket/pvc-1")
+		Expect(newCredentialsRefresher().volumes).To(BeEmpty())
+	})
+
+	It("stops tracking volumes whose keys don't expire anymore", func() {
+		r := newCredentialsRefresher()
+		r.track(&stagedVolume{VolumeID: "pvc-1", Expires: time.Now().Add(time.Hour)})
+		r.track(&stagedVolume{VolumeID: "pvc-1"})
+		Expect(newCredentialsRefresher().volumes).To(BeEmpty())
+	})
+
+	It("keeps tracking scoped keys which don't expire until the volume is unstaged", func() {
+		r := newCredentialsRefresher()
+		r.track(&stagedVolume{VolumeID: "pvc-1", ScopedAccessKeyID: "SCOPED"})
+		Expect(newCredentialsRefresher().get("pvc-1").ScopedAccessKeyID).To(Equal("SCOPED"))
+		r.forget("pvc-1")
+		Expect(r.get("pvc-1")).To(BeNil())
+	})
+
+	It("doesn't request new keys while the keys of the volume are current", func() {
+		// the mounter is unknown, so any attempt to request keys fails
+		prev := &stagedVolume{
+			VolumeID:          "pvc-1",
+			Expires:           time.Now().Add(time.Hour),
+			ScopedAccessKeyID: "SCOPED",
+		}
+		vol := &stagedVolume{VolumeID: "pvc-1", VolumeContext: map[string]string{"mounter": "foo"}}
+		Expect(updateCredentials(context.Background(), vol, prev)).To(Succeed())
+		Expect(vol.Expires).To(Equal(prev.Expires))
+		Expect(vol.ScopedAccessKeyID).To(Equal("SCOPED"))
+
+		prev.Expires = time.Now().Add(time.Minute)
+		Expect(updateCredentials(context.Background(), vol, prev)).NotTo(Succeed())
+	})
+})
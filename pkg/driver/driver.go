@@ -17,24 +17,50 @@ limitations under the License.
 package driver
 
 import (
+	"fmt"
+	"time"
+
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/golang/glog"
 
 	csicommon "github.com/kubernetes-csi/drivers/pkg/csi-common"
+	"github.com/yandex-cloud/k8s-csi-s3/pkg/mounter"
+	"github.com/yandex-cloud/k8s-csi-s3/pkg/s3"
+)
+
+// Modes select the services the driver serves. The controller runs in a
+// Deployment and the node service in a privileged DaemonSet.
+const (
+	ModeController = "controller"
+	ModeNode       = "node"
+	ModeAll        = "all"
 )
 
 type driver struct {
 	driver   *csicommon.CSIDriver
 	endpoint string
+	mode     string
 
 	ids *identityServer
 	ns  *nodeServer
 	cs  *controllerServer
+
+	// clients are shared by the controller and the configuration
+	clients *s3.ClientCache
+
+	server *server
+
+	// uploadsMaxAge enables aborting older multipart uploads every uploadsInterval
+	uploadsMaxAge   time.Duration
+	uploadsInterval time.Duration
 }
 
 var (
 	vendorVersion = "v1.34.7"
 	driverName    = "ru.yandex.s3.csi"
+
+	// checkHost is replaced in tests
+	checkHost = mounter.CheckHost
 )
 
 // New initializes the driver
@@ -47,42 +73,117 @@ func New(nodeID string, endpoint string) (*driver, error) {
 	s3Driver := &driver{
 		endpoint: endpoint,
 		driver:   d,
+		mode:     ModeAll,
+		clients:  newClientCache(),
+		server:   newServer(),
 	}
 	return s3Driver, nil
 }
 
+// AbortOldUploads makes the controller abort multipart uploads older than
+// maxAge in the volumes of the configured backends every interval
+func (s3 *driver) AbortOldUploads(maxAge, interval time.Duration) {
+	s3.uploadsMaxAge = maxAge
+	s3.uploadsInterval = interval
+}
+
+// SetMode makes the driver serve only the controller or the node service
+func (s3 *driver) SetMode(mode string) error {
+	switch mode {
+	case ModeController, ModeNode, ModeAll:
+		s3.mode = mode
+		return nil
+	}
+	return fmt.Errorf("unknown mode %q, must be %q, %q or %q", mode, ModeController, ModeNode, ModeAll)
+}
+
+func (s3 *driver) servesController() bool {
+	return s3.mode != ModeNode
+}
+
+func (s3 *driver) servesNode() bool {
+	return s3.mode != ModeController
+}
+
+// checkNode returns an error if the node service can't mount volumes. Without
+// --mode=node the driver may also run as the controller, e.g. in Deployments
+// from before the modes, so it only warns then.
+func (s3 *driver) checkNode() error {
+	err := checkHost()
+	if err != nil && s3.mode != ModeNode {
+		glog.Warningf("Node can't mount volumes: %v", err)
+		return nil
+	}
+	return err
+}
+
 func (s3 *driver) newIdentityServer(d *csicommon.CSIDriver) *identityServer {
 	return &identityServer{
 		DefaultIdentityServer: csicommon.NewDefaultIdentityServer(d),
+		controller:            s3.servesController(),
 	}
 }
 
 func (s3 *driver) newControllerServer(d *csicommon.CSIDriver) *controllerServer {
-	return &controllerServer{
+	cs := &controllerServer{
 		DefaultControllerServer: csicommon.NewDefaultControllerServer(d),
+		clients:                 s3.clients,
 	}
+	if s3.uploadsMaxAge > 0 {
+		cs.uploads = newUploadsJanitor(cs.clients, s3.uploadsMaxAge)
+		go cs.uploads.run(s3.uploadsInterval)
+	}
+	return cs
 }
 
 func (s3 *driver) newNodeServer(d *csicommon.CSIDriver) *nodeServer {
-	return &nodeServer{
+	ns := &nodeServer{
 		DefaultNodeServer: csicommon.NewDefaultNodeServer(d),
+		refresher:         newCredentialsRefresher(),
 	}
+	go ns.refresher.run()
+	return ns
 }
 
 func (s3 *driver) Run() {
 	glog.Infof("Driver: %v ", driverName)
 	glog.Infof("Version: %v ", vendorVersion)
-	// Initialize default library driver
+	glog.Infof("Mode: %v ", s3.mode)
+
+	if s3.servesNode() {
+		if err := s3.checkNode(); err != nil {
+			glog.Fatalf("Node can't mount volumes: %v", err)
+		}
+	}
 
-	s3.driver.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME})
+	// Initialize default library driver
+	if s3.servesController() {
+		s3.driver.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME})
+	}
 	s3.driver.AddVolumeCapabilityAccessModes([]csi.VolumeCapability_AccessMode_Mode{csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER})
 
-	// Create GRPC servers
+	// Create GRPC servers, nil ones aren't registered
+	var cs csi.ControllerServer
+	var ns csi.NodeServer
 	s3.ids = s3.newIdentityServer(s3.driver)
-	s3.ns = s3.newNodeServer(s3.driver)
-	s3.cs = s3.newControllerServer(s3.driver)
+	if s3.servesNode() {
+		s3.ns = s3.newNodeServer(s3.driver)
+		ns = s3.ns
+	}
+	if s3.servesController() {
+		s3.cs = s3.newControllerServer(s3.driver)
+		cs = s3.cs
+	}
+
+	s3.server.register(s3.ids, cs, ns)
+	if err := s3.server.serve(s3.endpoint); err != nil {
+		glog.Fatalf("Failed to serve: %v", err)
+	}
+}
 
-	s := csicommon.NewNonBlockingGRPCServer()
-	s.Start(s3.endpoint, s3.ids, s3.cs, s3.ns)
-	s.Wait()
+// Shutdown stops accepting requests and waits for the ones in progress for
+// up to timeout, then Run returns. Volumes with requests still in progress
+// are logged.
+func (s3 *driver) Shutdown(timeout time.Duration) {
+	s3.server.stop(timeout)
 }
@@ -17,9 +17,20 @@ limitations under the License.
 package driver
 
 import (
+	"github.com/container-storage-interface/spec/lib/go/csi"
 	csicommon "github.com/kubernetes-csi/drivers/pkg/csi-common"
+	"golang.org/x/net/context"
 )
 
 type identityServer struct {
 	*csicommon.DefaultIdentityServer
+	// controller is false if the controller service isn't served
+	controller bool
+}
+
+func (ids *identityServer) GetPluginCapabilities(ctx context.Context, req *csi.GetPluginCapabilitiesRequest) (*csi.GetPluginCapabilitiesResponse, error) {
+	if ids.controller {
+		return ids.DefaultIdentityServer.GetPluginCapabilities(ctx, req)
+	}
+	return &csi.GetPluginCapabilitiesResponse{}, nil
 }
@@ -0,0 +1,40 @@
+package driver
+
+import (
+	"errors"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+)
+
+var _ = Describe("Mode", func() {
+	It("rejects unknown modes", func() {
+		d, err := New("test-node", "unix:///tmp/csi-mode.sock")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(d.SetMode("standalone")).NotTo(Succeed())
+		Expect(d.mode).To(Equal(ModeAll))
+	})
+
+	It("fails only the node mode on hosts without FUSE", func() {
+		defer func(check func() error) { checkHost = check }(checkHost)
+		checkHost = func() error { return errors.New("FUSE is not available") }
+		d, err := New("test-node", "unix:///tmp/csi-mode.sock")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(d.checkNode()).To(Succeed())
+		Expect(d.SetMode(ModeNode)).To(Succeed())
+		Expect(d.checkNode()).NotTo(Succeed())
+	})
+
+	It("advertises the controller service only if it's served", func() {
+		for mode, services := range map[string]int{ModeAll: 1, ModeController: 1, ModeNode: 0} {
+			d, err := New("test-node", "unix:///tmp/csi-mode.sock")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(d.SetMode(mode)).To(Succeed())
+			resp, err := d.newIdentityServer(d.driver).GetPluginCapabilities(context.Background(), &csi.GetPluginCapabilitiesRequest{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.GetCapabilities()).To(HaveLen(services), mode)
+		}
+	})
+})
@@ -17,13 +17,13 @@ limitations under the License.
 package driver
 
 import (
-	"fmt"
 	"os"
 	"os/exec"
 	"regexp"
 	"strconv"
 
 	"github.com/golang/glog"
+	"github.com/yandex-cloud/k8s-csi-s3/pkg/errdefs"
 	"github.com/yandex-cloud/k8s-csi-s3/pkg/mounter"
 	"github.com/yandex-cloud/k8s-csi-s3/pkg/s3"
 	"golang.org/x/net/context"
@@ -38,11 +38,11 @@ import (
 
 type nodeServer struct {
 	*csicommon.DefaultNodeServer
+	refresher *credentialsRefresher
 }
 
-func getMeta(bucketName, prefix string, context map[string]string) *s3.FSMeta {
+func parseMountOptions(mountOptStr string) []string {
 	mountOptions := make([]string, 0)
-	mountOptStr := context[mounter.OptionsKey]
 	if mountOptStr != "" {
 		re, _ := regexp.Compile(`([^\s"]+|"([^"\\]+|\\")*")+`)
 		re2, _ := regexp.Compile(`"([^"\\]+|\\")*"`)
@@ -55,14 +55,70 @@ func getMeta(bucketName, prefix string, context map[string]string) *s3.FSMeta {
 			mountOptions = append(mountOptions, string(opt))
 		}
 	}
+	return mountOptions
+}
+
+// checkMountOptions validates mount options from the volume context or
+// StorageClass parameters against the mounter option policy
+func checkMountOptions(context map[string]string) error {
+	mountOptions := parseMountOptions(context[mounter.OptionsKey])
+	if err := mounter.CheckOptions(context[mounter.TypeKey], mountOptions); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	return nil
+}
+
+// Static PVs of public buckets set these keys in their volume attributes
+// and don't need a secret at all
+var anonymousKeys = []string{"anonymous", "endpoint", "region"}
+
+// Connection settings may also be set in StorageClass parameters or volume
+// attributes, but only if the secret doesn't set them. Client certificates
+// are only taken from secrets.
+var transportKeys = []string{"caBundle", "insecureSkipVerify", "proxyURL"}
+
+// The retry policy may be set per StorageClass too
+var retryKeys = []string{"retryMaxAttempts", "retryInitialBackoff", "retryMaxBackoff", "retryBudget"}
+
+// volumeSecrets returns secrets with the connection settings, the retry
+// policy and the keys of anonymous volumes from the volume context. Volume
+// attributes of static volumes aren't trusted like secrets, so connection
+// settings of the secret aren't overridden: a volume can't redirect the
+// requests of the driver through another proxy or disable certificate checks.
+func volumeSecrets(secrets, volumeContext map[string]string) map[string]string {
+	keys := append([]string{}, retryKeys...)
+	if volumeContext["anonymous"] == "true" {
+		keys = append(keys, anonymousKeys...)
+	}
+	merged := make(map[string]string, len(secrets)+len(keys)+len(transportKeys))
+	for k, v := range secrets {
+		merged[k] = v
+	}
+	for _, k := range keys {
+		if v := volumeContext[k]; v != "" {
+			merged[k] = v
+		}
+	}
+	for _, k := range transportKeys {
+		if v := volumeContext[k]; v != "" && merged[k] == "" {
+			merged[k] = v
+		}
+	}
+	return merged
+}
+
+func getMeta(bucketName, prefix string, context map[string]string) (*s3.FSMeta, error) {
+	if err := checkMountOptions(context); err != nil {
+		return nil, err
+	}
 	capacity, _ := strconv.ParseInt(context["capacity"], 10, 64)
 	return &s3.FSMeta{
 		BucketName:    bucketName,
 		Prefix:        prefix,
 		Mounter:       context[mounter.TypeKey],
-		MountOptions:  mountOptions,
+		MountOptions:  parseMountOptions(context[mounter.OptionsKey]),
 		CapacityBytes: capacity,
-	}
+	}, nil
 }
 
 func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
@@ -84,6 +140,16 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 		return nil, status.Error(codes.InvalidArgument, "Target path missing in request")
 	}
 
+	// Secrets are passed on every publish, so pick up rotated keys here
+	if len(req.GetSecrets()) > 0 {
+		vol := &stagedVolume{VolumeID: volumeID, VolumeContext: req.GetVolumeContext(), Secrets: req.GetSecrets()}
+		if err := updateCredentials(ctx, vol, ns.refresher.get(volumeID)); err != nil {
+			glog.Errorf("s3: failed to update credentials of volume %s: %v", volumeID, err)
+		} else {
+			ns.refresher.track(vol)
+		}
+	}
+
 	notMnt, err := checkMount(targetPath)
 	if err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
@@ -105,7 +171,7 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 	glog.V(3).Infof("Binding volume %v from %v to %v", volumeID, stagingTargetPath, targetPath)
 	out, err := cmd.Output()
 	if err != nil {
-		return nil, fmt.Errorf("Error running mount --bind %v %v: %s", stagingTargetPath, targetPath, out)
+		return nil, errdefs.New(errdefs.MountFailed, "Error running mount --bind %v %v: %s", stagingTargetPath, targetPath, out)
 	}
 
 	glog.V(4).Infof("s3: volume %s successfully mounted to %s", volumeID, targetPath)
@@ -158,19 +224,51 @@ func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVol
 	if !notMnt {
 		return &csi.NodeStageVolumeResponse{}, nil
 	}
-	client, err := s3.NewClientFromSecret(req.GetSecrets())
+	secrets, volumeContext, err := applyProfile(volumeID, req.GetSecrets(), req.GetVolumeContext())
 	if err != nil {
-		return nil, fmt.Errorf("failed to initialize S3 client: %s", err)
+		return nil, err
+	}
+	client, err := s3.NewClientFromSecret(ctx, volumeSecrets(secrets, volumeContext))
+	if err != nil {
+		return nil, s3Error(err, "failed to initialize S3 client")
 	}
 
-	meta := getMeta(bucketName, prefix, req.VolumeContext)
-	mounter, err := mounter.New(meta, client.Config())
+	meta, err := getMeta(bucketName, prefix, volumeContext)
 	if err != nil {
 		return nil, err
 	}
-	if err := mounter.Mount(stagingTargetPath, volumeID); err != nil {
+	// Mounters can't assume roles by themselves
+	cfg, err := s3.ResolveCredentials(ctx, client.Config())
+	if err != nil {
+		return nil, s3Error(err, "failed to get credentials of volume %s", volumeID)
+	}
+	if cfg, err = s3.ScopeCredentials(ctx, cfg, bucketName, prefix); err != nil {
+		return nil, s3Error(err, "failed to scope credentials of volume %s", volumeID)
+	}
+	vol := &stagedVolume{
+		VolumeID:      volumeID,
+		VolumeContext: req.GetVolumeContext(),
+		Secrets:       req.GetSecrets(),
+		Expires:       cfg.Expires,
+	}
+	if cfg.ScopedCredentials != "" {
+		vol.ScopedAccessKeyID = cfg.AccessKeyID
+	}
+	// mounters reject options and settings they don't support
+	fsMounter, err := mounter.New(meta, cfg)
+	if err == nil {
+		if err = fsMounter.Mount(stagingTargetPath, volumeID); err != nil {
+			err = errdefs.Wrap(errdefs.MountFailed, err)
+		}
+	} else {
+		err = errdefs.Wrap(errdefs.InvalidArgument, err)
+	}
+	if err != nil {
+		releaseScopedKeys(ctx, cfg, vol)
 		return nil, err
 	}
+	ns.refresher.track(vol)
+	s3.SetVolumeEndpoint(volumeID, cfg.Endpoint)
 
 	return &csi.NodeStageVolumeResponse{}, nil
 }
@@ -201,11 +299,115 @@ func (ns *nodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstag
 	if !exists {
 		err = mounter.FuseUnmount(stagingTargetPath)
 	}
+	if vol := ns.refresher.get(volumeID); vol != nil && vol.ScopedAccessKeyID != "" {
+		if cfg, err := volumeConfig(ctx, vol); err != nil {
+			glog.Errorf("s3: failed to remove scoped keys of volume %s: %v", volumeID, err)
+		} else {
+			releaseScopedKeys(ctx, cfg, vol)
+		}
+	}
+	ns.refresher.forget(volumeID)
+	s3.ForgetVolumeEndpoint(volumeID)
+	if err := mounter.RemoveCredentials(volumeID); err != nil {
+		glog.Errorf("s3: %v", err)
+	}
 	glog.V(4).Infof("s3: volume %s has been unmounted from stage path %v.", volumeID, stagingTargetPath)
 
 	return &csi.NodeUnstageVolumeResponse{}, nil
 }
 
+// updateCredentials switches an already staged volume to the keys from the
+// secrets of vol if they were rotated since the volume was mounted, or to
+// renewed keys of an assumed role, and sets the expiration of the new keys
+// in vol. Keys which prev, the state of the staged volume, holds are kept
+// until they're due for renewal, so that temporary and scoped keys aren't
+// requested again on every publish.
+func updateCredentials(ctx context.Context, vol, prev *stagedVolume) error {
+	if prev != nil && !prev.due() {
+		vol.Expires = prev.Expires
+		vol.ScopedAccessKeyID = prev.ScopedAccessKeyID
+		return nil
+	}
+	bucketName, prefix := volumeIDToBucketPrefix(vol.VolumeID)
+	_, volumeContext, err := applyProfile(vol.VolumeID, vol.Secrets, vol.VolumeContext)
+	if err != nil {
+		return err
+	}
+	meta, err := getMeta(bucketName, prefix, volumeContext)
+	if err != nil {
+		return err
+	}
+	cfg, err := volumeConfig(ctx, vol)
+	if err != nil {
+		return err
+	}
+	if cfg, err = s3.ScopeCredentials(ctx, cfg, bucketName, prefix); err != nil {
+		return err
+	}
+	next := *vol
+	next.Expires = cfg.Expires
+	if cfg.ScopedCredentials != "" {
+		next.ScopedAccessKeyID = cfg.AccessKeyID
+	}
+	fsMounter, err := mounter.New(meta, cfg)
+	if err != nil {
+		releaseScopedKeys(ctx, cfg, &next)
+		return err
+	}
+	updater, ok := fsMounter.(mounter.CredentialsUpdater)
+	if !ok {
+		glog.V(4).Infof("s3: mounter of volume %s can't update credentials without remounting", vol.VolumeID)
+		releaseScopedKeys(ctx, cfg, &next)
+		if prev != nil {
+			vol.Expires = prev.Expires
+			vol.ScopedAccessKeyID = prev.ScopedAccessKeyID
+		}
+		return nil
+	}
+	updated, err := updater.UpdateCredentials(vol.VolumeID)
+	if err != nil {
+		releaseScopedKeys(ctx, cfg, &next)
+		return err
+	}
+	if updated {
+		glog.Infof("s3: credentials of volume %s have been updated", vol.VolumeID)
+	}
+	if prev != nil && prev.ScopedAccessKeyID != "" && prev.ScopedAccessKeyID != next.ScopedAccessKeyID {
+		// the mounter doesn't use the superseded keys anymore
+		releaseScopedKeys(ctx, cfg, prev)
+	}
+	*vol = next
+	return nil
+}
+
+// volumeConfig returns the configuration of the volume with the keys
+// obtained from its secrets, before they're scoped to the volume
+func volumeConfig(ctx context.Context, vol *stagedVolume) (*s3.Config, error) {
+	secrets, volumeContext, err := applyProfile(vol.VolumeID, vol.Secrets, vol.VolumeContext)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := s3.LoadConfig(ctx, volumeSecrets(secrets, volumeContext))
+	if err != nil {
+		return nil, err
+	}
+	// scoped credentials are requested from a healthy endpoint
+	return s3.ResolveCredentials(ctx, s3.HealthyEndpoint(ctx, cfg))
+}
+
+// releaseScopedKeys removes the scoped keys of vol, cfg has the keys they
+// were obtained with. Failures are only logged, the keys are removed with
+// the user of the volume anyway.
+func releaseScopedKeys(ctx context.Context, cfg *s3.Config, vol *stagedVolume) {
+	if vol.ScopedAccessKeyID == "" {
+		return
+	}
+	bucketName, prefix := volumeIDToBucketPrefix(vol.VolumeID)
+	if err := s3.ReleaseScopedCredentials(ctx, cfg, bucketName, prefix, vol.ScopedAccessKeyID); err != nil {
+		glog.Errorf("s3: failed to remove scoped keys of volume %s: %v", vol.VolumeID, err)
+	}
+}
+
 // NodeGetCapabilities returns the supported capabilities of the node server
 func (ns *nodeServer) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
 	// currently there is a single NodeServer capability according to the spec
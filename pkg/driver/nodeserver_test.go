@@ -0,0 +1,34 @@
+package driver
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("volumeSecrets", func() {
+	It("doesn't let the volume context override connection settings of the secret", func() {
+		secrets := volumeSecrets(map[string]string{
+			"endpoint": "https://s3.example.com",
+			"caBundle": "secret-ca",
+			"proxyURL": "http://proxy.example.com:3128",
+		}, map[string]string{
+			"caBundle":           "volume-ca",
+			"proxyURL":           "http://other.example.com:3128",
+			"insecureSkipVerify": "true",
+			"retryMaxAttempts":   "3",
+		})
+		Expect(secrets).To(Equal(map[string]string{
+			"endpoint":           "https://s3.example.com",
+			"caBundle":           "secret-ca",
+			"proxyURL":           "http://proxy.example.com:3128",
+			"insecureSkipVerify": "true",
+			"retryMaxAttempts":   "3",
+		}))
+	})
+
+	It("keeps insecureSkipVerify of the secret", func() {
+		secrets := volumeSecrets(map[string]string{"insecureSkipVerify": "false"},
+			map[string]string{"insecureSkipVerify": "true"})
+		Expect(secrets["insecureSkipVerify"]).To(Equal("false"))
+	})
+})
@@ -0,0 +1,176 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"net"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/glog"
+	"github.com/kubernetes-csi/csi-lib-utils/protosanitizer"
+	csicommon "github.com/kubernetes-csi/drivers/pkg/csi-common"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+// server serves the CSI services like the csi-common server, but keeps
+// track of the requests in progress, so that it can be stopped gracefully
+type server struct {
+	grpc *grpc.Server
+
+	mu       sync.Mutex
+	next     uint64
+	requests map[uint64]*request
+
+	stopOnce sync.Once
+	// stopped is closed when the requests are drained or given up
+	stopped chan struct{}
+}
+
+// request is an RPC in progress
+type request struct {
+	method   string
+	volumeID string
+	started  time.Time
+}
+
+func newServer() *server {
+	s := &server{
+		requests: make(map[uint64]*request),
+		stopped:  make(chan struct{}),
+	}
+	s.grpc = grpc.NewServer(grpc.UnaryInterceptor(s.intercept))
+	return s
+}
+
+func (s *server) register(ids csi.IdentityServer, cs csi.ControllerServer, ns csi.NodeServer) {
+	csi.RegisterIdentityServer(s.grpc, ids)
+	if cs != nil {
+		csi.RegisterControllerServer(s.grpc, cs)
+	}
+	if ns != nil {
+		csi.RegisterNodeServer(s.grpc, ns)
+	}
+}
+
+// serve accepts connections at the endpoint until the server is stopped,
+// and then waits for the requests to finish
+func (s *server) serve(endpoint string) error {
+	proto, addr, err := csicommon.ParseEndpoint(endpoint)
+	if err != nil {
+		return err
+	}
+	if proto == "unix" {
+		addr = "/" + addr
+		if err := os.Remove(addr); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	listener, err := net.Listen(proto, addr)
+	if err != nil {
+		return err
+	}
+	glog.Infof("Listening for connections on address: %#v", listener.Addr())
+	if err = s.grpc.Serve(listener); err != nil && err != grpc.ErrServerStopped {
+		return err
+	}
+	<-s.stopped
+	return nil
+}
+
+// stop stops accepting requests and waits for the ones in progress for up
+// to timeout. Requests which are still running then are logged and cancelled.
+func (s *server) stop(timeout time.Duration) {
+	s.stopOnce.Do(func() {
+		defer close(s.stopped)
+		drained := make(chan struct{})
+		go func() {
+			s.grpc.GracefulStop()
+			close(drained)
+		}()
+		select {
+		case <-drained:
+			glog.Infof("All requests finished")
+		case <-time.After(timeout):
+			for _, req := range s.inProgress() {
+				glog.Warningf("Stopping with %s of volume %s in progress for %v",
+					req.method, req.volumeID, time.Since(req.started).Round(time.Second))
+			}
+			s.grpc.Stop()
+		}
+	})
+}
+
+// inProgress returns the requests in progress, the oldest first
+func (s *server) inProgress() []*request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	requests := make([]*request, 0, len(s.requests))
+	for _, req := range s.requests {
+		requests = append(requests, req)
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		return requests[i].started.Before(requests[j].started)
+	})
+	return requests
+}
+
+func (s *server) track(method, volumeID string) func() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := s.next
+	s.next++
+	s.requests[id] = &request{method: method, volumeID: volumeID, started: time.Now()}
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.requests, id)
+	}
+}
+
+// requestVolumeID returns the volume of a request, or the name of the
+// volume to be created
+func requestVolumeID(req interface{}) string {
+	switch r := req.(type) {
+	case interface{ GetVolumeId() string }:
+		return r.GetVolumeId()
+	case *csi.CreateVolumeRequest:
+		return r.GetName()
+	}
+	return ""
+}
+
+// intercept tracks and logs requests like the csi-common server does
+func (s *server) intercept(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if volumeID := requestVolumeID(req); volumeID != "" {
+		defer s.track(path.Base(info.FullMethod), volumeID)()
+	}
+	glog.V(3).Infof("GRPC call: %s", info.FullMethod)
+	glog.V(5).Infof("GRPC request: %s", protosanitizer.StripSecrets(req))
+	resp, err := handler(ctx, req)
+	if err != nil {
+		glog.Errorf("GRPC error: %v", err)
+	} else {
+		glog.V(5).Infof("GRPC response: %s", protosanitizer.StripSecrets(resp))
+	}
+	return resp, err
+}
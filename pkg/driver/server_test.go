@@ -0,0 +1,99 @@
+package driver
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+// stagingNodeServer blocks NodeStageVolume until release is closed
+type stagingNodeServer struct {
+	csi.NodeServer
+	staging chan struct{}
+	release chan struct{}
+}
+
+func (ns *stagingNodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
+	close(ns.staging)
+	select {
+	case <-ns.release:
+	case <-ctx.Done():
+	}
+	return &csi.NodeStageVolumeResponse{}, nil
+}
+
+var _ = Describe("Server", func() {
+	var (
+		dir    string
+		s      *server
+		ns     *stagingNodeServer
+		served chan error
+		conn   *grpc.ClientConn
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "csi-s3-server")
+		Expect(err).NotTo(HaveOccurred())
+		socket := filepath.Join(dir, "csi.sock")
+
+		s = newServer()
+		ns = &stagingNodeServer{staging: make(chan struct{}), release: make(chan struct{})}
+		s.register(&identityServer{}, nil, ns)
+		served = make(chan error, 1)
+		go func() {
+			served <- s.serve("unix:/" + socket)
+		}()
+		Eventually(func() error {
+			_, err := os.Stat(socket)
+			return err
+		}).Should(Succeed())
+
+		conn, err = grpc.Dial(socket, grpc.WithInsecure(), grpc.WithDialer(func(addr string, timeout time.Duration) (net.Conn, error) {
+			return net.DialTimeout("unix", addr, timeout)
+		}))
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		conn.Close()
+		os.RemoveAll(dir)
+	})
+
+	stage := func() chan error {
+		done := make(chan error, 1)
+		go func() {
+			_, err := csi.NewNodeClient(conn).NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{VolumeId: "bucket/pvc"})
+			done <- err
+		}()
+		Eventually(ns.staging).Should(BeClosed())
+		return done
+	}
+
+	It("waits for requests in progress", func() {
+		done := stage()
+		Expect(s.inProgress()).To(HaveLen(1))
+		Expect(s.inProgress()[0].volumeID).To(Equal("bucket/pvc"))
+		go s.stop(time.Minute)
+		Consistently(served, "100ms").ShouldNot(Receive())
+		close(ns.release)
+		Eventually(done).Should(Receive(BeNil()))
+		Eventually(served).Should(Receive(BeNil()))
+		Expect(s.inProgress()).To(BeEmpty())
+	})
+
+	It("stops after the timeout", func() {
+		done := stage()
+		s.stop(50 * time.Millisecond)
+		Eventually(served).Should(Receive(BeNil()))
+		Eventually(done).Should(Receive(HaveOccurred()))
+	})
+})
@@ -0,0 +1,186 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"path"
+	"sort"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/yandex-cloud/k8s-csi-s3/pkg/mounter"
+	"github.com/yandex-cloud/k8s-csi-s3/pkg/s3"
+	"golang.org/x/net/context"
+)
+
+// Listing the volumes of a backend or aborting the uploads of a volume stops
+// after this long
+const uploadsAbortTimeout = 5 * time.Minute
+
+// uploadsJanitor aborts incomplete multipart uploads which interrupted
+// mounters left behind in volumes. Every sweep lists the volumes of each
+// backend profile: the buckets and the top-level prefixes of buckets with the
+// metadata object which CreateVolume writes. The profile must let the driver
+// resolve credentials itself, e.g. with a credentials provider or a role, as
+// the secrets of volumes aren't known outside of requests.
+type uploadsJanitor struct {
+	clients *s3.ClientCache
+	maxAge  time.Duration
+}
+
+func newUploadsJanitor(clients *s3.ClientCache, maxAge time.Duration) *uploadsJanitor {
+	return &uploadsJanitor{
+		clients: clients,
+		maxAge:  maxAge,
+	}
+}
+
+func (j *uploadsJanitor) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		j.abortOldUploads()
+	}
+}
+
+// abortOldUploads aborts the uploads older than maxAge in every volume of
+// every backend
+func (j *uploadsJanitor) abortOldUploads() {
+	cfg := driverConfig()
+	initiatedBefore := time.Now().Add(-j.maxAge)
+	for _, backend := range cfg.sweptBackends() {
+		client, volumes, err := j.backendVolumes(cfg, backend)
+		if err != nil {
+			glog.Errorf("s3: failed to list the volumes of backend %q: %v", backend, err)
+		}
+		for _, volumeID := range volumes {
+			aborted, err := j.abortVolumeUploads(client, volumeID, initiatedBefore)
+			if err != nil {
+				glog.Errorf("s3: failed to abort old multipart uploads of volume %s: %v", volumeID, err)
+				continue
+			}
+			if aborted > 0 {
+				glog.Infof("s3: aborted %d multipart uploads older than %v in volume %s", aborted, j.maxAge, volumeID)
+			}
+		}
+	}
+}
+
+// sweptBackends returns the names of the backend profiles, or "" for the
+// defaults if they don't select a backend
+func (cfg *Config) sweptBackends() []string {
+	var names []string
+	for name := range cfg.Backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if cfg.Defaults[backendKey] == "" {
+		names = append([]string{""}, names...)
+	}
+	return names
+}
+
+// backendVolumes returns a client with the credentials of the backend
+// profile and the IDs of the volumes it finds with them. Volumes found
+// before an error are returned with it.
+func (j *uploadsJanitor) backendVolumes(cfg *Config, backend string) (s3.Client, []string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), uploadsAbortTimeout)
+	defer cancel()
+	profile, err := cfg.profile(backend)
+	if err != nil {
+		return nil, nil, err
+	}
+	secrets := make(map[string]string, len(profile))
+	for k, v := range profile {
+		if k != mounter.OptionsKey && k != mounter.BucketKey {
+			secrets[k] = v
+		}
+	}
+	client, err := j.clients.Get(ctx, secrets)
+	if err != nil {
+		return nil, nil, err
+	}
+	if client.Config().Anonymous {
+		// anonymous requests can't list or abort uploads
+		return client, nil, nil
+	}
+
+	idPrefix := ""
+	if backend != "" {
+		idPrefix = backend + backendSeparator
+	}
+	buckets, err := client.ListBuckets(ctx)
+	if err != nil {
+		return client, nil, err
+	}
+	// the bucket of the profile may belong to another account
+	if bucketName := profile[mounter.BucketKey]; bucketName != "" && !contains(buckets, bucketName) {
+		buckets = append(buckets, bucketName)
+	}
+	var volumes []string
+	for _, bucketName := range buckets {
+		found, err := bucketVolumes(ctx, client, bucketName)
+		if err != nil {
+			glog.Errorf("s3: failed to list the volumes in bucket %s: %v", bucketName, err)
+		}
+		for _, volumeID := range found {
+			volumes = append(volumes, idPrefix+volumeID)
+		}
+	}
+	return client, volumes, ctx.Err()
+}
+
+// bucketVolumes returns the IDs of the volumes in the bucket: the bucket
+// itself, or its top-level prefixes with metadata objects
+func bucketVolumes(ctx context.Context, client s3.Client, bucketName string) ([]string, error) {
+	meta, err := client.GetFSMeta(ctx, bucketName, "")
+	if err != nil {
+		return nil, err
+	}
+	if meta != nil {
+		return []string{bucketName}, nil
+	}
+	prefixes, err := client.ListPrefixes(ctx, bucketName, "")
+	if err != nil {
+		return nil, err
+	}
+	var volumes []string
+	for _, prefix := range prefixes {
+		meta, err := client.GetFSMeta(ctx, bucketName, prefix)
+		if err != nil {
+			return volumes, err
+		}
+		if meta != nil {
+			volumes = append(volumes, path.Join(bucketName, prefix))
+		}
+	}
+	return volumes, nil
+}
+
+func (j *uploadsJanitor) abortVolumeUploads(client s3.Client, volumeID string, initiatedBefore time.Time) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), uploadsAbortTimeout)
+	defer cancel()
+	bucketName, prefix := volumeIDToBucketPrefix(volumeID)
+	return client.AbortMultipartUploads(ctx, bucketName, prefix, initiatedBefore)
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,78 @@
+package driver
+
+import (
+	"os"
+	"time"
+
+	"golang.org/x/net/context"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/yandex-cloud/k8s-csi-s3/pkg/s3"
+	"github.com/yandex-cloud/k8s-csi-s3/pkg/s3/s3test"
+)
+
+var _ = Describe("Uploads janitor", func() {
+	var fake *s3test.Server
+
+	BeforeEach(func() {
+		// every bucket has an old upload, shared has them in its prefixes
+		fake = s3test.NewServer()
+		old := time.Now().Add(-48 * time.Hour)
+		for _, bucketName := range []string{"volume", "other", "shared"} {
+			fake.CreateBucket(bucketName, false)
+		}
+		fake.CreateUpload("volume", "file", old)
+		fake.CreateUpload("other", "file", old)
+		fake.CreateUpload("shared", "pvc-2/file", old)
+		fake.CreateUpload("shared", "data/file", old)
+		fake.PutObject("shared", "data/")
+		// the volumes volume and shared/pvc-2 have metadata like CreateVolume writes
+		client, err := s3.NewClientFromSecret(context.Background(), map[string]string{
+			"accessKeyID":     "id",
+			"secretAccessKey": "secret",
+			"endpoint":        fake.URL,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(client.SetFSMeta(context.Background(), &s3.FSMeta{BucketName: "volume"})).To(Succeed())
+		Expect(client.SetFSMeta(context.Background(), &s3.FSMeta{BucketName: "shared", Prefix: "pvc-2"})).To(Succeed())
+		os.Setenv("JANITOR_AWS_ACCESS_KEY_ID", "id")
+		os.Setenv("JANITOR_AWS_SECRET_ACCESS_KEY", "secret")
+		s3.ConfigureProviders(s3.ProviderSettings{Providers: []string{s3.CredentialsEnv}, EnvPrefixes: []string{"JANITOR_"}})
+	})
+
+	AfterEach(func() {
+		setConfig(&Config{})
+		s3.ConfigureProviders(s3.ProviderSettings{})
+		os.Unsetenv("JANITOR_AWS_ACCESS_KEY_ID")
+		os.Unsetenv("JANITOR_AWS_SECRET_ACCESS_KEY")
+		fake.Close()
+	})
+
+	It("finds the volumes of the backends when it sweeps", func() {
+		setConfig(&Config{
+			Defaults: map[string]string{"backend": "minio"},
+			Backends: map[string]map[string]string{
+				"minio": {
+					"endpoint":             fake.URL,
+					"region":               "us-east-1",
+					"addressingStyle":      "path",
+					"credentialsProvider":  s3.CredentialsEnv,
+					"credentialsEnvPrefix": "JANITOR_",
+				},
+			},
+		})
+		j := newUploadsJanitor(newClientCache(), time.Hour)
+		j.abortOldUploads()
+		Expect(fake.UploadKeys("volume")).To(BeEmpty())
+		Expect(fake.UploadKeys("shared")).To(Equal([]string{"data/file"}))
+		Expect(fake.UploadKeys("other")).To(Equal([]string{"file"}))
+	})
+
+	It("sweeps the defaults unless they select a backend", func() {
+		cfg := &Config{Backends: map[string]map[string]string{"b": {}, "a": {}}}
+		Expect(cfg.sweptBackends()).To(Equal([]string{"", "a", "b"}))
+		cfg.Defaults = map[string]string{"backend": "a"}
+		Expect(cfg.sweptBackends()).To(Equal([]string{"a", "b"}))
+	})
+})
@@ -0,0 +1,152 @@
+// Package errdefs defines the kinds of errors of the driver and the gRPC codes
+// they are returned with, so that the CSI sidecars know whether to retry.
+package errdefs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Kind is the kind of an error
+type Kind int
+
+const (
+	// Unknown errors are returned as Internal
+	Unknown Kind = iota
+	// InvalidArgument means that the request or the configuration is invalid
+	InvalidArgument
+	// NotFound means that the bucket or object doesn't exist
+	NotFound
+	// AccessDenied means that the keys are invalid or not allowed to do the request
+	AccessDenied
+	// Conflict means that the bucket was modified concurrently, the request may succeed when retried
+	Conflict
+	// AlreadyExists means that the bucket name is taken by another account
+	AlreadyExists
+	// FailedPrecondition means that the bucket isn't in the state the request requires, e.g. not empty
+	FailedPrecondition
+	// Throttled means that the S3 endpoint asked to reduce the request rate
+	Throttled
+	// Unavailable means that the S3 endpoint can't be reached or fails
+	Unavailable
+	// MountFailed means that the mounter failed to mount the volume
+	MountFailed
+)
+
+var kindNames = map[Kind]string{
+	Unknown:            "Unknown",
+	InvalidArgument:    "InvalidArgument",
+	NotFound:           "NotFound",
+	AccessDenied:       "AccessDenied",
+	Conflict:           "Conflict",
+	AlreadyExists:      "AlreadyExists",
+	FailedPrecondition: "FailedPrecondition",
+	Throttled:          "Throttled",
+	Unavailable:        "Unavailable",
+	MountFailed:        "MountFailed",
+}
+
+func (k Kind) String() string {
+	return kindNames[k]
+}
+
+var kindCodes = map[Kind]codes.Code{
+	Unknown:            codes.Internal,
+	InvalidArgument:    codes.InvalidArgument,
+	NotFound:           codes.NotFound,
+	AccessDenied:       codes.PermissionDenied,
+	Conflict:           codes.Aborted,
+	AlreadyExists:      codes.AlreadyExists,
+	FailedPrecondition: codes.FailedPrecondition,
+	Throttled:          codes.ResourceExhausted,
+	Unavailable:        codes.Unavailable,
+	MountFailed:        codes.Internal,
+}
+
+// Error is an error of a known kind. gRPC returns it with the code of the kind.
+type Error struct {
+	Kind Kind
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// GRPCStatus is used by gRPC to get the status of the error
+func (e *Error) GRPCStatus() *status.Status {
+	return status.New(Code(e), e.Error())
+}
+
+// New returns an error of the kind with a formatted message
+func New(kind Kind, format string, args ...interface{}) error {
+	return &Error{Kind: kind, Err: fmt.Errorf(format, args...)}
+}
+
+// Wrap returns err as an error of the kind, nil if err is nil
+func Wrap(kind Kind, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Kind: kind, Err: err}
+}
+
+// Wrapf prefixes the message of err and keeps its kind, so that the result
+// is returned with the same code. It returns nil if err is nil.
+func Wrapf(err error, format string, args ...interface{}) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Kind: KindOf(err), Err: fmt.Errorf(format+": %w", append(args, err)...)}
+}
+
+// KindOf returns the kind of err or any error it wraps
+func KindOf(err error) Kind {
+	var e *Error
+	for errors.As(err, &e) {
+		if e.Kind != Unknown {
+			return e.Kind
+		}
+		err = e.Err
+	}
+	return Unknown
+}
+
+// Is returns true if err or any error it wraps is of the kind
+func Is(err error, kind Kind) bool {
+	return KindOf(err) == kind
+}
+
+// Code returns the gRPC code of err. Errors without a kind keep the code of
+// a wrapped gRPC status, cancelled requests get Canceled or DeadlineExceeded
+// and all other errors Internal.
+func Code(err error) codes.Code {
+	if err == nil {
+		return codes.OK
+	}
+	if kind := KindOf(err); kind != Unknown {
+		return kindCodes[kind]
+	}
+	var grpcErr interface{ GRPCStatus() *status.Status }
+	for wrapped := err; errors.As(wrapped, &grpcErr); {
+		if _, ok := grpcErr.(*Error); !ok {
+			return grpcErr.GRPCStatus().Code()
+		}
+		wrapped = grpcErr.(*Error).Err
+	}
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return codes.DeadlineExceeded
+	case errors.Is(err, context.Canceled):
+		return codes.Canceled
+	}
+	return codes.Internal
+}
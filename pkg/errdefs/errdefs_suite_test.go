@@ -0,0 +1,13 @@
+package errdefs_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestErrdefs(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Errdefs")
+}
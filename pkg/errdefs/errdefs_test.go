@@ -0,0 +1,60 @@
+package errdefs_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/yandex-cloud/k8s-csi-s3/pkg/errdefs"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Errors", func() {
+	It("maps kinds to gRPC codes", func() {
+		for kind, code := range map[errdefs.Kind]codes.Code{
+			errdefs.InvalidArgument:    codes.InvalidArgument,
+			errdefs.NotFound:           codes.NotFound,
+			errdefs.AccessDenied:       codes.PermissionDenied,
+			errdefs.Conflict:           codes.Aborted,
+			errdefs.AlreadyExists:      codes.AlreadyExists,
+			errdefs.FailedPrecondition: codes.FailedPrecondition,
+			errdefs.Throttled:          codes.ResourceExhausted,
+			errdefs.Unavailable:        codes.Unavailable,
+			errdefs.MountFailed:        codes.Internal,
+		} {
+			err := errdefs.New(kind, "%s failed", "request")
+			Expect(err.Error()).To(Equal("request failed"))
+			Expect(errdefs.Code(err)).To(Equal(code), kind.String())
+			// gRPC servers use the status of the error
+			Expect(status.Convert(err).Code()).To(Equal(code), kind.String())
+		}
+	})
+
+	It("keeps the kind of wrapped errors", func() {
+		cause := errors.New("SlowDown")
+		err := errdefs.Wrapf(errdefs.Wrap(errdefs.Throttled, cause), "failed to create bucket %s", "bucket")
+		Expect(err.Error()).To(Equal("failed to create bucket bucket: SlowDown"))
+		Expect(errdefs.Is(err, errdefs.Throttled)).To(BeTrue())
+		Expect(errors.Is(err, cause)).To(BeTrue())
+		Expect(errdefs.Code(fmt.Errorf("outer: %w", err))).To(Equal(codes.ResourceExhausted))
+		Expect(errdefs.Wrapf(nil, "nothing")).To(BeNil())
+		Expect(errdefs.Wrap(errdefs.NotFound, nil)).To(BeNil())
+	})
+
+	It("returns errors without a kind as Internal", func() {
+		Expect(errdefs.Code(errors.New("failed"))).To(Equal(codes.Internal))
+		Expect(status.Convert(errdefs.Wrapf(errors.New("failed"), "context")).Code()).To(Equal(codes.Internal))
+		Expect(errdefs.Code(nil)).To(Equal(codes.OK))
+	})
+
+	It("keeps the code of wrapped statuses and cancelled requests", func() {
+		invalid := errdefs.Wrapf(status.Error(codes.InvalidArgument, "bad option"), "failed to mount")
+		Expect(status.Convert(invalid).Code()).To(Equal(codes.InvalidArgument))
+		Expect(errdefs.Code(errdefs.Wrapf(context.DeadlineExceeded, "failed to list objects"))).To(Equal(codes.DeadlineExceeded))
+		Expect(errdefs.Code(errdefs.Wrapf(context.Canceled, "failed to list objects"))).To(Equal(codes.Canceled))
+	})
+})
@@ -0,0 +1,29 @@
+package mounter
+
+import (
+	"github.com/yandex-cloud/k8s-csi-s3/pkg/s3"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Anonymous volumes", func() {
+	cfg := &s3.Config{Endpoint: "https://storage.example.com", Anonymous: true}
+
+	It("are mounted with rclone by default", func() {
+		m, err := New(&s3.FSMeta{BucketName: "public"}, cfg)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(m).To(BeAssignableToTypeOf(&rcloneMounter{}))
+	})
+
+	It("can be mounted with s3fs", func() {
+		m, err := New(&s3.FSMeta{BucketName: "public", Mounter: s3fsMounterType}, cfg)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(m).To(BeAssignableToTypeOf(&s3fsMounter{}))
+	})
+
+	It("can't be mounted with geesefs", func() {
+		_, err := New(&s3.FSMeta{BucketName: "public", Mounter: geesefsMounterType}, cfg)
+		Expect(err).To(HaveOccurred())
+	})
+})
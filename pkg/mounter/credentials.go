@@ -0,0 +1,258 @@
+package mounter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	systemd "github.com/coreos/go-systemd/v22/dbus"
+	"github.com/golang/glog"
+)
+
+const (
+	// Credential files of every volume live in their own directory below
+	// this one. It should be a tmpfs so that keys never hit the disk.
+	defaultCredentialsDir = "/run/csi-s3"
+	// Mounters started through systemd run on the host, so their credentials
+	// are kept in the plugin directory which is shared with the host
+	systemdCredentialsDir = "/csi/credentials"
+	awsCredentialsName    = "aws-credentials"
+	awsKeysName           = "aws-keys.json"
+	s3fsPasswdName        = "passwd-s3fs"
+	volumeStateName       = "state.json"
+)
+
+func credentialsDir() string {
+	if dir := os.Getenv("CREDENTIALS_DIR"); dir != "" {
+		return dir
+	}
+	return defaultCredentialsDir
+}
+
+func volumeCredentialsDir(baseDir, volumeID string) string {
+	return filepath.Join(baseDir, systemd.PathBusEscape(volumeID))
+}
+
+// writeCredentialsFile atomically writes a root-only credentials file for the volume
+// and returns its path
+func writeCredentialsFile(baseDir, volumeID, name string, content []byte) (string, error) {
+	dir := volumeCredentialsDir(baseDir, volumeID)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("Error creating credentials directory %s: %v", dir, err)
+	}
+	tmp, err := ioutil.TempFile(dir, "."+name)
+	if err != nil {
+		return "", fmt.Errorf("Error writing credentials for volume %s: %v", volumeID, err)
+	}
+	defer os.Remove(tmp.Name())
+	// TempFile already creates the file with 0600, but be explicit about it
+	if err = tmp.Chmod(0600); err == nil {
+		_, err = tmp.Write(content)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", fmt.Errorf("Error writing credentials for volume %s: %v", volumeID, err)
+	}
+	path := filepath.Join(dir, name)
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return "", fmt.Errorf("Error writing credentials for volume %s: %v", volumeID, err)
+	}
+	return path, nil
+}
+
+// RemoveCredentials removes all credential files of the volume
+func RemoveCredentials(volumeID string) error {
+	for _, baseDir := range []string{credentialsDir(), systemdCredentialsDir} {
+		if err := removeCredentialsDir(baseDir, volumeID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func removeCredentialsDir(baseDir, volumeID string) error {
+	dir := volumeCredentialsDir(baseDir, volumeID)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return nil
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return fmt.Errorf("Error removing credentials of volume %s: %v", volumeID, err)
+	}
+	glog.V(4).Infof("Removed credentials of volume %s from %s", volumeID, baseDir)
+	return nil
+}
+
+// WriteVolumeState stores state which the node plugin needs to keep serving
+// the volume after a restart in a root-only file next to its credentials
+func WriteVolumeState(volumeID string, state []byte) error {
+	baseDir := credentialsDir()
+	if _, err := os.Stat(volumeCredentialsDir(systemdCredentialsDir, volumeID)); err == nil {
+		// mounters started through systemd outlive the plugin with their credentials
+		baseDir = systemdCredentialsDir
+	}
+	_, err := writeCredentialsFile(baseDir, volumeID, volumeStateName, state)
+	return err
+}
+
+// RemoveVolumeState removes the state of the volume stored with WriteVolumeState
+func RemoveVolumeState(volumeID string) error {
+	for _, baseDir := range []string{credentialsDir(), systemdCredentialsDir} {
+		err := os.Remove(filepath.Join(volumeCredentialsDir(baseDir, volumeID), volumeStateName))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadVolumeStates returns the states of all volumes stored with WriteVolumeState
+func ReadVolumeStates() ([][]byte, error) {
+	var states [][]byte
+	for _, baseDir := range []string{credentialsDir(), systemdCredentialsDir} {
+		dirs, err := ioutil.ReadDir(baseDir)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, dir := range dirs {
+			state, err := ioutil.ReadFile(filepath.Join(baseDir, dir.Name(), volumeStateName))
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			states = append(states, state)
+		}
+	}
+	return states, nil
+}
+
+// volumeKeys are the S3 keys a mounter uses for a volume
+type volumeKeys struct {
+	AccessKeyID     string `json:"accessKeyID"`
+	SecretAccessKey string `json:"secretAccessKey"`
+	SessionToken    string `json:"sessionToken,omitempty"`
+	// Expires is set for temporary keys, the node plugin renews them in time
+	Expires time.Time `json:"expires"`
+}
+
+// processCredentials is the output format of an AWS credential_process
+type processCredentials struct {
+	Version         int
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string
+	SessionToken    string `json:",omitempty"`
+	Expiration      string `json:",omitempty"`
+}
+
+// AWS SDKs run the credential process again when returned credentials
+// expire, so rewritten keys are picked up by running mounts within this period
+const credentialsRefreshInterval = 5 * time.Minute
+
+// writeAWSCredentials writes the keys of the volume and an AWS shared
+// credentials file which makes the mounter get them through credential_process,
+// so that the keys can be changed later without remounting. driverPath and
+// hostDir are paths of the driver binary and of baseDir as seen by the mounter.
+// It returns the path of the shared credentials file as seen by the mounter.
+func writeAWSCredentials(baseDir, hostDir, driverPath, volumeID string, keys *volumeKeys) (string, error) {
+	keysFile, err := writeVolumeKeys(baseDir, volumeID, keys)
+	if err != nil {
+		return "", err
+	}
+	hostKeysFile := filepath.Join(hostDir, strings.TrimPrefix(keysFile, baseDir))
+	sharedCredentials := fmt.Sprintf("[default]\ncredential_process = %s --print-credentials=%s\n", driverPath, hostKeysFile)
+	credFile, err := writeCredentialsFile(baseDir, volumeID, awsCredentialsName, []byte(sharedCredentials))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(hostDir, strings.TrimPrefix(credFile, baseDir)), nil
+}
+
+func writeVolumeKeys(baseDir, volumeID string, keys *volumeKeys) (string, error) {
+	content, err := json.Marshal(keys)
+	if err != nil {
+		return "", err
+	}
+	return writeCredentialsFile(baseDir, volumeID, awsKeysName, content)
+}
+
+// updateAWSCredentials replaces the keys of an already mounted volume.
+// It returns false if the volume has no credentials files or the keys didn't change.
+func updateAWSCredentials(volumeID string, keys *volumeKeys) (bool, error) {
+	content, err := json.Marshal(keys)
+	if err != nil {
+		return false, err
+	}
+	updated := false
+	for _, baseDir := range []string{credentialsDir(), systemdCredentialsDir} {
+		keysFile := filepath.Join(volumeCredentialsDir(baseDir, volumeID), awsKeysName)
+		prev, err := ioutil.ReadFile(keysFile)
+		if os.IsNotExist(err) || err == nil && bytes.Equal(prev, content) {
+			continue
+		}
+		if _, err = writeCredentialsFile(baseDir, volumeID, awsKeysName, content); err != nil {
+			return updated, err
+		}
+		updated = true
+	}
+	return updated, nil
+}
+
+// PrintCredentials prints volume keys from keysFile in the AWS credential_process format
+func PrintCredentials(w io.Writer, keysFile string) error {
+	content, err := ioutil.ReadFile(keysFile)
+	if err != nil {
+		return err
+	}
+	var keys volumeKeys
+	if err = json.Unmarshal(content, &keys); err != nil {
+		return fmt.Errorf("Error parsing %s: %v", keysFile, err)
+	}
+	expiration := time.Now().Add(credentialsRefreshInterval)
+	if !keys.Expires.IsZero() && keys.Expires.Before(expiration) {
+		expiration = keys.Expires
+	}
+	return json.NewEncoder(w).Encode(&processCredentials{
+		Version:         1,
+		AccessKeyID:     keys.AccessKeyID,
+		SecretAccessKey: keys.SecretAccessKey,
+		SessionToken:    keys.SessionToken,
+		Expiration:      expiration.UTC().Format(time.RFC3339),
+	})
+}
+
+// Credentials of the driver process itself are never passed to mounters
+var credentialsEnv = []string{
+	"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN",
+	"AWS_ROLE_ARN", "AWS_WEB_IDENTITY_TOKEN_FILE", "AWS_ROLE_SESSION_NAME",
+	"AWS_SHARED_CREDENTIALS_FILE", "AWSACCESSKEYID", "AWSSECRETACCESSKEY", "AWSSESSIONTOKEN",
+}
+
+// mounterEnv returns the environment for a mounter process
+func mounterEnv(extra ...string) []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		inherit := true
+		for _, name := range credentialsEnv {
+			if strings.HasPrefix(kv, name+"=") {
+				inherit = false
+				break
+			}
+		}
+		if inherit {
+			env = append(env, kv)
+		}
+	}
+	return append(env, extra...)
+}
@@ -0,0 +1,117 @@
+package mounter
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Volume credentials", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "csi-s3-credentials")
+		Expect(err).NotTo(HaveOccurred())
+		os.Setenv("CREDENTIALS_DIR", dir)
+	})
+
+	AfterEach(func() {
+		os.Unsetenv("CREDENTIALS_DIR")
+		os.RemoveAll(dir)
+	})
+
+	printKeys := func(volumeID string) processCredentials {
+		var out bytes.Buffer
+		keysFile := filepath.Join(volumeCredentialsDir(dir, volumeID), awsKeysName)
+		Expect(PrintCredentials(&out, keysFile)).To(Succeed())
+		var creds processCredentials
+		Expect(json.Unmarshal(out.Bytes(), &creds)).To(Succeed())
+		return creds
+	}
+
+	It("writes root-only files served through credential_process", func() {
+		credFile, err := writeAWSCredentials(dir, "/host/creds", "/host/s3driver", "bucket/prefix",
+			&volumeKeys{AccessKeyID: "id1", SecretAccessKey: "secret1"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(credFile).To(HavePrefix("/host/creds/"))
+
+		localFile := filepath.Join(dir, credFile[len("/host/creds"):])
+		st, err := os.Stat(localFile)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(st.Mode().Perm()).To(Equal(os.FileMode(0600)))
+		content, err := ioutil.ReadFile(localFile)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(content)).To(ContainSubstring("credential_process = /host/s3driver --print-credentials=/host/creds/"))
+		Expect(string(content)).NotTo(ContainSubstring("secret1"))
+
+		creds := printKeys("bucket/prefix")
+		Expect(creds.Version).To(Equal(1))
+		Expect(creds.AccessKeyID).To(Equal("id1"))
+		Expect(creds.SecretAccessKey).To(Equal("secret1"))
+		// running mounts request static keys again to pick up rotated ones
+		expiration, err := time.Parse(time.RFC3339, creds.Expiration)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(expiration).To(BeTemporally("~", time.Now().Add(credentialsRefreshInterval), time.Minute))
+	})
+
+	It("passes the expiration of temporary keys expiring sooner", func() {
+		expires := time.Now().Add(time.Minute).UTC().Truncate(time.Second)
+		_, err := writeAWSCredentials(dir, dir, "/s3driver", "vol",
+			&volumeKeys{AccessKeyID: "id1", SecretAccessKey: "secret1", SessionToken: "token", Expires: expires})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(printKeys("vol").Expiration).To(Equal(expires.Format(time.RFC3339)))
+	})
+
+	It("doesn't let processes without root privileges read the keys", func() {
+		if os.Geteuid() != 0 {
+			Skip("switching users requires root")
+		}
+		Expect(os.Chmod(dir, 0755)).To(Succeed())
+		_, err := writeAWSCredentials(dir, dir, "/s3driver", "vol", &volumeKeys{AccessKeyID: "id1", SecretAccessKey: "secret1"})
+		Expect(err).NotTo(HaveOccurred())
+
+		// the test binary prints the keys, see TestMain
+		binDir, err := ioutil.TempDir("", "csi-s3-bin")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(binDir)
+		Expect(os.Chmod(binDir, 0755)).To(Succeed())
+		binary, err := ioutil.ReadFile(os.Args[0])
+		Expect(err).NotTo(HaveOccurred())
+		process := filepath.Join(binDir, "s3driver")
+		Expect(ioutil.WriteFile(process, binary, 0755)).To(Succeed())
+
+		cmd := exec.Command(process)
+		cmd.Env = append(os.Environ(), "CSI_S3_TEST_PRINT_CREDENTIALS="+filepath.Join(volumeCredentialsDir(dir, "vol"), awsKeysName))
+		cmd.SysProcAttr = &syscall.SysProcAttr{Credential: &syscall.Credential{Uid: geesefsUID, Gid: geesefsGID}}
+		_, err = cmd.Output()
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("updates keys of mounted volumes only when they change", func() {
+		keys := &volumeKeys{AccessKeyID: "id1", SecretAccessKey: "secret1"}
+		_, err := writeAWSCredentials(dir, dir, "/s3driver", "vol", keys)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(updateAWSCredentials("vol", keys)).To(BeFalse())
+		Expect(updateAWSCredentials("vol", &volumeKeys{AccessKeyID: "id2", SecretAccessKey: "secret2"})).To(BeTrue())
+		Expect(printKeys("vol").AccessKeyID).To(Equal("id2"))
+
+		// volumes which are not mounted are left alone
+		Expect(updateAWSCredentials("other", keys)).To(BeFalse())
+		_, err = os.Stat(volumeCredentialsDir(dir, "other"))
+		Expect(os.IsNotExist(err)).To(BeTrue())
+
+		Expect(RemoveCredentials("vol")).To(Succeed())
+		_, err = os.Stat(volumeCredentialsDir(dir, "vol"))
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+})
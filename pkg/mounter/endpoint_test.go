@@ -0,0 +1,25 @@
+package mounter
+
+import (
+	"github.com/yandex-cloud/k8s-csi-s3/pkg/s3"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Signature version 2", func() {
+	cfg := &s3.Config{Endpoint: "http://ceph:7480", SignatureVersion: s3.SignatureV2}
+	meta := &s3.FSMeta{BucketName: "bucket"}
+
+	It("is supported by s3fs and rclone", func() {
+		_, err := newS3fsMounter(meta, cfg)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = newRcloneMounter(meta, cfg)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("isn't supported by geesefs", func() {
+		_, err := newGeeseFSMounter(meta, cfg)
+		Expect(err).To(HaveOccurred())
+	})
+})
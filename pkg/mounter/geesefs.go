@@ -3,6 +3,7 @@ package mounter
 import (
 	"fmt"
 	"os"
+	"strconv"
 	"time"
 
 	systemd "github.com/coreos/go-systemd/v22/dbus"
@@ -14,6 +15,9 @@ import (
 
 const (
 	geesefsCmd = "geesefs"
+	// GeeseFS without keys runs as nobody:nogroup after mounting
+	geesefsUID = 65534
+	geesefsGID = 65534
 )
 
 // Implements Mounter
@@ -23,17 +27,32 @@ type geesefsMounter struct {
 	region          string
 	accessKeyID     string
 	secretAccessKey string
-	roleArn         string
+	sessionToken    string
+	expires         time.Time
+	transport       s3.TransportConfig
+	addressingStyle string
 }
 
 func newGeeseFSMounter(meta *s3.FSMeta, cfg *s3.Config) (Mounter, error) {
+	if cfg.Anonymous {
+		return nil, fmt.Errorf("geesefs can't mount public buckets anonymously, use rclone or s3fs instead")
+	}
+	if cfg.Transport.ClientCert != "" || cfg.Transport.InsecureSkipVerify {
+		return nil, fmt.Errorf("geesefs doesn't support client certificates and insecureSkipVerify, use rclone instead")
+	}
+	if cfg.SignatureVersion == s3.SignatureV2 {
+		return nil, fmt.Errorf("geesefs doesn't support signature version 2, use rclone or s3fs instead")
+	}
 	return &geesefsMounter{
 		meta:            meta,
 		endpoint:        cfg.Endpoint,
 		region:          cfg.Region,
 		accessKeyID:     cfg.AccessKeyID,
 		secretAccessKey: cfg.SecretAccessKey,
-		roleArn:         cfg.AwsRoleArn,
+		sessionToken:    cfg.SessionToken,
+		expires:         cfg.Expires,
+		transport:       cfg.Transport,
+		addressingStyle: cfg.AddressingStyle,
 	}, nil
 }
 
@@ -70,15 +89,62 @@ func (geesefs *geesefsMounter) CopyBinary(from, to string) error {
 	return nil
 }
 
-func (geesefs *geesefsMounter) MountDirect(target string, args []string) error {
+func (geesefs *geesefsMounter) MountDirect(target, volumeID string, args []string) error {
 	args = append([]string{
 		"--endpoint", geesefs.endpoint,
 		"-o", "allow_other",
 		"--log-file", "/dev/stderr",
 	}, args...)
-	os.Setenv("AWS_ACCESS_KEY_ID", geesefs.accessKeyID)
-	os.Setenv("AWS_SECRET_ACCESS_KEY", geesefs.secretAccessKey)
-	return fuseMount(target, geesefsCmd, args)
+	var env []string
+	if geesefs.accessKeyID != "" {
+		driverPath, err := os.Executable()
+		if err != nil {
+			return err
+		}
+		credFile, err := writeAWSCredentials(credentialsDir(), credentialsDir(), driverPath, volumeID, geesefs.keys())
+		if err != nil {
+			return err
+		}
+		env = append(env, "AWS_SHARED_CREDENTIALS_FILE="+credFile)
+	}
+	transportEnv, err := geesefs.transportEnv(credentialsDir(), credentialsDir(), volumeID)
+	if err != nil {
+		return err
+	}
+	env = append(env, transportEnv...)
+	return fuseMount(target, geesefsCmd, args, mounterEnv(env...))
+}
+
+// transportEnv returns the environment with the CA bundle and the proxy for GeeseFS
+func (geesefs *geesefsMounter) transportEnv(baseDir, hostDir, volumeID string) ([]string, error) {
+	env := proxyEnv(&geesefs.transport)
+	if geesefs.transport.CABundle != "" {
+		files, err := writeTransportFiles(baseDir, hostDir, volumeID, &geesefs.transport)
+		if err != nil {
+			return nil, err
+		}
+		// GeeseFS is a Go program, so the bundle replaces the system CAs like in the driver
+		env = append(env, "SSL_CERT_FILE="+files.caBundle)
+	}
+	return env, nil
+}
+
+func (geesefs *geesefsMounter) keys() *volumeKeys {
+	return &volumeKeys{
+		AccessKeyID:     geesefs.accessKeyID,
+		SecretAccessKey: geesefs.secretAccessKey,
+		SessionToken:    geesefs.sessionToken,
+		Expires:         geesefs.expires,
+	}
+}
+
+// UpdateCredentials switches a mounted volume to the current keys.
+// GeeseFS gets keys through credential_process, so it picks them up by itself.
+func (geesefs *geesefsMounter) UpdateCredentials(volumeID string) (bool, error) {
+	if geesefs.accessKeyID == "" {
+		return false, nil
+	}
+	return updateAWSCredentials(volumeID, geesefs.keys())
 }
 
 func (geesefs *geesefsMounter) Mount(target, volumeID string) error {
@@ -87,11 +153,19 @@ func (geesefs *geesefsMounter) Mount(target, volumeID string) error {
 	if geesefs.region != "" {
 		args = append(args, "--region", geesefs.region)
 	}
-	args = append(
-		args,
-		"--setuid", "65534", // nobody. drop root privileges
-		"--setgid", "65534", // nogroup
-	)
+	if geesefs.addressingStyle == s3.AddressingVirtual {
+		// GeeseFS sends path-style requests by default
+		args = append(args, "--subdomain")
+	}
+	if geesefs.accessKeyID == "" {
+		// Keys are read from root-only files whenever they expire or are
+		// rotated, so GeeseFS only drops root privileges without them
+		args = append(
+			args,
+			"--setuid", strconv.Itoa(geesefsUID),
+			"--setgid", strconv.Itoa(geesefsGID),
+		)
+	}
 	useSystemd := true
 	for i := 0; i < len(geesefs.meta.MountOptions); i++ {
 		if geesefs.meta.MountOptions[i] == "--no-systemd" {
@@ -103,22 +177,19 @@ func (geesefs *geesefsMounter) Mount(target, volumeID string) error {
 	args = append(args, fullPath, target)
 	// Try to start geesefs using systemd so it doesn't get killed when the container exits
 	if !useSystemd {
-		return geesefs.MountDirect(target, args)
+		return geesefs.MountDirect(target, volumeID, args)
 	}
 	conn, err := systemd.New()
 	if err != nil {
 		glog.Errorf("Failed to connect to systemd dbus service: %v, starting geesefs directly", err)
-		return geesefs.MountDirect(target, args)
+		return geesefs.MountDirect(target, volumeID, args)
 	}
 	defer conn.Close()
 	// systemd is present
 	if err = geesefs.CopyBinary("/usr/bin/geesefs", "/csi/geesefs"); err != nil {
 		return err
 	}
-	pluginDir := os.Getenv("PLUGIN_DIR")
-	if pluginDir == "" {
-		pluginDir = "/var/lib/kubelet/plugins/ru.yandex.s3.csi"
-	}
+	pluginDir := pluginDir()
 	args = append([]string{pluginDir + "/geesefs", "-f", "-o", "allow_other", "--endpoint", geesefs.endpoint}, args...)
 	unitName := "geesefs-" + systemd.PathBusEscape(volumeID) + ".service"
 	newProps := []systemd.Property{
@@ -127,10 +198,6 @@ func (geesefs *geesefsMounter) Mount(target, volumeID string) error {
 			Value: dbus.MakeVariant("GeeseFS mount for Kubernetes volume " + volumeID),
 		},
 		systemd.PropExecStart(args, false),
-		systemd.Property{
-			Name:  "Environment",
-			Value: dbus.MakeVariant([]string{"AWS_ACCESS_KEY_ID=" + geesefs.accessKeyID, "AWS_SECRET_ACCESS_KEY=" + geesefs.secretAccessKey}),
-		},
 		systemd.Property{
 			Name:  "CollectMode",
 			Value: dbus.MakeVariant("inactive-or-failed"),
@@ -164,9 +231,38 @@ func (geesefs *geesefsMounter) Mount(target, volumeID string) error {
 			conn.ResetFailedUnit(unitName)
 		}
 	}
+	var env []string
+	if geesefs.accessKeyID != "" {
+		// Don't put keys into unit properties, anyone can read them with
+		// `systemctl show`. Pass a root-only credentials file instead.
+		driverPath, err := os.Executable()
+		if err != nil {
+			return err
+		}
+		if err = geesefs.CopyBinary(driverPath, "/csi/s3driver"); err != nil {
+			return err
+		}
+		hostCredFile, err := writeAWSCredentials(systemdCredentialsDir, pluginDir+"/credentials",
+			pluginDir+"/s3driver", volumeID, geesefs.keys())
+		if err != nil {
+			return err
+		}
+		env = append(env, "AWS_SHARED_CREDENTIALS_FILE="+hostCredFile)
+	}
+	transportEnv, err := geesefs.transportEnv(systemdCredentialsDir, pluginDir+"/credentials", volumeID)
+	if err != nil {
+		return err
+	}
+	env = append(env, transportEnv...)
+	if len(env) > 0 {
+		newProps = append(newProps, systemd.Property{
+			Name:  "Environment",
+			Value: dbus.MakeVariant(env),
+		})
+	}
 	_, err = conn.StartTransientUnit(unitName, "replace", newProps, nil)
 	if err != nil {
 		return fmt.Errorf("Error starting systemd unit %s on host: %v", unitName, err)
 	}
-	return waitForMount(target, 10*time.Second)
+	return waitForMount(target, mountTimeout())
 }
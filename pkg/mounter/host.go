@@ -0,0 +1,32 @@
+package mounter
+
+import (
+	"fmt"
+	"os"
+
+	systemd "github.com/coreos/go-systemd/v22/dbus"
+	"github.com/golang/glog"
+)
+
+// fuseDevice is opened by every mounter
+var fuseDevice = "/dev/fuse"
+
+// CheckHost checks that the node can mount volumes. FUSE is required.
+// Without systemd mounters are started in the container and are killed
+// with it, which is only reported.
+func CheckHost() error {
+	info, err := os.Stat(fuseDevice)
+	if err != nil {
+		return fmt.Errorf("FUSE is not available: %w", err)
+	}
+	if info.Mode()&os.ModeCharDevice == 0 {
+		return fmt.Errorf("FUSE is not available: %s is not a character device", fuseDevice)
+	}
+	conn, err := systemd.New()
+	if err != nil {
+		glog.Warningf("Failed to connect to systemd dbus service: %v, mounters will be stopped with the driver", err)
+		return nil
+	}
+	conn.Close()
+	return nil
+}
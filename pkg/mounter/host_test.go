@@ -0,0 +1,32 @@
+package mounter
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("CheckHost", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "csi-s3-host")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		fuseDevice = "/dev/fuse"
+		os.RemoveAll(dir)
+	})
+
+	It("requires the FUSE device", func() {
+		fuseDevice = filepath.Join(dir, "fuse")
+		Expect(CheckHost()).NotTo(Succeed())
+		Expect(ioutil.WriteFile(fuseDevice, nil, 0600)).To(Succeed())
+		Expect(CheckHost()).NotTo(Succeed())
+	})
+})
@@ -25,6 +25,13 @@ type Mounter interface {
 	Mount(target, volumeID string) error
 }
 
+// CredentialsUpdater is implemented by mounters which can switch
+// a mounted volume to new credentials without remounting it
+type CredentialsUpdater interface {
+	// UpdateCredentials returns true if the credentials of the volume changed
+	UpdateCredentials(volumeID string) (bool, error)
+}
+
 const (
 	s3fsMounterType     = "s3fs"
 	geesefsMounterType  = "geesefs"
@@ -41,10 +48,18 @@ func New(meta *s3.FSMeta, cfg *s3.Config) (Mounter, error) {
 	if len(meta.Mounter) == 0 {
 		mounter = cfg.Mounter
 	}
+	if len(mounter) == 0 && cfg.Anonymous {
+		// GeeseFS can't send unsigned requests
+		mounter = rcloneMounterType
+	}
+	mounter, err := ResolveType(mounter)
+	if err != nil {
+		return nil, err
+	}
+	if err := CheckOptions(mounter, meta.MountOptions); err != nil {
+		return nil, err
+	}
 	switch mounter {
-	case geesefsMounterType:
-		return newGeeseFSMounter(meta, cfg)
-
 	case s3fsMounterType:
 		return newS3fsMounter(meta, cfg)
 
@@ -52,13 +67,13 @@ func New(meta *s3.FSMeta, cfg *s3.Config) (Mounter, error) {
 		return newRcloneMounter(meta, cfg)
 
 	default:
-		// default to GeeseFS
 		return newGeeseFSMounter(meta, cfg)
 	}
 }
 
-func fuseMount(path string, command string, args []string) error {
+func fuseMount(path string, command string, args []string, env []string) error {
 	cmd := exec.Command(command, args...)
+	cmd.Env = env
 	cmd.Stderr = os.Stderr
 	glog.V(3).Infof("Mounting fuse with command: %s and args: %s", command, args)
 
@@ -67,7 +82,7 @@ func fuseMount(path string, command string, args []string) error {
 		return fmt.Errorf("Error fuseMount command: %s\nargs: %s\noutput: %s", command, args, out)
 	}
 
-	return waitForMount(path, 10*time.Second)
+	return waitForMount(path, mountTimeout())
 }
 
 func Unmount(path string) error {
@@ -92,10 +107,13 @@ func SystemdUnmount(volumeID string) (bool, error) {
 		return false, err
 	}
 	if len(units) == 0 || units[0].ActiveState == "inactive" || units[0].ActiveState == "failed" {
-		return true, nil
+		return true, removeCredentialsDir(systemdCredentialsDir, volumeID)
 	}
 	_, err = conn.StopUnit(unitName, "replace", nil)
-	return true, err
+	if err != nil {
+		return true, err
+	}
+	return true, removeCredentialsDir(systemdCredentialsDir, volumeID)
 }
 
 func FuseUnmount(path string) error {
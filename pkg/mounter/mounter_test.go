@@ -0,0 +1,28 @@
+package mounter_test
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/yandex-cloud/k8s-csi-s3/pkg/mounter"
+)
+
+// TestMain lets specs run the test binary as a credential process
+func TestMain(m *testing.M) {
+	if keysFile := os.Getenv("CSI_S3_TEST_PRINT_CREDENTIALS"); keysFile != "" {
+		if err := mounter.PrintCredentials(os.Stdout, keysFile); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func TestMounter(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Mounter")
+}
@@ -0,0 +1,182 @@
+package mounter
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/yandex-cloud/k8s-csi-s3/pkg/errdefs"
+)
+
+// OptionPolicy restricts the mount options a StorageClass or a static PV
+// may pass to a mounter. Entries are either command line flags ("--log-file")
+// or FUSE options given with -o ("passwd_file").
+//
+// If Allow is not empty, only the listed options are accepted.
+// Options listed in Deny are always rejected.
+type OptionPolicy struct {
+	Allow []string
+	Deny  []string
+}
+
+// OptionError is returned when a mount option is rejected by the policy
+type OptionError struct {
+	Mounter string
+	Option  string
+}
+
+func (e *OptionError) Error() string {
+	return fmt.Sprintf("mount option %q is not allowed for mounter %s", e.Option, e.Mounter)
+}
+
+var (
+	policyMu sync.RWMutex
+	policies = defaultPolicies()
+)
+
+// Types are the names of the supported mounters
+var Types = []string{geesefsMounterType, s3fsMounterType, rcloneMounterType}
+
+// defaultPolicies returns the default mount option policies. Options which
+// make the (privileged) mounter read or write arbitrary host paths, load
+// code, or send credentials somewhere else are denied.
+func defaultPolicies() map[string]OptionPolicy {
+	return map[string]OptionPolicy{
+		geesefsMounterType: {
+			Deny: []string{
+				"--log-file", "--cache", "--shared-config", "--profile",
+				"--endpoint", "--setuid", "--setgid",
+			},
+		},
+		s3fsMounterType: {
+			Deny: []string{
+				"passwd_file", "logfile", "use_cache", "url", "tmpdir",
+				"ahbe_conf", "mime", "credlib", "credlib_opts",
+			},
+		},
+		rcloneMounterType: {
+			Deny: []string{
+				"--config", "--log-file", "--cache-dir", "--temp-dir",
+				"--password-command", "--s3-endpoint", "--s3-shared-credentials-file",
+				"--s3-profile", "--ca-cert", "--client-cert", "--client-key",
+				"--rc", "--rc-addr", "--files-from", "--files-from-raw",
+				"--include-from", "--exclude-from", "--filter-from",
+			},
+		},
+	}
+}
+
+// DefaultOptionPolicy returns the built-in mount option policy of a mounter type
+func DefaultOptionPolicy(mounterType string) OptionPolicy {
+	return defaultPolicies()[mounterType]
+}
+
+// SetOptionPolicy replaces the mount option policy of a mounter type
+func SetOptionPolicy(mounterType string, policy OptionPolicy) {
+	policyMu.Lock()
+	defer policyMu.Unlock()
+	policies[mounterType] = policy
+}
+
+// GetOptionPolicy returns the mount option policy of a mounter type
+func GetOptionPolicy(mounterType string) OptionPolicy {
+	policyMu.RLock()
+	defer policyMu.RUnlock()
+	return policies[mounterType]
+}
+
+// ResolveType returns the mounter type, the default mounter (GeeseFS) if
+// it's empty. Unknown types, in any spelling, are rejected.
+func ResolveType(mounterType string) (string, error) {
+	if mounterType == "" {
+		return geesefsMounterType, nil
+	}
+	for _, t := range Types {
+		if t == mounterType {
+			return t, nil
+		}
+	}
+	return "", errdefs.New(errdefs.InvalidArgument, "unknown mounter %q, must be one of %s",
+		mounterType, strings.Join(Types, ", "))
+}
+
+// CheckOptions validates mount options against the policy of the mounter.
+// An empty mounter type means the default mounter (GeeseFS).
+func CheckOptions(mounterType string, options []string) error {
+	mounterType, err := ResolveType(mounterType)
+	if err != nil {
+		return err
+	}
+	return GetOptionPolicy(mounterType).Check(mounterType, options)
+}
+
+// Check validates mount options of the mounter type against the policy
+func (policy OptionPolicy) Check(mounterType string, options []string) error {
+	if mounterType == "" {
+		mounterType = geesefsMounterType
+	}
+	allow := normalizeOptionSet(policy.Allow)
+	deny := normalizeOptionSet(policy.Deny)
+	for _, name := range optionNames(options) {
+		if mounterType == geesefsMounterType && name == "--no-systemd" {
+			// handled by the driver itself
+			continue
+		}
+		if deny[name] || len(allow) > 0 && !allow[name] {
+			return &OptionError{Mounter: mounterType, Option: name}
+		}
+	}
+	return nil
+}
+
+func normalizeOptionSet(options []string) map[string]bool {
+	set := make(map[string]bool, len(options))
+	for _, opt := range options {
+		set[normalizeOption(opt)] = true
+	}
+	return set
+}
+
+// normalizeOption turns "-log_file=x" and "--log-file" into "--log-file",
+// FUSE options like "passwd_file=x" into "passwd_file"
+func normalizeOption(opt string) string {
+	opt = strings.ToLower(opt)
+	if i := strings.Index(opt, "="); i >= 0 {
+		opt = opt[0:i]
+	}
+	if !strings.HasPrefix(opt, "-") {
+		return opt
+	}
+	return "--" + strings.Replace(strings.TrimLeft(opt, "-"), "_", "-", -1)
+}
+
+// optionNames extracts the names of all flags and FUSE options from the
+// list of mount options. Flag values are skipped.
+func optionNames(options []string) []string {
+	var names []string
+	for i := 0; i < len(options); i++ {
+		opt := options[i]
+		fuseOpts := ""
+		switch {
+		case opt == "-o":
+			if i+1 < len(options) {
+				i++
+				fuseOpts = options[i]
+			}
+		case strings.HasPrefix(opt, "-o") && !strings.HasPrefix(opt, "--"):
+			fuseOpts = opt[2:]
+		case strings.HasPrefix(opt, "-"):
+			names = append(names, normalizeOption(opt))
+			continue
+		default:
+			// flag value or positional argument
+			continue
+		}
+		for _, fuseOpt := range strings.Split(fuseOpts, ",") {
+			if fuseOpt != "" {
+				names = append(names, normalizeOption(fuseOpt))
+			}
+		}
+	}
+	return names
+}
@@ -0,0 +1,57 @@
+package mounter_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/yandex-cloud/k8s-csi-s3/pkg/errdefs"
+	"github.com/yandex-cloud/k8s-csi-s3/pkg/mounter"
+	"github.com/yandex-cloud/k8s-csi-s3/pkg/s3"
+)
+
+var _ = Describe("CheckOptions", func() {
+
+	It("accepts harmless options", func() {
+		Expect(mounter.CheckOptions("geesefs", []string{"--memory-limit", "1000", "--dir-mode", "0777", "--no-systemd"})).To(Succeed())
+		Expect(mounter.CheckOptions("s3fs", []string{"-o", "allow_other,mp_umask=000"})).To(Succeed())
+		Expect(mounter.CheckOptions("rclone", []string{"--vfs-cache-mode=full"})).To(Succeed())
+	})
+
+	It("rejects denied flags in any spelling", func() {
+		for _, opts := range [][]string{
+			{"--log-file", "/etc/passwd"},
+			{"--log-file=/etc/passwd"},
+			{"-log_file", "/etc/passwd"},
+			{"--CACHE", "/"},
+		} {
+			err := mounter.CheckOptions("", opts)
+			Expect(err).To(HaveOccurred(), "%v", opts)
+			Expect(err).To(BeAssignableToTypeOf(&mounter.OptionError{}))
+		}
+	})
+
+	It("rejects denied FUSE options", func() {
+		Expect(mounter.CheckOptions("s3fs", []string{"-o", "allow_other,passwd_file=/root/.passwd"})).NotTo(Succeed())
+		Expect(mounter.CheckOptions("s3fs", []string{"-ouse_cache=/"})).NotTo(Succeed())
+		Expect(mounter.CheckOptions("rclone", []string{"--config", "/etc/shadow"})).NotTo(Succeed())
+	})
+
+	It("rejects unknown mounters instead of skipping the policy", func() {
+		for _, mounterType := range []string{"GeeseFS", "foo"} {
+			err := mounter.CheckOptions(mounterType, []string{"--log-file", "/etc/passwd"})
+			Expect(err).To(HaveOccurred(), mounterType)
+			Expect(errdefs.KindOf(err)).To(Equal(errdefs.InvalidArgument), mounterType)
+
+			meta := &s3.FSMeta{BucketName: "bucket", Mounter: mounterType, MountOptions: []string{"--log-file", "/etc/passwd"}}
+			_, err = mounter.New(meta, &s3.Config{AccessKeyID: "key", SecretAccessKey: "secret"})
+			Expect(errdefs.KindOf(err)).To(Equal(errdefs.InvalidArgument), mounterType)
+		}
+	})
+
+	It("enforces the allowlist when set", func() {
+		prev := mounter.GetOptionPolicy("rclone")
+		defer mounter.SetOptionPolicy("rclone", prev)
+		mounter.SetOptionPolicy("rclone", mounter.OptionPolicy{Allow: []string{"--vfs-cache-mode"}})
+		Expect(mounter.CheckOptions("rclone", []string{"--vfs-cache-mode", "full"})).To(Succeed())
+		Expect(mounter.CheckOptions("rclone", []string{"--read-only"})).NotTo(Succeed())
+	})
+})
@@ -4,18 +4,24 @@ import (
 	"fmt"
 	"os"
 	"path"
+	"time"
 
 	"github.com/yandex-cloud/k8s-csi-s3/pkg/s3"
 )
 
 // Implements Mounter
 type rcloneMounter struct {
-	meta            *s3.FSMeta
-	url             string
-	region          string
-	accessKeyID     string
-	secretAccessKey string
-	roleArn         string
+	meta             *s3.FSMeta
+	url              string
+	region           string
+	accessKeyID      string
+	secretAccessKey  string
+	sessionToken     string
+	expires          time.Time
+	anonymous        bool
+	transport        s3.TransportConfig
+	addressingStyle  string
+	signatureVersion string
 }
 
 const (
@@ -24,12 +30,17 @@ const (
 
 func newRcloneMounter(meta *s3.FSMeta, cfg *s3.Config) (Mounter, error) {
 	return &rcloneMounter{
-		meta:            meta,
-		url:             cfg.Endpoint,
-		region:          cfg.Region,
-		accessKeyID:     cfg.AccessKeyID,
-		secretAccessKey: cfg.SecretAccessKey,
-		roleArn:         cfg.AwsRoleArn,
+		meta:             meta,
+		url:              cfg.Endpoint,
+		region:           cfg.Region,
+		accessKeyID:      cfg.AccessKeyID,
+		secretAccessKey:  cfg.SecretAccessKey,
+		sessionToken:     cfg.SessionToken,
+		expires:          cfg.Expires,
+		anonymous:        cfg.Anonymous,
+		transport:        cfg.Transport,
+		addressingStyle:  cfg.AddressingStyle,
+		signatureVersion: cfg.SignatureVersion,
 	}, nil
 }
 
@@ -40,7 +51,8 @@ func (rclone *rcloneMounter) Mount(target, volumeID string) error {
 		fmt.Sprintf("%s", target),
 		"--daemon",
 		"--s3-provider=AWS",
-		"--s3-env-auth=true",
+		// without keys and environment auth rclone sends unsigned requests
+		fmt.Sprintf("--s3-env-auth=%v", !rclone.anonymous),
 		fmt.Sprintf("--s3-endpoint=%s", rclone.url),
 		"--allow-other",
 		"--vfs-cache-mode=writes",
@@ -48,8 +60,60 @@ func (rclone *rcloneMounter) Mount(target, volumeID string) error {
 	if rclone.region != "" {
 		args = append(args, fmt.Sprintf("--s3-region=%s", rclone.region))
 	}
+	if rclone.anonymous {
+		args = append(args, "--read-only")
+	}
+	switch rclone.addressingStyle {
+	case s3.AddressingPath:
+		args = append(args, "--s3-force-path-style=true")
+	case s3.AddressingVirtual:
+		args = append(args, "--s3-force-path-style=false")
+	}
+	if rclone.signatureVersion == s3.SignatureV2 {
+		args = append(args, "--s3-v2-auth")
+	}
+	if rclone.transport.InsecureSkipVerify {
+		args = append(args, "--no-check-certificate")
+	}
+	files, err := writeTransportFiles(credentialsDir(), credentialsDir(), volumeID, &rclone.transport)
+	if err != nil {
+		return err
+	}
+	if files.caBundle != "" {
+		args = append(args, "--ca-cert="+files.caBundle)
+	}
+	if files.clientCert != "" {
+		args = append(args, "--client-cert="+files.clientCert, "--client-key="+files.clientKey)
+	}
 	args = append(args, rclone.meta.MountOptions...)
-	os.Setenv("AWS_ACCESS_KEY_ID", rclone.accessKeyID)
-	os.Setenv("AWS_SECRET_ACCESS_KEY", rclone.secretAccessKey)
-	return fuseMount(target, rcloneCmd, args)
+	env := proxyEnv(&rclone.transport)
+	if rclone.accessKeyID != "" {
+		driverPath, err := os.Executable()
+		if err != nil {
+			return err
+		}
+		credFile, err := writeAWSCredentials(credentialsDir(), credentialsDir(), driverPath, volumeID, rclone.keys())
+		if err != nil {
+			return err
+		}
+		env = append(env, "AWS_SHARED_CREDENTIALS_FILE="+credFile)
+	}
+	return fuseMount(target, rcloneCmd, args, mounterEnv(env...))
+}
+
+func (rclone *rcloneMounter) keys() *volumeKeys {
+	return &volumeKeys{
+		AccessKeyID:     rclone.accessKeyID,
+		SecretAccessKey: rclone.secretAccessKey,
+		SessionToken:    rclone.sessionToken,
+		Expires:         rclone.expires,
+	}
+}
+
+// UpdateCredentials switches a mounted volume to the current keys
+func (rclone *rcloneMounter) UpdateCredentials(volumeID string) (bool, error) {
+	if rclone.accessKeyID == "" {
+		return false, nil
+	}
+	return updateAWSCredentials(volumeID, rclone.keys())
 }
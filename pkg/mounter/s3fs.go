@@ -2,18 +2,22 @@ package mounter
 
 import (
 	"fmt"
-	"os"
+	"strings"
 
 	"github.com/yandex-cloud/k8s-csi-s3/pkg/s3"
 )
 
 // Implements Mounter
 type s3fsMounter struct {
-	meta          *s3.FSMeta
-	url           string
-	region        string
-	pwFileContent string
-	roleArn       string
+	meta             *s3.FSMeta
+	url              string
+	region           string
+	pwFileContent    string
+	sessionToken     string
+	anonymous        bool
+	transport        s3.TransportConfig
+	addressingStyle  string
+	signatureVersion string
 }
 
 const (
@@ -21,52 +25,82 @@ const (
 )
 
 func newS3fsMounter(meta *s3.FSMeta, cfg *s3.Config) (Mounter, error) {
+	if cfg.Transport.ClientCert != "" {
+		return nil, fmt.Errorf("s3fs doesn't support client certificates, use rclone instead")
+	}
+	// s3fs reads its keys once, so they'd stop working when they expire
+	if cfg.TemporaryCredentials() {
+		return nil, fmt.Errorf("s3fs can't renew temporary credentials, use geesefs or rclone instead")
+	}
 	return &s3fsMounter{
-		meta:          meta,
-		url:           cfg.Endpoint,
-		region:        cfg.Region,
-		pwFileContent: cfg.AccessKeyID + ":" + cfg.SecretAccessKey,
-		roleArn:       cfg.AwsRoleArn,
+		meta:             meta,
+		url:              cfg.Endpoint,
+		region:           cfg.Region,
+		pwFileContent:    cfg.AccessKeyID + ":" + cfg.SecretAccessKey,
+		sessionToken:     cfg.SessionToken,
+		anonymous:        cfg.Anonymous,
+		transport:        cfg.Transport,
+		addressingStyle:  cfg.AddressingStyle,
+		signatureVersion: cfg.SignatureVersion,
 	}, nil
 }
 
 func (s3fs *s3fsMounter) Mount(target, volumeID string) error {
-	useRole := s3fs.pwFileContent[0] == ':' // access key ID is empty
-	if !useRole {
-		if err := writes3fsPass(s3fs.pwFileContent); err != nil {
-			return err
-		}
-	}
-	// s3fs mybucket /path/to/mountpoint -o passwd_file=${HOME}/.passwd-s3fs
+	useRole := !s3fs.anonymous && s3fs.pwFileContent[0] == ':' // access key ID is empty
+	// s3fs mybucket /path/to/mountpoint -o passwd_file=/run/csi-s3/<volume>/passwd-s3fs
 	args := []string{
 		fmt.Sprintf("%s:/%s", s3fs.meta.BucketName, s3fs.meta.Prefix),
 		target,
 		"-o", "allow_other",
 		"-o", "mp_umask=000",
 	}
+	var env []string
+	if s3fs.anonymous {
+		args = append(args, "-o", "public_bucket=1", "-o", "ro")
+	} else if !useRole && s3fs.sessionToken != "" {
+		// The password file can't hold a session token, s3fs only takes it from the environment
+		keys := strings.SplitN(s3fs.pwFileContent, ":", 2)
+		env = append(env,
+			"AWSACCESSKEYID="+keys[0],
+			"AWSSECRETACCESSKEY="+keys[1],
+			"AWSSESSIONTOKEN="+s3fs.sessionToken,
+		)
+	} else if !useRole {
+		pwFileName, err := writeCredentialsFile(credentialsDir(), volumeID, s3fsPasswdName, []byte(s3fs.pwFileContent))
+		if err != nil {
+			return err
+		}
+		args = append(args, "-o", fmt.Sprintf("passwd_file=%s", pwFileName))
+	}
 	if useRole {
-		args = append(args, "-o", fmt.Sprintf("iam_role=%s", s3fs.roleArn))
+		// use the role of the instance profile
+		args = append(args, "-o", "iam_role=auto")
 	} else {
-		args = append(args, "-o", "use_path_request_style")
+		if s3fs.addressingStyle != s3.AddressingVirtual {
+			args = append(args, "-o", "use_path_request_style")
+		}
 		args = append(args, "-o", fmt.Sprintf("url=%s", s3fs.url))
 		if s3fs.region != "" {
 			args = append(args, "-o", fmt.Sprintf("endpoint=%s", s3fs.region))
 		}
 	}
-	args = append(args, s3fs.meta.MountOptions...)
-	return fuseMount(target, s3fsCmd, args)
-}
-
-func writes3fsPass(pwFileContent string) error {
-	pwFileName := fmt.Sprintf("%s/.passwd-s3fs", os.Getenv("HOME"))
-	pwFile, err := os.OpenFile(pwFileName, os.O_RDWR|os.O_CREATE, 0600)
-	if err != nil {
-		return err
+	switch s3fs.signatureVersion {
+	case s3.SignatureV2:
+		args = append(args, "-o", "sigv2")
+	case s3.SignatureV4:
+		args = append(args, "-o", "sigv4")
 	}
-	_, err = pwFile.WriteString(pwFileContent)
-	if err != nil {
-		return err
+	if s3fs.transport.InsecureSkipVerify {
+		args = append(args, "-o", "no_check_certificate")
 	}
-	pwFile.Close()
-	return nil
+	env = append(env, proxyEnv(&s3fs.transport)...)
+	if s3fs.transport.CABundle != "" {
+		files, err := writeTransportFiles(credentialsDir(), credentialsDir(), volumeID, &s3fs.transport)
+		if err != nil {
+			return err
+		}
+		env = append(env, "CURL_CA_BUNDLE="+files.caBundle)
+	}
+	args = append(args, s3fs.meta.MountOptions...)
+	return fuseMount(target, s3fsCmd, args, mounterEnv(env...))
 }
@@ -0,0 +1,35 @@
+package mounter
+
+import (
+	"time"
+
+	"github.com/yandex-cloud/k8s-csi-s3/pkg/s3"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("s3fs", func() {
+	meta := &s3.FSMeta{BucketName: "bucket", Mounter: s3fsMounterType}
+
+	It("accepts static keys", func() {
+		_, err := New(meta, &s3.Config{AccessKeyID: "key", SecretAccessKey: "secret"})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("accepts the instance profile role", func() {
+		_, err := New(meta, &s3.Config{})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("rejects temporary keys", func() {
+		for _, cfg := range []*s3.Config{
+			{AwsRoleArn: "arn:aws:iam::123456789012:role/csi-s3"},
+			{AccessKeyID: "key", SecretAccessKey: "secret", SessionToken: "token", Expires: time.Now().Add(time.Hour)},
+			{AccessKeyID: "key", SecretAccessKey: "secret", ScopedCredentials: s3.ScopedMinio},
+		} {
+			_, err := New(meta, cfg)
+			Expect(err).To(HaveOccurred())
+		}
+	})
+})
@@ -0,0 +1,55 @@
+package mounter
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMountTimeout = 10 * time.Second
+	defaultPluginDir    = "/var/lib/kubelet/plugins/ru.yandex.s3.csi"
+)
+
+// Settings of the mounters which the driver configuration file may change
+type Settings struct {
+	// MountTimeout is how long to wait for the mounter to mount the volume
+	MountTimeout time.Duration
+	// PluginDir is the directory of the plugin on the host, where mounters
+	// started by systemd find their binary and credentials. It overrides
+	// the PLUGIN_DIR environment variable.
+	PluginDir string
+}
+
+var (
+	settingsMu sync.RWMutex
+	settings   Settings
+)
+
+// Configure replaces the settings, zero values select the defaults
+func Configure(s Settings) {
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
+	settings = s
+}
+
+func mountTimeout() time.Duration {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+	if settings.MountTimeout > 0 {
+		return settings.MountTimeout
+	}
+	return defaultMountTimeout
+}
+
+func pluginDir() string {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+	if settings.PluginDir != "" {
+		return settings.PluginDir
+	}
+	if dir := os.Getenv("PLUGIN_DIR"); dir != "" {
+		return dir
+	}
+	return defaultPluginDir
+}
@@ -0,0 +1,58 @@
+package mounter
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/yandex-cloud/k8s-csi-s3/pkg/s3"
+)
+
+const (
+	caBundleName   = "ca.pem"
+	clientCertName = "client.pem"
+	clientKeyName  = "client-key.pem"
+)
+
+// transportFiles are paths of the TLS files of a volume as seen by the mounter
+type transportFiles struct {
+	caBundle   string
+	clientCert string
+	clientKey  string
+}
+
+// writeTransportFiles writes the CA bundle and the client certificate of the
+// volume next to its credentials. hostDir is baseDir as seen by the mounter.
+func writeTransportFiles(baseDir, hostDir, volumeID string, transport *s3.TransportConfig) (*transportFiles, error) {
+	files := &transportFiles{}
+	for _, f := range []struct {
+		name    string
+		content string
+		path    *string
+	}{
+		{caBundleName, transport.CABundle, &files.caBundle},
+		{clientCertName, transport.ClientCert, &files.clientCert},
+		{clientKeyName, transport.ClientKey, &files.clientKey},
+	} {
+		if f.content == "" {
+			continue
+		}
+		path, err := writeCredentialsFile(baseDir, volumeID, f.name, []byte(f.content))
+		if err != nil {
+			return nil, err
+		}
+		*f.path = filepath.Join(hostDir, strings.TrimPrefix(path, baseDir))
+	}
+	return files, nil
+}
+
+// proxyEnv returns the environment which makes mounters use the proxy.
+// curl only reads the lower case variables, Go programs both.
+func proxyEnv(transport *s3.TransportConfig) []string {
+	if transport.ProxyURL == "" {
+		return nil
+	}
+	return []string{
+		"HTTPS_PROXY=" + transport.ProxyURL, "https_proxy=" + transport.ProxyURL,
+		"HTTP_PROXY=" + transport.ProxyURL, "http_proxy=" + transport.ProxyURL,
+	}
+}
@@ -0,0 +1,64 @@
+package mounter
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/yandex-cloud/k8s-csi-s3/pkg/s3"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Transport", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "csi-s3-transport")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("writes the CA bundle and the client certificate next to the credentials", func() {
+		files, err := writeTransportFiles(dir, "/host/creds", "bucket/prefix", &s3.TransportConfig{
+			CABundle:   "ca",
+			ClientCert: "cert",
+			ClientKey:  "key",
+		})
+		Expect(err).NotTo(HaveOccurred())
+		for path, content := range map[string]string{files.caBundle: "ca", files.clientCert: "cert", files.clientKey: "key"} {
+			Expect(path).To(HavePrefix("/host/creds/"))
+			local, err := ioutil.ReadFile(filepath.Join(dir, path[len("/host/creds"):]))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(local)).To(Equal(content))
+		}
+	})
+
+	It("writes nothing without certificates", func() {
+		files, err := writeTransportFiles(dir, dir, "bucket/prefix", &s3.TransportConfig{ProxyURL: "http://proxy:3128"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(*files).To(Equal(transportFiles{}))
+		Expect(proxyEnv(&s3.TransportConfig{ProxyURL: "http://proxy:3128"})).To(ContainElement("https_proxy=http://proxy:3128"))
+	})
+
+	It("is rejected by mounters which can't use it", func() {
+		meta := &s3.FSMeta{BucketName: "bucket"}
+		mtls := &s3.Config{Transport: s3.TransportConfig{ClientCert: "cert", ClientKey: "key"}}
+		insecure := &s3.Config{Transport: s3.TransportConfig{InsecureSkipVerify: true}}
+		_, err := newGeeseFSMounter(meta, mtls)
+		Expect(err).To(HaveOccurred())
+		_, err = newGeeseFSMounter(meta, insecure)
+		Expect(err).To(HaveOccurred())
+		_, err = newS3fsMounter(meta, mtls)
+		Expect(err).To(HaveOccurred())
+		_, err = newS3fsMounter(meta, insecure)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = newRcloneMounter(meta, mtls)
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
@@ -0,0 +1,240 @@
+package s3
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/smithy-go"
+	"github.com/golang/glog"
+	"github.com/minio/minio-go/v7"
+)
+
+// ClientCache keeps clients built from CSI secrets, so that every request
+// with the same secret reuses the connections of one client and, for roles,
+// the assumed role credentials. Clients are built again after the TTL, when
+// their temporary keys expire and when a request fails with a credentials
+// error. Keys from the file, env and Vault providers are read again after
+// the TTL too.
+type ClientCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]*cacheEntry
+	// pending are the clients being built by key, concurrent requests
+	// with the same secret wait for them instead of building their own
+	pending map[string]*pendingClient
+}
+
+type cacheEntry struct {
+	client  Client
+	expires time.Time
+}
+
+// pendingClient is a client being built, done is closed when it's ready
+type pendingClient struct {
+	done   chan struct{}
+	client Client
+	err    error
+}
+
+// newClientFromSecret builds the clients of the cache, tests replace it
+var newClientFromSecret = NewClientFromSecret
+
+// NewClientCache returns a cache which keeps clients for ttl
+func NewClientCache(ttl time.Duration) *ClientCache {
+	return &ClientCache{
+		ttl:     ttl,
+		entries: make(map[string]*cacheEntry),
+		pending: make(map[string]*pendingClient),
+	}
+}
+
+// SetTTL changes the TTL of clients created from now on
+func (cache *ClientCache) SetTTL(ttl time.Duration) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	cache.ttl = ttl
+}
+
+// Get returns the client of the secret, creating it if it's not cached
+func (cache *ClientCache) Get(ctx context.Context, secret map[string]string) (Client, error) {
+	key := secretHash(secret)
+	now := time.Now()
+	cache.mu.Lock()
+	entry, ok := cache.entries[key]
+	if ok && now.Before(entry.expires) {
+		cache.mu.Unlock()
+		return entry.client, nil
+	}
+	if p, ok := cache.pending[key]; ok {
+		cache.mu.Unlock()
+		select {
+		case <-p.done:
+			return p.client, p.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	p := &pendingClient{done: make(chan struct{})}
+	cache.pending[key] = p
+	ttl := cache.ttl
+	cache.mu.Unlock()
+
+	p.client, p.err = cache.build(ctx, key, secret, now, ttl)
+	cache.mu.Lock()
+	delete(cache.pending, key)
+	cache.mu.Unlock()
+	close(p.done)
+	return p.client, p.err
+}
+
+// build creates the client of the secret and caches it
+func (cache *ClientCache) build(ctx context.Context, key string, secret map[string]string, now time.Time, ttl time.Duration) (Client, error) {
+	client, err := newClientFromSecret(ctx, secret)
+	if err != nil {
+		return nil, err
+	}
+	entry := &cacheEntry{
+		client:  &cachedClient{Client: client, cache: cache, key: key},
+		expires: now.Add(ttl),
+	}
+	if keysExpire := client.Config().Expires; !keysExpire.IsZero() && keysExpire.Before(entry.expires) {
+		entry.expires = keysExpire.Add(-credentialsExpiryWindow)
+	}
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	for k, e := range cache.entries {
+		if !now.Before(e.expires) {
+			delete(cache.entries, k)
+		}
+	}
+	cache.entries[key] = entry
+	return entry.client, nil
+}
+
+func (cache *ClientCache) evict(key string, client *cachedClient) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	// a newer client may have replaced it already
+	if entry, ok := cache.entries[key]; ok && entry.client == client {
+		delete(cache.entries, key)
+	}
+}
+
+// secretHash is the cache key of a secret, so that the cache doesn't hold secrets as keys
+func secretHash(secret map[string]string) string {
+	keys := make([]string, 0, len(secret))
+	for k := range secret {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	h := sha256.New()
+	for _, k := range keys {
+		// NUL can't be part of secret keys, so pairs can't run into each other
+		h.Write([]byte(k))
+		h.Write([]byte{0})
+		h.Write([]byte(secret[k]))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+var credentialsErrorCodes = map[string]bool{
+	"InvalidAccessKeyId":           true,
+	"SignatureDoesNotMatch":        true,
+	"ExpiredToken":                 true,
+	"ExpiredTokenException":        true,
+	"InvalidToken":                 true,
+	"TokenRefreshRequired":         true,
+	"InvalidClientTokenId":         true,
+	"InvalidIdentityToken":         true,
+	"InvalidTokenId":               true,
+	"AuthorizationHeaderMalformed": true,
+}
+
+// isCredentialsError returns true if the error means that the keys
+// of the client are invalid or expired
+func isCredentialsError(err error) bool {
+	if err == nil {
+		return false
+	}
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && credentialsErrorCodes[apiErr.ErrorCode()] {
+		return true
+	}
+	return credentialsErrorCodes[minio.ToErrorResponse(err).Code]
+}
+
+// cachedClient removes itself from the cache when its keys stop working
+type cachedClient struct {
+	Client
+	cache *ClientCache
+	key   string
+}
+
+func (client *cachedClient) check(err error) error {
+	if isCredentialsError(err) {
+		glog.Warningf("Removing S3 client from the cache after credentials error: %v", err)
+		client.cache.evict(client.key, client)
+	}
+	return err
+}
+
+func (client *cachedClient) GetBucketStatus(ctx context.Context, bucketName string) (BucketStatus, error) {
+	status, err := client.Client.GetBucketStatus(ctx, bucketName)
+	return status, client.check(err)
+}
+
+func (client *cachedClient) CreateBucket(ctx context.Context, bucketName string) error {
+	return client.check(client.Client.CreateBucket(ctx, bucketName))
+}
+
+func (client *cachedClient) SetFSMeta(ctx context.Context, meta *FSMeta) error {
+	return client.check(client.Client.SetFSMeta(ctx, meta))
+}
+
+func (client *cachedClient) GetFSMeta(ctx context.Context, bucketName string, prefix string) (*FSMeta, error) {
+	meta, err := client.Client.GetFSMeta(ctx, bucketName, prefix)
+	return meta, client.check(err)
+}
+
+func (client *cachedClient) CreatePrefix(ctx context.Context, bucketName string, prefix string) error {
+	return client.check(client.Client.CreatePrefix(ctx, bucketName, prefix))
+}
+
+func (client *cachedClient) RemovePrefix(ctx context.Context, bucketName string, prefix string) error {
+	return client.check(client.Client.RemovePrefix(ctx, bucketName, prefix))
+}
+
+func (client *cachedClient) RemoveBucket(ctx context.Context, bucketName string) error {
+	return client.check(client.Client.RemoveBucket(ctx, bucketName))
+}
+
+func (client *cachedClient) AbortMultipartUploads(ctx context.Context, bucketName string, prefix string, initiatedBefore time.Time) (int, error) {
+	aborted, err := client.Client.AbortMultipartUploads(ctx, bucketName, prefix, initiatedBefore)
+	return aborted, client.check(err)
+}
+
+func (client *cachedClient) ListBuckets(ctx context.Context) ([]string, error) {
+	names, err := client.Client.ListBuckets(ctx)
+	return names, client.check(err)
+}
+
+func (client *cachedClient) ListPrefixes(ctx context.Context, bucketName string, prefix string) ([]string, error) {
+	prefixes, err := client.Client.ListPrefixes(ctx, bucketName, prefix)
+	return prefixes, client.check(err)
+}
+
+func (client *cachedClient) GetBucketPolicy(ctx context.Context, bucketName string) (string, error) {
+	policy, err := client.Client.GetBucketPolicy(ctx, bucketName)
+	return policy, client.check(err)
+}
+
+func (client *cachedClient) SetBucketPolicy(ctx context.Context, bucketName string, policy string) error {
+	return client.check(client.Client.SetBucketPolicy(ctx, bucketName, policy))
+}
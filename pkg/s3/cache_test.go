@@ -0,0 +1,114 @@
+package s3
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/yandex-cloud/k8s-csi-s3/pkg/s3/s3test"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Client cache", func() {
+	var (
+		ctx    = context.Background()
+		fake   *s3test.Server
+		secret map[string]string
+	)
+
+	BeforeEach(func() {
+		fake = s3test.NewServer()
+		fake.CreateBucket("bucket", false)
+		secret = map[string]string{
+			"accessKeyID":     "access",
+			"secretAccessKey": "secret",
+			"endpoint":        fake.URL,
+		}
+	})
+
+	AfterEach(func() {
+		fake.Close()
+	})
+
+	It("reuses clients of the same secret", func() {
+		cache := NewClientCache(time.Minute)
+		client, err := cache.Get(ctx, secret)
+		Expect(err).NotTo(HaveOccurred())
+		same, err := cache.Get(ctx, map[string]string{
+			"endpoint":        fake.URL,
+			"secretAccessKey": "secret",
+			"accessKeyID":     "access",
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(same).To(BeIdenticalTo(client))
+
+		secret["secretAccessKey"] = "rotated"
+		other, err := cache.Get(ctx, secret)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(other).NotTo(BeIdenticalTo(client))
+		Expect(other.Config().SecretAccessKey).To(Equal("rotated"))
+	})
+
+	It("builds the client once for concurrent requests with the same secret", func() {
+		var builds int32
+		defer func() { newClientFromSecret = NewClientFromSecret }()
+		newClientFromSecret = func(ctx context.Context, secret map[string]string) (Client, error) {
+			atomic.AddInt32(&builds, 1)
+			time.Sleep(50 * time.Millisecond)
+			return NewClientFromSecret(ctx, secret)
+		}
+
+		cache := NewClientCache(time.Minute)
+		clients := make([]Client, 10)
+		var wg sync.WaitGroup
+		for i := range clients {
+			wg.Add(1)
+			go func(i int) {
+				defer GinkgoRecover()
+				defer wg.Done()
+				client, err := cache.Get(ctx, secret)
+				Expect(err).NotTo(HaveOccurred())
+				clients[i] = client
+			}(i)
+		}
+		wg.Wait()
+		Expect(atomic.LoadInt32(&builds)).To(BeEquivalentTo(1))
+		for _, client := range clients {
+			Expect(client).To(BeIdenticalTo(clients[0]))
+		}
+	})
+
+	It("builds clients again after the TTL", func() {
+		cache := NewClientCache(0)
+		client, err := cache.Get(ctx, secret)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cache.Get(ctx, secret)).NotTo(BeIdenticalTo(client))
+	})
+
+	It("builds clients again when temporary keys expire", func() {
+		cache := NewClientCache(time.Hour)
+		client, err := cache.Get(ctx, secret)
+		Expect(err).NotTo(HaveOccurred())
+		cache.entries[secretHash(secret)].expires = time.Now()
+		Expect(cache.Get(ctx, secret)).NotTo(BeIdenticalTo(client))
+	})
+
+	It("evicts clients after credentials errors", func() {
+		cache := NewClientCache(time.Hour)
+		client, err := cache.Get(ctx, secret)
+		Expect(err).NotTo(HaveOccurred())
+
+		fake.Fault = func(r *http.Request) int { return http.StatusForbidden }
+		_, err = client.GetBucketStatus(ctx, "bucket")
+		Expect(err).To(HaveOccurred())
+		Expect(cache.Get(ctx, secret)).To(BeIdenticalTo(client))
+
+		fake.FaultCode = "InvalidAccessKeyId"
+		Expect(client.CreatePrefix(ctx, "bucket", "volume")).NotTo(Succeed())
+		Expect(cache.Get(ctx, secret)).NotTo(BeIdenticalTo(client))
+	})
+})
@@ -0,0 +1,339 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/minio/minio-go/v7/pkg/signer"
+)
+
+// Capabilities are the optional features of an S3 backend. A feature is
+// supported if the backend implements its API, regardless of whether it's
+// enabled for a bucket.
+type Capabilities struct {
+	// MultiObjectDelete removes many objects with one request
+	MultiObjectDelete bool
+	ObjectLock        bool
+	Tagging           bool
+	// ConditionalWrites honour If-Match and If-None-Match in PutObject
+	ConditionalWrites bool
+}
+
+const (
+	capabilitiesProbeTimeout = 30 * time.Second
+	// capabilitiesProbeKey is written into the probed volume only by
+	// backends without conditional writes and removed right away
+	capabilitiesProbeKey = ".csi-s3-capabilities-probe"
+)
+
+var (
+	capabilitiesMu       sync.Mutex
+	endpointCapabilities = make(map[string]Capabilities)
+	// probingEndpoints are the endpoints which are being probed
+	probingEndpoints = make(map[string]bool)
+)
+
+// EndpointCapabilities returns the capabilities of the endpoint if it has
+// been probed already
+func EndpointCapabilities(endpoint string) (Capabilities, bool) {
+	return cachedCapabilities(endpoint)
+}
+
+// cachedCapabilities returns the capabilities of the endpoint
+// if they've been probed already
+func cachedCapabilities(endpoint string) (Capabilities, bool) {
+	capabilitiesMu.Lock()
+	defer capabilitiesMu.Unlock()
+	caps, ok := endpointCapabilities[endpoint]
+	return caps, ok
+}
+
+func setCapabilities(endpoint string, caps Capabilities) {
+	capabilitiesMu.Lock()
+	defer capabilitiesMu.Unlock()
+	endpointCapabilities[endpoint] = caps
+	features := &expvar.Map{}
+	for name, supported := range caps.Features() {
+		value := int64(0)
+		if supported {
+			value = 1
+		}
+		features.Set(name, intVar(value))
+	}
+	capabilitiesMetric.Set(endpoint, features)
+}
+
+// Features returns whether the backend supports each feature by its name
+func (caps Capabilities) Features() map[string]bool {
+	return map[string]bool{
+		"multiObjectDelete": caps.MultiObjectDelete,
+		"objectLock":        caps.ObjectLock,
+		"tagging":           caps.Tagging,
+		"conditionalWrites": caps.ConditionalWrites,
+	}
+}
+
+func (caps Capabilities) String() string {
+	return fmt.Sprintf("multiObjectDelete=%v objectLock=%v tagging=%v conditionalWrites=%v",
+		caps.MultiObjectDelete, caps.ObjectLock, caps.Tagging, caps.ConditionalWrites)
+}
+
+// StartCapabilitiesProbe probes the capabilities of the endpoint of the
+// client in the background, unless they're known or being probed already.
+// The probe only writes to the volume in the bucket or prefix.
+func StartCapabilitiesProbe(client Client, bucketName, prefix string) {
+	endpoint := client.Config().Endpoint
+	capabilitiesMu.Lock()
+	_, known := endpointCapabilities[endpoint]
+	if known || probingEndpoints[endpoint] {
+		capabilitiesMu.Unlock()
+		return
+	}
+	probingEndpoints[endpoint] = true
+	capabilitiesMu.Unlock()
+
+	go func() {
+		defer func() {
+			capabilitiesMu.Lock()
+			delete(probingEndpoints, endpoint)
+			capabilitiesMu.Unlock()
+		}()
+		if _, err := ProbeCapabilities(context.Background(), client, bucketName, prefix); err != nil {
+			glog.Warningf("%v", err)
+		}
+	}()
+}
+
+// ProbeCapabilities returns the capabilities of the endpoint of the client.
+// They're probed in the volume in the bucket or prefix once per endpoint and
+// cached. Errors, and responses which don't tell whether the backend supports
+// a feature, like AccessDenied, fail the probe, so that it's repeated next time.
+func ProbeCapabilities(ctx context.Context, client Client, bucketName, prefix string) (Capabilities, error) {
+	cfg := client.Config()
+	if caps, ok := cachedCapabilities(cfg.Endpoint); ok {
+		return caps, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, capabilitiesProbeTimeout)
+	defer cancel()
+	signing, err := signingConfig(ctx, cfg)
+	if err != nil {
+		return Capabilities{}, fmt.Errorf("failed to probe capabilities of S3 endpoint %s: %w", cfg.Endpoint, err)
+	}
+	caps, err := newCapabilitiesProbe(signing, bucketName, prefix).run(ctx)
+	if err != nil {
+		return caps, fmt.Errorf("failed to probe capabilities of S3 endpoint %s: %w", cfg.Endpoint, err)
+	}
+	glog.Infof("S3 endpoint %s supports %s", cfg.Endpoint, caps)
+	setCapabilities(cfg.Endpoint, caps)
+	return caps, nil
+}
+
+// supportsMultiObjectDelete returns false if the endpoint is known
+// not to support multi-object delete requests
+func supportsMultiObjectDelete(endpoint string) bool {
+	caps, ok := cachedCapabilities(endpoint)
+	return !ok || caps.MultiObjectDelete
+}
+
+// signingConfig returns cfg with the keys the clients sign requests with.
+// Configs without static keys get the keys of their role, or of the default
+// credentials chain of the driver like the AWS client.
+func signingConfig(ctx context.Context, cfg *Config) (*Config, error) {
+	if cfg.Anonymous || cfg.AccessKeyID != "" {
+		return cfg, nil
+	}
+	awsConf, err := loadAwsConfig(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	creds, err := awsConf.Credentials.Retrieve(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get credentials: %v", err)
+	}
+	resolved := *cfg
+	resolved.AccessKeyID = creds.AccessKeyID
+	resolved.SecretAccessKey = creds.SecretAccessKey
+	resolved.SessionToken = creds.SessionToken
+	return &resolved, nil
+}
+
+// capabilitiesProbe sends signed requests which don't change the bucket,
+// except for the probe key in the volume
+type capabilitiesProbe struct {
+	cfg    *Config
+	bucket string
+	key    string
+}
+
+func newCapabilitiesProbe(cfg *Config, bucketName, prefix string) *capabilitiesProbe {
+	return &capabilitiesProbe{cfg: cfg, bucket: bucketName, key: objectPrefix(prefix) + capabilitiesProbeKey}
+}
+
+// probeResponse is the status and the S3 error code of a probe request
+type probeResponse struct {
+	status    int
+	code      string
+	versionID string
+}
+
+// unsupported means that the backend doesn't implement the request
+func (resp *probeResponse) unsupported() bool {
+	return resp.status == http.StatusNotImplemented || resp.status == http.StatusMethodNotAllowed ||
+		resp.code == "NotImplemented"
+}
+
+// check returns true if the request succeeded or failed with one of the
+// codes, false if it isn't supported and an error otherwise. Denied requests
+// only tell about the permissions of the keys, not about the backend.
+func (probe *capabilitiesProbe) check(resp *probeResponse, feature string, codes ...string) (bool, error) {
+	if resp.status < 300 {
+		return true, nil
+	}
+	for _, code := range codes {
+		if resp.code == code {
+			return true, nil
+		}
+	}
+	if resp.unsupported() {
+		return false, nil
+	}
+	return false, fmt.Errorf("%s probe failed with %d %s", feature, resp.status, resp.code)
+}
+
+func (probe *capabilitiesProbe) run(ctx context.Context) (Capabilities, error) {
+	var caps Capabilities
+	for _, p := range []struct {
+		supported *bool
+		probe     func(ctx context.Context) (bool, error)
+	}{
+		{&caps.MultiObjectDelete, probe.multiObjectDelete},
+		{&caps.ObjectLock, probe.subresource("object-lock", "ObjectLockConfigurationNotFoundError")},
+		{&caps.Tagging, probe.subresource("tagging", "NoSuchTagSet")},
+		{&caps.ConditionalWrites, probe.conditionalWrites},
+	} {
+		supported, err := p.probe(ctx)
+		if err != nil {
+			return caps, err
+		}
+		*p.supported = supported
+	}
+	return caps, nil
+}
+
+// subresource probes a GET request of a bucket subresource, which
+// succeeds or fails with one of the codes if it's supported
+func (probe *capabilitiesProbe) subresource(name string, codes ...string) func(ctx context.Context) (bool, error) {
+	return func(ctx context.Context) (bool, error) {
+		resp, err := probe.request(ctx, http.MethodGet, "", name, nil, nil)
+		if err != nil {
+			return false, err
+		}
+		return probe.check(resp, name, codes...)
+	}
+}
+
+// multiObjectDelete removes a version of the probe key which doesn't exist,
+// so that even versioned buckets don't get a delete marker
+func (probe *capabilitiesProbe) multiObjectDelete(ctx context.Context) (bool, error) {
+	body := []byte(`<Delete><Quiet>true</Quiet><Object><Key>` + probe.key +
+		`</Key><VersionId>null</VersionId></Object></Delete>`)
+	sum := md5.Sum(body)
+	header := http.Header{"Content-Md5": {base64.StdEncoding.EncodeToString(sum[:])}}
+	resp, err := probe.request(ctx, http.MethodPost, "", "delete", header, body)
+	if err != nil {
+		return false, err
+	}
+	return probe.check(resp, "multiObjectDelete")
+}
+
+// conditionalWrites writes the probe key only if it has an ETag which no
+// object can have. Backends which ignore the condition write it, and the
+// version they wrote is removed again.
+func (probe *capabilitiesProbe) conditionalWrites(ctx context.Context) (bool, error) {
+	header := http.Header{"If-Match": {`"00000000000000000000000000000000"`}}
+	resp, err := probe.request(ctx, http.MethodPut, probe.key, "", header, nil)
+	if err != nil {
+		return false, err
+	}
+	if resp.status < 300 {
+		query := ""
+		if resp.versionID != "" {
+			query = url.Values{"versionId": {resp.versionID}}.Encode()
+		}
+		if _, err = probe.request(ctx, http.MethodDelete, probe.key, query, nil, nil); err != nil {
+			glog.Errorf("Failed to remove %s from bucket %s: %v", probe.key, probe.bucket, err)
+		}
+		return false, nil
+	}
+	return probe.check(resp, "conditionalWrites", "PreconditionFailed", "NoSuchKey")
+}
+
+// request sends a signed request to the bucket or an object of it. The
+// query is raw, since S3 expects subresources like ?delete without "=".
+func (probe *capabilitiesProbe) request(ctx context.Context, method, key, query string,
+	header http.Header, body []byte) (*probeResponse, error) {
+	u, err := url.Parse(probe.cfg.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	virtualHost := probe.cfg.AddressingStyle == AddressingVirtual ||
+		probe.cfg.AddressingStyle == "" && isAwsEndpoint(probe.cfg.Endpoint)
+	if virtualHost {
+		u.Host = probe.bucket + "." + u.Host
+		u.Path = endpointPath(probe.cfg.Endpoint) + "/" + key
+	} else {
+		u.Path = endpointPath(probe.cfg.Endpoint) + "/" + probe.bucket + "/" + key
+	}
+	u.RawQuery = query
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	switch {
+	case probe.cfg.Anonymous:
+	case probe.cfg.SignatureVersion == SignatureV2:
+		req = signer.SignV2(*req, probe.cfg.AccessKeyID, probe.cfg.SecretAccessKey, virtualHost)
+	default:
+		req.Header.Set("X-Amz-Content-Sha256", payloadHash(body))
+		req = signer.SignV4(*req, probe.cfg.AccessKeyID, probe.cfg.SecretAccessKey, probe.cfg.SessionToken, signingRegion(probe.cfg))
+	}
+
+	client, err := httpClient(probe.cfg)
+	if err != nil {
+		return nil, err
+	}
+	httpResp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+	respBody, err := ioutil.ReadAll(httpResp.Body)
+	if err != nil {
+		return nil, err
+	}
+	resp := &probeResponse{status: httpResp.StatusCode, versionID: httpResp.Header.Get("X-Amz-Version-Id")}
+	if resp.status >= 300 {
+		var s3Err struct {
+			Code string
+		}
+		xml.Unmarshal(respBody, &s3Err)
+		resp.code = s3Err.Code
+	}
+	return resp, nil
+}
@@ -0,0 +1,164 @@
+package s3
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/yandex-cloud/k8s-csi-s3/pkg/s3/s3test"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Capabilities", func() {
+	ctx := context.Background()
+
+	var fake *s3test.Server
+
+	BeforeEach(func() {
+		fake = s3test.NewServer()
+	})
+
+	AfterEach(func() {
+		fake.Close()
+	})
+
+	// unsupported fails requests with the query parameter with 501
+	unsupported := func(param string) {
+		fake.Fault = func(r *http.Request) int {
+			if _, ok := r.URL.Query()[param]; ok {
+				return http.StatusNotImplemented
+			}
+			return 0
+		}
+	}
+
+	It("detects the features of the backend", func() {
+		fake.CreateBucket("bucket", true)
+		client, err := NewClientAws(fakeConfig(fake))
+		Expect(err).NotTo(HaveOccurred())
+		caps, err := ProbeCapabilities(ctx, client, "bucket", "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(caps).To(Equal(Capabilities{
+			MultiObjectDelete: true,
+			ObjectLock:        true,
+			Tagging:           true,
+			ConditionalWrites: true,
+		}))
+		Expect(fake.Keys("bucket")).To(BeEmpty())
+	})
+
+	It("detects missing features without leaving objects behind", func() {
+		fake.CreateBucket("bucket", true)
+		fake.IgnoreConditions = true
+		unsupported("delete")
+		client, err := NewClientMinio(fakeConfig(fake))
+		Expect(err).NotTo(HaveOccurred())
+		caps, err := ProbeCapabilities(ctx, client, "bucket", "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(caps.MultiObjectDelete).To(BeFalse())
+		Expect(caps.ConditionalWrites).To(BeFalse())
+		Expect(caps.Tagging).To(BeTrue())
+		Expect(fake.Keys("bucket")).To(BeEmpty())
+	})
+
+	It("probes every endpoint once", func() {
+		fake.CreateBucket("bucket", false)
+		client, err := NewClientAws(fakeConfig(fake))
+		Expect(err).NotTo(HaveOccurred())
+		requests := 0
+		fake.Fault = func(r *http.Request) int {
+			requests++
+			return 0
+		}
+		_, err = ProbeCapabilities(ctx, client, "bucket", "")
+		Expect(err).NotTo(HaveOccurred())
+		probeRequests := requests
+		_, err = ProbeCapabilities(ctx, client, "bucket", "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(requests).To(Equal(probeRequests))
+	})
+
+	It("probes again after transient errors", func() {
+		fake.CreateBucket("bucket", false)
+		client, err := NewClientAws(fakeConfig(fake))
+		Expect(err).NotTo(HaveOccurred())
+		fake.Fault = func(r *http.Request) int {
+			return http.StatusServiceUnavailable
+		}
+		_, err = ProbeCapabilities(ctx, client, "bucket", "")
+		Expect(err).To(HaveOccurred())
+		_, ok := cachedCapabilities(fake.URL)
+		Expect(ok).To(BeFalse())
+		fake.Fault = nil
+		caps, err := ProbeCapabilities(ctx, client, "bucket", "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(caps.MultiObjectDelete).To(BeTrue())
+	})
+
+	It("doesn't cache results of denied probes", func() {
+		fake.CreateBucket("bucket", false)
+		fake.Buckets["bucket"].Forbidden = true
+		client, err := NewClientAws(fakeConfig(fake))
+		Expect(err).NotTo(HaveOccurred())
+		_, err = ProbeCapabilities(ctx, client, "bucket", "")
+		Expect(err).To(HaveOccurred())
+		_, ok := cachedCapabilities(fake.URL)
+		Expect(ok).To(BeFalse())
+		Expect(supportsMultiObjectDelete(fake.URL)).To(BeTrue())
+	})
+
+	It("signs probes with the credentials of the driver without keys in the config", func() {
+		os.Setenv("AWS_ACCESS_KEY_ID", "driver-id")
+		os.Setenv("AWS_SECRET_ACCESS_KEY", "driver-secret")
+		defer os.Unsetenv("AWS_ACCESS_KEY_ID")
+		defer os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+		fake.CreateBucket("bucket", false)
+		cfg := fakeConfig(fake)
+		cfg.AccessKeyID, cfg.SecretAccessKey = "", ""
+		client, err := NewClientAws(cfg)
+		Expect(err).NotTo(HaveOccurred())
+		var unsigned []string
+		fake.Fault = func(r *http.Request) int {
+			if !strings.Contains(r.Header.Get("Authorization"), "Credential=driver-id/") {
+				unsigned = append(unsigned, r.Method+" "+r.URL.String())
+				return http.StatusForbidden
+			}
+			return 0
+		}
+		_, err = ProbeCapabilities(ctx, client, "bucket", "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(unsigned).To(BeEmpty())
+	})
+
+	for name, newClient := range clients {
+		name, newClient := name, newClient
+
+		It("removes objects one by one with "+name+" without multi-object delete", func() {
+			fake.CreateBucket("bucket", true)
+			for i := 0; i < 5; i++ {
+				fake.PutObject("bucket", fmt.Sprintf("pvc/file%d", i))
+			}
+			client, err := newClient(fakeConfig(fake))
+			Expect(err).NotTo(HaveOccurred())
+			unsupported("delete")
+			_, err = ProbeCapabilities(ctx, client, "bucket", "")
+			Expect(err).NotTo(HaveOccurred())
+
+			multiDeletes := 0
+			fake.Fault = func(r *http.Request) int {
+				if _, ok := r.URL.Query()["delete"]; ok {
+					multiDeletes++
+					return http.StatusNotImplemented
+				}
+				return 0
+			}
+			Expect(client.RemovePrefix(ctx, "bucket", "pvc")).To(Succeed())
+			Expect(fake.Keys("bucket")).To(BeEmpty())
+			Expect(multiDeletes).To(BeZero())
+		})
+	}
+})
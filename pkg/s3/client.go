@@ -1,44 +1,285 @@
 package s3
 
-import "github.com/golang/glog"
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
 
-type s3Client interface {
+	"github.com/golang/glog"
+)
+
+const (
+	// ClientAws uses the AWS SDK
+	ClientAws = "aws"
+	// ClientMinio uses the minio client
+	ClientMinio = "minio"
+
+	// AddressingPath puts the bucket into the path of requests
+	AddressingPath = "path"
+	// AddressingVirtual puts the bucket into the host name of requests
+	AddressingVirtual = "virtual"
+
+	// SignatureV4 is the default signature version
+	SignatureV4 = "v4"
+	// SignatureV2 is the legacy signature version, e.g. for old Ceph releases.
+	// Only the minio client supports it.
+	SignatureV2 = "v2"
+)
+
+// BucketStatus tells if a bucket exists and can be accessed
+type BucketStatus int
+
+const (
+	// BucketFound means that the bucket exists and is accessible
+	BucketFound BucketStatus = iota
+	// BucketNotFound means that the bucket doesn't exist
+	BucketNotFound
+	// BucketInaccessible means that access to the bucket is denied
+	// or its status can't be checked, e.g. because the endpoint is down
+	BucketInaccessible
+)
+
+func (status BucketStatus) String() string {
+	switch status {
+	case BucketFound:
+		return "found"
+	case BucketNotFound:
+		return "not found"
+	}
+	return "inaccessible"
+}
+
+// Client is the S3 client used by the driver. Both implementations
+// have the same semantics:
+//
+// GetBucketStatus returns BucketNotFound and no error if the bucket doesn't
+// exist, and BucketInaccessible with the error if it can't be accessed.
+// CreateBucket succeeds if the bucket already exists and is owned by the caller.
+// CreatePrefix creates the "prefix/" directory object.
+// SetFSMeta writes the metadata object which marks the volume of the bucket
+// or prefix, GetFSMeta returns nil without an error if the volume has none.
+// RemovePrefix removes every version of every object below "prefix/".
+// RemoveBucket removes every version of every object and the bucket itself.
+// Both abort the incomplete multipart uploads of the removed objects first.
+// Removing a bucket or prefix which doesn't exist is not an error.
+// AbortMultipartUploads aborts the incomplete multipart uploads below
+// "prefix/", or of the whole bucket if prefix is empty, which were initiated
+// before initiatedBefore, or all of them if it's zero. It returns the number
+// of aborted uploads.
+// ListBuckets returns the names of the buckets owned by the account of the keys.
+// ListPrefixes returns the top-level prefixes of the bucket which start
+// with prefix, without the trailing "/".
+// GetBucketPolicy returns an empty policy if the bucket has none,
+// SetBucketPolicy removes the policy if it's empty.
+// Every request stops when ctx is cancelled or its deadline expires.
+type Client interface {
 	Config() *Config
-	BucketExists(bucketName string) (bool, error)
-	CreateBucket(bucketName string) error
-	CreatePrefix(bucketName string, prefix string) error
-	RemovePrefix(bucketName string, prefix string) error
-	RemoveBucket(bucketName string) error
+	GetBucketStatus(ctx context.Context, bucketName string) (BucketStatus, error)
+	CreateBucket(ctx context.Context, bucketName string) error
+	CreatePrefix(ctx context.Context, bucketName string, prefix string) error
+	SetFSMeta(ctx context.Context, meta *FSMeta) error
+	GetFSMeta(ctx context.Context, bucketName string, prefix string) (*FSMeta, error)
+	RemovePrefix(ctx context.Context, bucketName string, prefix string) error
+	RemoveBucket(ctx context.Context, bucketName string) error
+	AbortMultipartUploads(ctx context.Context, bucketName string, prefix string, initiatedBefore time.Time) (int, error)
+	ListBuckets(ctx context.Context) ([]string, error)
+	ListPrefixes(ctx context.Context, bucketName string, prefix string) ([]string, error)
+	GetBucketPolicy(ctx context.Context, bucketName string) (string, error)
+	SetBucketPolicy(ctx context.Context, bucketName string, policy string) error
 }
 
 // Config holds values to configure the driver
 type Config struct {
 	AccessKeyID     string
 	SecretAccessKey string
-	Region          string
-	Endpoint        string
+	// SessionToken is set for temporary (STS) credentials
+	SessionToken string
+	Region       string
+	// Endpoint may include a base path, e.g. for S3 gateways served
+	// under a path. Only the AWS client supports that.
+	Endpoint string
+	// Endpoints are gateways of the same S3 cluster. The controller fails
+	// over between them and mounters get a healthy one. Endpoint is the first one.
+	Endpoints []string
+	// AddressingStyle is AddressingPath or AddressingVirtual. By default
+	// virtual-hosted-style requests are only sent to AWS itself.
+	AddressingStyle string
+	// SignatureVersion is SignatureV4 (default) or SignatureV2
+	SignatureVersion string
 
 	AwsRoleArn string
+	// Client is either ClientAws or ClientMinio. By default the AWS SDK
+	// is used without static keys and the minio client otherwise.
+	Client string
+	// WebIdentityTokenFile makes the driver assume AwsRoleArn with
+	// AssumeRoleWithWebIdentity, e.g. with an IRSA service account token
+	WebIdentityTokenFile string
+	// Expires is set when the keys are temporary
+	Expires time.Time
+	// ScopedCredentials is ScopedMinio or ScopedRgw to give mounters keys
+	// which only have access to their own volume
+	ScopedCredentials string
+	// RgwAdminPath is the path of the RGW admin API, "/admin" by default
+	RgwAdminPath string
+	// Anonymous makes unsigned requests to public buckets, without any keys
+	Anonymous bool
+	// PolicyPrincipals are allowed to access the bucket or prefix of every
+	// volume by bucket policy statements. They are shared by all volumes
+	// created with the secret and don't isolate these volumes from each other.
+	PolicyPrincipals []string
+	// Transport configures TLS and the proxy for the endpoint
+	Transport TransportConfig
+	// Retry is the retry policy of the clients created with NewClientFromSecret
+	Retry RetryPolicy
+	// Delete configures removal of prefixes and buckets
+	Delete DeleteOptions
 
+	// Mounter is the default mounter of volumes which don't select one,
+	// usually set by the driver configuration file
 	Mounter string
 }
 
-func NewClientFromSecret(secret map[string]string) (s3Client, error) {
+// TemporaryCredentials returns true if the keys of cfg expire, or will expire
+// once the role is assumed or keys scoped to a volume are obtained
+func (cfg *Config) TemporaryCredentials() bool {
+	return !cfg.Expires.IsZero() || cfg.AccessKeyID == "" && cfg.AwsRoleArn != "" ||
+		cfg.ScopedCredentials == ScopedMinio
+}
+
+// configFromSecret reads the driver configuration from CSI secrets,
+// the keys are set by the credentials provider
+func configFromSecret(secret map[string]string) *Config {
 	cfg := &Config{
-		AccessKeyID:     secret["accessKeyID"],
-		SecretAccessKey: secret["secretAccessKey"],
-		Region:          secret["region"],
-		Endpoint:        secret["endpoint"],
-		AwsRoleArn:      secret["awsRoleArn"],
-		// Mounter is set in the volume preferences, not secrets
-		Mounter: "",
+		AccessKeyID:          secret["accessKeyID"],
+		SecretAccessKey:      secret["secretAccessKey"],
+		SessionToken:         secret["sessionToken"],
+		Region:               secret["region"],
+		Endpoint:             secret["endpoint"],
+		Endpoints:            splitList(secret["endpoints"]),
+		AddressingStyle:      secret["addressingStyle"],
+		SignatureVersion:     secret["signatureVersion"],
+		AwsRoleArn:           secret["awsRoleArn"],
+		Client:               secret["client"],
+		WebIdentityTokenFile: secret["webIdentityTokenFile"],
+		ScopedCredentials:    secret["scopedCredentials"],
+		RgwAdminPath:         secret["rgwAdminPath"],
+		PolicyPrincipals:     splitList(secret["policyPrincipals"]),
+		Anonymous:            secret["anonymous"] == "true",
+		Transport:            transportFromSecret(secret),
+		Mounter:              secret["mounter"],
+	}
+	if len(cfg.Endpoints) > 0 {
+		cfg.Endpoint = cfg.Endpoints[0]
+	}
+	return cfg
+}
+
+func NewClientFromSecret(ctx context.Context, secret map[string]string) (Client, error) {
+	cfg, err := LoadConfig(ctx, secret)
+	if err != nil {
+		return nil, err
+	}
+	newClient, err := clientConstructor(cfg)
+	if err != nil {
+		return nil, err
+	}
+	var client Client
+	if len(cfg.Endpoints) > 1 {
+		client, err = newFailoverClient(ctx, cfg, newClient)
+	} else {
+		client, err = newClient(cfg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Retry.MaxAttempts <= 1 {
+		return client, nil
+	}
+	return &retryClient{Client: client, policy: cfg.Retry}, nil
+}
+
+// clientConstructor returns the constructor of the client selected by cfg
+func clientConstructor(cfg *Config) (func(cfg *Config) (Client, error), error) {
+	newClientAws := func(cfg *Config) (Client, error) {
+		return NewClientAws(cfg)
+	}
+	newClientMinio := func(cfg *Config) (Client, error) {
+		return NewClientMinio(cfg)
+	}
+
+	switch cfg.Client {
+	case ClientAws:
+		return newClientAws, nil
+	case ClientMinio:
+		return newClientMinio, nil
+	case "":
+	default:
+		return nil, fmt.Errorf("unknown S3 client %q, must be %q or %q", cfg.Client, ClientAws, ClientMinio)
+	}
+
+	// Only the minio client signs with V2, only the AWS client supports endpoint paths
+	if cfg.SignatureVersion == SignatureV2 {
+		return newClientMinio, nil
+	}
+	if endpointPath(cfg.Endpoint) != "" {
+		return newClientAws, nil
 	}
 
 	// If access key ID is not provided, try aws role arn.
 	if cfg.AccessKeyID == "" {
 		glog.Infof("NewClientFromSecret: awsRoleArn: '%s'", cfg.AwsRoleArn)
-		return NewClientAws(cfg)
+		return newClientAws, nil
+	}
+
+	return newClientMinio, nil
+}
+
+// checkEndpointOptions validates the addressing style and the signature version
+func checkEndpointOptions(cfg *Config) error {
+	switch cfg.AddressingStyle {
+	case "", AddressingPath, AddressingVirtual:
+	default:
+		return fmt.Errorf("unknown addressingStyle %q, must be %q or %q", cfg.AddressingStyle, AddressingPath, AddressingVirtual)
 	}
+	switch cfg.SignatureVersion {
+	case "", SignatureV4, SignatureV2:
+	default:
+		return fmt.Errorf("unknown signatureVersion %q, must be %q or %q", cfg.SignatureVersion, SignatureV4, SignatureV2)
+	}
+	return nil
+}
+
+// endpointPath returns the base path of the endpoint without the trailing slash
+func endpointPath(endpoint string) string {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSuffix(u.Path, "/")
+}
+
+// splitList splits a comma separated list
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// objectPrefix returns the key prefix of all objects of a volume
+func objectPrefix(prefix string) string {
+	if prefix == "" {
+		return ""
+	}
+	return strings.TrimSuffix(prefix, "/") + "/"
+}
 
-	return NewClientMinio(cfg)
+// metadataKey returns the key of the metadata object of a volume
+func metadataKey(prefix string) string {
+	return objectPrefix(prefix) + metadataName
 }
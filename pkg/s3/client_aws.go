@@ -3,12 +3,24 @@ package s3
 import (
 	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/smithy-go"
 	"github.com/golang/glog"
-	"github.com/udhos/boilerplate/awsconfig"
 )
 
 type s3ClientAws struct {
@@ -16,125 +28,453 @@ type s3ClientAws struct {
 	awsS3Client *s3.Client
 }
 
-func NewClientAws(cfg *Config) (*s3ClientAws, error) {
+const (
+	roleSessionName = "k8s-csi-s3driver"
+	defaultRegion   = "us-east-1"
+	// Refresh temporary credentials this long before they expire
+	credentialsExpiryWindow = 5 * time.Minute
+)
 
-	awsConfOptions := awsconfig.Options{
-		Region:          cfg.Region,
-		RoleArn:         cfg.AwsRoleArn,
-		RoleSessionName: "k8s-csi-s3driver",
-		Printf:          glog.Infof,
+func NewClientAws(cfg *Config) (*s3ClientAws, error) {
+	if cfg.SignatureVersion == SignatureV2 {
+		return nil, fmt.Errorf("the AWS client doesn't support signature version 2, use the minio client")
 	}
-
-	awsConf, errAwsConf := awsconfig.AwsConfig(awsConfOptions)
-	if errAwsConf != nil {
-		return nil, errAwsConf
+	// loading the configuration only reads local files, requests use their own contexts
+	awsConf, err := loadAwsConfig(context.Background(), cfg)
+	if err != nil {
+		return nil, err
 	}
 
 	client := &s3ClientAws{
-		config:      cfg,
-		awsS3Client: s3.NewFromConfig(awsConf.AwsConfig),
+		config: cfg,
+		awsS3Client: s3.NewFromConfig(awsConf, func(o *s3.Options) {
+			// requests are retried by the retry policy
+			o.Retryer = aws.NopRetryer{}
+			if cfg.Endpoint != "" {
+				o.EndpointResolver = s3.EndpointResolverFromURL(cfg.Endpoint)
+				// Only AWS itself is known to support virtual-hosted-style requests
+				o.UsePathStyle = !isAwsEndpoint(cfg.Endpoint)
+			}
+			switch cfg.AddressingStyle {
+			case AddressingPath:
+				o.UsePathStyle = true
+			case AddressingVirtual:
+				o.UsePathStyle = false
+			}
+		}),
 	}
 
 	return client, nil
 }
 
+// loadAwsConfig uses static keys from cfg if present, assumes cfg.AwsRoleArn
+// if set, and falls back to the default credentials chain otherwise
+func loadAwsConfig(ctx context.Context, cfg *Config) (aws.Config, error) {
+	region := cfg.Region
+	if region == "" && cfg.Endpoint != "" {
+		// Other S3 implementations don't care about the region, but requests must be signed with some
+		region = defaultRegion
+	}
+	opts := []func(*config.LoadOptions) error{
+		config.WithRegion(region),
+	}
+	if !cfg.Transport.IsDefault() {
+		if err := cfg.Transport.Validate(); err != nil {
+			return aws.Config{}, err
+		}
+		// STS requests for roles go through the same transport. The SDK adds
+		// AWS_CA_BUNDLE of the driver to buildable clients only.
+		opts = append(opts, config.WithHTTPClient(awshttp.NewBuildableClient().WithTransportOptions(
+			func(transport *http.Transport) {
+				cfg.Transport.apply(transport)
+			})))
+	}
+	if cfg.Anonymous {
+		// requests to public buckets are sent unsigned
+		opts = append(opts, config.WithCredentialsProvider(aws.AnonymousCredentials{}))
+	} else if cfg.AccessKeyID != "" {
+		opts = append(opts, config.WithCredentialsProvider(
+			credentials.NewStaticCredentialsProvider(cfg.AccessKeyID, cfg.SecretAccessKey, cfg.SessionToken),
+		))
+	}
+	awsConf, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		glog.Errorf("loadAwsConfig: load config: %v", err)
+		return awsConf, err
+	}
+
+	var provider aws.CredentialsProvider
+	if cfg.Anonymous {
+		// no role to assume
+	} else if cfg.AwsRoleArn != "" && cfg.WebIdentityTokenFile != "" {
+		glog.Infof("loadAwsConfig: AssumeRoleWithWebIdentity: arn: %s token: %s", cfg.AwsRoleArn, cfg.WebIdentityTokenFile)
+		provider = stscreds.NewWebIdentityRoleProvider(sts.NewFromConfig(awsConf), cfg.AwsRoleArn,
+			stscreds.IdentityTokenFile(cfg.WebIdentityTokenFile),
+			func(o *stscreds.WebIdentityRoleOptions) {
+				o.RoleSessionName = roleSessionName
+			})
+	} else if cfg.AwsRoleArn != "" {
+		glog.Infof("loadAwsConfig: AssumeRole: arn: %s", cfg.AwsRoleArn)
+		provider = stscreds.NewAssumeRoleProvider(sts.NewFromConfig(awsConf), cfg.AwsRoleArn,
+			func(o *stscreds.AssumeRoleOptions) {
+				o.RoleSessionName = roleSessionName
+			})
+	}
+	if provider != nil {
+		awsConf.Credentials = aws.NewCredentialsCache(provider, func(o *aws.CredentialsCacheOptions) {
+			o.ExpiryWindow = credentialsExpiryWindow
+		})
+	}
+
+	return awsConf, nil
+}
+
+// ResolveCredentials obtains temporary keys for a config without static keys
+// by assuming its role, with a web identity token if one is configured.
+// Mounters can't assume roles by themselves, so the node plugin hands them
+// the keys and renews them before cfg.Expires. Configs with static keys
+// or without a role are returned unchanged.
+func ResolveCredentials(ctx context.Context, cfg *Config) (*Config, error) {
+	if cfg.AccessKeyID != "" || cfg.AwsRoleArn == "" {
+		return cfg, nil
+	}
+	awsConf, err := loadAwsConfig(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	creds, err := awsConf.Credentials.Retrieve(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to assume role %s: %v", cfg.AwsRoleArn, err)
+	}
+	resolved := *cfg
+	resolved.AccessKeyID = creds.AccessKeyID
+	resolved.SecretAccessKey = creds.SecretAccessKey
+	resolved.SessionToken = creds.SessionToken
+	if creds.CanExpire {
+		resolved.Expires = creds.Expires
+	}
+	return &resolved, nil
+}
+
 func (client *s3ClientAws) Config() *Config {
 	return client.config
 }
 
-func (client *s3ClientAws) BucketExists(bucketName string) (bool, error) {
+func (client *s3ClientAws) GetBucketStatus(ctx context.Context, bucketName string) (BucketStatus, error) {
 	input := s3.HeadBucketInput{
 		Bucket: aws.String(bucketName),
 	}
-	_, err := client.awsS3Client.HeadBucket(context.TODO(), &input)
-	return err == nil, err
+	_, err := client.awsS3Client.HeadBucket(ctx, &input)
+	switch {
+	case err == nil:
+		return BucketFound, nil
+	case isAwsNotFound(err):
+		return BucketNotFound, nil
+	}
+	return BucketInaccessible, err
 }
 
-func (client *s3ClientAws) CreateBucket(bucketName string) error {
+func (client *s3ClientAws) CreateBucket(ctx context.Context, bucketName string) error {
 	input := s3.CreateBucketInput{
 		Bucket: aws.String(bucketName),
-		CreateBucketConfiguration: &types.CreateBucketConfiguration{
+	}
+	// us-east-1 is the default and can't be used as a location constraint
+	if client.config.Region != "" && client.config.Region != defaultRegion {
+		input.CreateBucketConfiguration = &types.CreateBucketConfiguration{
 			LocationConstraint: types.BucketLocationConstraint(client.config.Region),
-		},
+		}
+	}
+	_, err := client.awsS3Client.CreateBucket(ctx, &input)
+	var owned *types.BucketAlreadyOwnedByYou
+	if errors.As(err, &owned) {
+		return nil
 	}
-	_, err := client.awsS3Client.CreateBucket(context.TODO(), &input)
 	return err
 }
 
-func (client *s3ClientAws) CreatePrefix(bucketName string, prefix string) error {
+func (client *s3ClientAws) CreatePrefix(ctx context.Context, bucketName string, prefix string) error {
 	if prefix == "" {
 		return nil
 	}
 	input := s3.PutObjectInput{
 		Bucket: aws.String(bucketName),
-		Key:    aws.String(prefix + "/"),
+		Key:    aws.String(objectPrefix(prefix)),
 		Body:   &bytes.Buffer{},
 	}
-	_, err := client.awsS3Client.PutObject(context.TODO(), &input)
+	_, err := client.awsS3Client.PutObject(ctx, &input)
 	return err
 }
 
-func (client *s3ClientAws) RemovePrefix(bucketName string, prefix string) error {
-	errObj := client.removeObjectsFromPrefix(bucketName, prefix)
-	if errObj != nil {
-		glog.Errorf("RemovePrefix: removeObjectsFromPrefix: bucket='%s' prefix='%s' %v",
-			bucketName, prefix, errObj)
+func (client *s3ClientAws) SetFSMeta(ctx context.Context, meta *FSMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	input := s3.PutObjectInput{
+		Bucket:      aws.String(meta.BucketName),
+		Key:         aws.String(metadataKey(meta.Prefix)),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String("application/json"),
 	}
+	_, err = client.awsS3Client.PutObject(ctx, &input)
+	return err
+}
 
-	return client.removeObjects(bucketName, []string{prefix})
+func (client *s3ClientAws) GetFSMeta(ctx context.Context, bucketName string, prefix string) (*FSMeta, error) {
+	input := s3.GetObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(metadataKey(prefix)),
+	}
+	result, err := client.awsS3Client.GetObject(ctx, &input)
+	if isAwsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer result.Body.Close()
+	meta := &FSMeta{}
+	if err = json.NewDecoder(result.Body).Decode(meta); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", metadataKey(prefix), err)
+	}
+	return meta, nil
 }
 
-func (client *s3ClientAws) RemoveBucket(bucketName string) error {
-	errObj := client.removeObjectsFromPrefix(bucketName, "")
-	if errObj != nil {
-		glog.Errorf("RemoveBucket: removeObjectsFromPrefix: bucket='%s' %v",
-			bucketName, errObj)
+func (client *s3ClientAws) RemovePrefix(ctx context.Context, bucketName string, prefix string) error {
+	_, err := client.AbortMultipartUploads(ctx, bucketName, prefix, time.Time{})
+	if err == nil {
+		err = client.removeObjects(ctx, bucketName, objectPrefix(prefix))
 	}
+	if isAwsNotFound(err) {
+		return nil
+	}
+	return err
+}
 
-	input := s3.DeleteBucketInput{Bucket: aws.String(bucketName)}
-	_, err := client.awsS3Client.DeleteBucket(context.TODO(), &input)
+func (client *s3ClientAws) RemoveBucket(ctx context.Context, bucketName string) error {
+	_, err := client.AbortMultipartUploads(ctx, bucketName, "", time.Time{})
+	if err == nil {
+		err = client.removeObjects(ctx, bucketName, "")
+	}
+	if err == nil {
+		input := s3.DeleteBucketInput{Bucket: aws.String(bucketName)}
+		_, err = client.awsS3Client.DeleteBucket(ctx, &input)
+	}
+	if isAwsNotFound(err) {
+		return nil
+	}
 	return err
 }
 
-func (client *s3ClientAws) removeObjectsFromPrefix(bucketName string, prefix string) error {
+func (client *s3ClientAws) AbortMultipartUploads(ctx context.Context, bucketName string, prefix string, initiatedBefore time.Time) (int, error) {
+	aborted, err := abortUploads(ctx, bucketName, initiatedBefore,
+		func(emit func(upload multipartUpload) error) error {
+			input := &s3.ListMultipartUploadsInput{
+				Bucket: aws.String(bucketName),
+				Prefix: aws.String(objectPrefix(prefix)),
+			}
+			for {
+				result, err := client.awsS3Client.ListMultipartUploads(ctx, input)
+				if err != nil {
+					return err
+				}
+				for _, u := range result.Uploads {
+					upload := multipartUpload{Key: aws.ToString(u.Key), UploadID: aws.ToString(u.UploadId), Initiated: aws.ToTime(u.Initiated)}
+					if err = emit(upload); err != nil {
+						return err
+					}
+				}
+				if !result.IsTruncated {
+					return nil
+				}
+				input.KeyMarker = result.NextKeyMarker
+				input.UploadIdMarker = result.NextUploadIdMarker
+			}
+		},
+		func(ctx context.Context, upload multipartUpload) error {
+			input := s3.AbortMultipartUploadInput{
+				Bucket:   aws.String(bucketName),
+				Key:      aws.String(upload.Key),
+				UploadId: aws.String(upload.UploadID),
+			}
+			_, err := client.awsS3Client.AbortMultipartUpload(ctx, &input)
+			return err
+		})
+	if isAwsNotFound(err) {
+		return aborted, nil
+	}
+	return aborted, err
+}
 
-	result, errList := client.awsS3Client.ListObjectsV2(context.TODO(), &s3.ListObjectsV2Input{
-		Bucket: aws.String(bucketName),
-		Prefix: aws.String(prefix),
-	})
+func (client *s3ClientAws) ListBuckets(ctx context.Context) ([]string, error) {
+	result, err := client.awsS3Client.ListBuckets(ctx, &s3.ListBucketsInput{})
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(result.Buckets))
+	for _, b := range result.Buckets {
+		names = append(names, aws.ToString(b.Name))
+	}
+	return names, nil
+}
 
-	if errList != nil {
-		glog.Errorf("removeObjectsFromPrefix: bucket='%s' prefix='%s': error listing objects: %v",
-			bucketName, prefix, errList)
-		return errList
+func (client *s3ClientAws) ListPrefixes(ctx context.Context, bucketName string, prefix string) ([]string, error) {
+	input := &s3.ListObjectsV2Input{
+		Bucket:    aws.String(bucketName),
+		Prefix:    aws.String(prefix),
+		Delimiter: aws.String("/"),
+	}
+	var prefixes []string
+	for {
+		result, err := client.awsS3Client.ListObjectsV2(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range result.CommonPrefixes {
+			prefixes = append(prefixes, strings.TrimSuffix(aws.ToString(p.Prefix), "/"))
+		}
+		if !result.IsTruncated {
+			return prefixes, nil
+		}
+		input.ContinuationToken = result.NextContinuationToken
 	}
+}
 
-	count := len(result.Contents)
+func (client *s3ClientAws) GetBucketPolicy(ctx context.Context, bucketName string) (string, error) {
+	input := s3.GetBucketPolicyInput{Bucket: aws.String(bucketName)}
+	result, err := client.awsS3Client.GetBucketPolicy(ctx, &input)
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && apiErr.ErrorCode() == "NoSuchBucketPolicy" {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return aws.ToString(result.Policy), nil
+}
 
-	glog.Infof("removeObjectsFromPrefix: bucket='%s' prefix='%s': found %d keys",
-		bucketName, prefix, count)
+func (client *s3ClientAws) SetBucketPolicy(ctx context.Context, bucketName string, policy string) error {
+	if policy == "" {
+		input := s3.DeleteBucketPolicyInput{Bucket: aws.String(bucketName)}
+		_, err := client.awsS3Client.DeleteBucketPolicy(ctx, &input)
+		return err
+	}
+	input := s3.PutBucketPolicyInput{
+		Bucket: aws.String(bucketName),
+		Policy: aws.String(policy),
+	}
+	_, err := client.awsS3Client.PutBucketPolicy(ctx, &input)
+	return err
+}
 
-	if count < 1 {
-		return nil
+// removeObjects removes all versions of all objects with the prefix, with
+// a request per object if the endpoint doesn't support multi-object delete
+func (client *s3ClientAws) removeObjects(ctx context.Context, bucketName string, prefix string) error {
+	remove, batchSize := client.deleteObjects, 0
+	if !supportsMultiObjectDelete(client.config.Endpoint) {
+		remove, batchSize = client.deleteObject, 1
 	}
+	d := newDeleter(ctx, bucketName, client.config.Delete, remove)
+	total, err := d.run(ctx, func(emit func([]objectVersion) bool) error {
+		input := &s3.ListObjectVersionsInput{
+			Bucket: aws.String(bucketName),
+			Prefix: aws.String(prefix),
+		}
+		for {
+			result, err := client.awsS3Client.ListObjectVersions(ctx, input)
+			if err != nil {
+				return err
+			}
+
+			var objects []objectVersion
+			for _, v := range result.Versions {
+				objects = append(objects, objectVersion{Key: aws.ToString(v.Key), VersionID: aws.ToString(v.VersionId)})
+			}
+			for _, m := range result.DeleteMarkers {
+				objects = append(objects, objectVersion{Key: aws.ToString(m.Key), VersionID: aws.ToString(m.VersionId)})
+			}
+			for len(objects) > 0 {
+				batch := objects
+				if batchSize > 0 && len(batch) > batchSize {
+					batch = objects[0:batchSize]
+				}
+				if !emit(batch) {
+					return nil
+				}
+				objects = objects[len(batch):]
+			}
 
-	var keys []string
-	for _, o := range result.Contents {
-		keys = append(keys, *o.Key)
+			if !result.IsTruncated {
+				return nil
+			}
+			input.KeyMarker = result.NextKeyMarker
+			input.VersionIdMarker = result.NextVersionIdMarker
+		}
+	})
+	if err != nil {
+		return err
 	}
 
-	return client.removeObjects(bucketName, keys)
+	glog.Infof("removeObjects: bucket='%s' prefix='%s': removed %d objects",
+		bucketName, prefix, total)
+	return nil
+}
+
+// deleteObject removes a single object version
+func (client *s3ClientAws) deleteObject(ctx context.Context, bucketName string, objects []objectVersion) (int, error) {
+	input := s3.DeleteObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(objects[0].Key),
+	}
+	if objects[0].VersionID != "" {
+		input.VersionId = aws.String(objects[0].VersionID)
+	}
+	if _, err := client.awsS3Client.DeleteObject(ctx, &input); err != nil {
+		return 1, err
+	}
+	return 0, nil
 }
 
-func (client *s3ClientAws) removeObjects(bucketName string, keys []string) error {
-	var objectIds []types.ObjectIdentifier
-	for _, key := range keys {
-		objectIds = append(objectIds, types.ObjectIdentifier{Key: aws.String(key)})
+// deleteObjects removes a page of listed objects with a multi-object delete request
+func (client *s3ClientAws) deleteObjects(ctx context.Context, bucketName string, objects []objectVersion) (int, error) {
+	objectIds := make([]types.ObjectIdentifier, len(objects))
+	for i, object := range objects {
+		objectIds[i] = types.ObjectIdentifier{Key: aws.String(object.Key)}
+		if object.VersionID != "" {
+			objectIds[i].VersionId = aws.String(object.VersionID)
+		}
 	}
 	input := s3.DeleteObjectsInput{
 		Bucket: aws.String(bucketName),
-		Delete: &types.Delete{Objects: objectIds},
+		Delete: &types.Delete{Objects: objectIds, Quiet: true},
 	}
-	_, err := client.awsS3Client.DeleteObjects(context.TODO(), &input)
-	return err
+	result, err := client.awsS3Client.DeleteObjects(ctx, &input)
+	if err != nil {
+		return len(objects), err
+	}
+	for _, e := range result.Errors {
+		glog.Errorf("Failed to remove object %s, error: %s", aws.ToString(e.Key), aws.ToString(e.Message))
+	}
+	if len(result.Errors) > 0 {
+		e := result.Errors[0]
+		return len(result.Errors), &smithy.GenericAPIError{Code: aws.ToString(e.Code), Message: aws.ToString(e.Message)}
+	}
+	return 0, nil
+}
+
+// isAwsNotFound checks if the bucket or the object doesn't exist
+func isAwsNotFound(err error) bool {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "NotFound", "NoSuchBucket", "NoSuchKey":
+			return true
+		}
+	}
+	return false
+}
+
+func isAwsEndpoint(endpoint string) bool {
+	u, err := url.Parse(endpoint)
+	return err == nil && strings.HasSuffix(u.Hostname(), ".amazonaws.com")
 }
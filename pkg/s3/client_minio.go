@@ -3,8 +3,12 @@ package s3
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/url"
+	"strings"
+	"time"
 
 	"github.com/golang/glog"
 	"github.com/minio/minio-go/v7"
@@ -18,7 +22,6 @@ const (
 type s3ClientMinio struct {
 	config *Config
 	minio  *minio.Client
-	ctx    context.Context
 }
 
 type FSMeta struct {
@@ -29,6 +32,12 @@ type FSMeta struct {
 	CapacityBytes int64    `json:"CapacityBytes"`
 }
 
+func init() {
+	// Requests are retried by the retry policy. minio-go only has this global
+	// setting, the driver doesn't use minio-go for anything else.
+	minio.MaxRetry = 1
+}
+
 func NewClientMinio(cfg *Config) (*s3ClientMinio, error) {
 	var client = &s3ClientMinio{}
 
@@ -37,20 +46,43 @@ func NewClientMinio(cfg *Config) (*s3ClientMinio, error) {
 	if err != nil {
 		return nil, err
 	}
+	if endpointPath(cfg.Endpoint) != "" {
+		return nil, fmt.Errorf("the minio client doesn't support endpoints with a path, use the AWS client")
+	}
 	ssl := u.Scheme == "https"
 	endpoint := u.Hostname()
 	if u.Port() != "" {
 		endpoint = u.Hostname() + ":" + u.Port()
 	}
-	minioClient, err := minio.New(endpoint, &minio.Options{
-		Creds:  credentials.NewStaticV4(client.config.AccessKeyID, client.config.SecretAccessKey, client.config.Region),
+	creds := credentials.NewStaticV4(client.config.AccessKeyID, client.config.SecretAccessKey, client.config.SessionToken)
+	if client.config.SignatureVersion == SignatureV2 {
+		creds = credentials.NewStaticV2(client.config.AccessKeyID, client.config.SecretAccessKey, client.config.SessionToken)
+	}
+	if client.config.Anonymous {
+		creds = credentials.NewStatic("", "", "", credentials.SignatureAnonymous)
+	}
+	opts := &minio.Options{
+		Creds:  creds,
 		Secure: ssl,
-	})
+		// like the AWS client, virtual-hosted-style is only used for AWS by default
+		BucketLookup: minio.BucketLookupAuto,
+	}
+	switch cfg.AddressingStyle {
+	case AddressingPath:
+		opts.BucketLookup = minio.BucketLookupPath
+	case AddressingVirtual:
+		opts.BucketLookup = minio.BucketLookupDNS
+	}
+	if !cfg.Transport.IsDefault() {
+		if opts.Transport, err = newTransport(&cfg.Transport); err != nil {
+			return nil, err
+		}
+	}
+	minioClient, err := minio.New(endpoint, opts)
 	if err != nil {
 		return nil, err
 	}
 	client.minio = minioClient
-	client.ctx = context.Background()
 	return client, nil
 }
 
@@ -58,17 +90,28 @@ func (client *s3ClientMinio) Config() *Config {
 	return client.config
 }
 
-func (client *s3ClientMinio) BucketExists(bucketName string) (bool, error) {
-	return client.minio.BucketExists(client.ctx, bucketName)
+func (client *s3ClientMinio) GetBucketStatus(ctx context.Context, bucketName string) (BucketStatus, error) {
+	exists, err := client.minio.BucketExists(ctx, bucketName)
+	switch {
+	case err != nil:
+		return BucketInaccessible, err
+	case !exists:
+		return BucketNotFound, nil
+	}
+	return BucketFound, nil
 }
 
-func (client *s3ClientMinio) CreateBucket(bucketName string) error {
-	return client.minio.MakeBucket(client.ctx, bucketName, minio.MakeBucketOptions{Region: client.config.Region})
+func (client *s3ClientMinio) CreateBucket(ctx context.Context, bucketName string) error {
+	err := client.minio.MakeBucket(ctx, bucketName, minio.MakeBucketOptions{Region: client.config.Region})
+	if minio.ToErrorResponse(err).Code == "BucketAlreadyOwnedByYou" {
+		return nil
+	}
+	return err
 }
 
-func (client *s3ClientMinio) CreatePrefix(bucketName string, prefix string) error {
+func (client *s3ClientMinio) CreatePrefix(ctx context.Context, bucketName string, prefix string) error {
 	if prefix != "" {
-		_, err := client.minio.PutObject(client.ctx, bucketName, prefix+"/", bytes.NewReader([]byte("")), 0, minio.PutObjectOptions{})
+		_, err := client.minio.PutObject(ctx, bucketName, objectPrefix(prefix), bytes.NewReader([]byte("")), 0, minio.PutObjectOptions{})
 		if err != nil {
 			return err
 		}
@@ -76,131 +119,237 @@ func (client *s3ClientMinio) CreatePrefix(bucketName string, prefix string) erro
 	return nil
 }
 
-func (client *s3ClientMinio) RemovePrefix(bucketName string, prefix string) error {
-	var err error
+func (client *s3ClientMinio) SetFSMeta(ctx context.Context, meta *FSMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	_, err = client.minio.PutObject(ctx, meta.BucketName, metadataKey(meta.Prefix), bytes.NewReader(data), int64(len(data)),
+		minio.PutObjectOptions{ContentType: "application/json"})
+	return err
+}
 
-	if err = client.removeObjects(bucketName, prefix); err == nil {
-		return client.minio.RemoveObject(client.ctx, bucketName, prefix, minio.RemoveObjectOptions{})
+func (client *s3ClientMinio) GetFSMeta(ctx context.Context, bucketName string, prefix string) (*FSMeta, error) {
+	object, err := client.minio.GetObject(ctx, bucketName, metadataKey(prefix), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer object.Close()
+	data, err := ioutil.ReadAll(object)
+	if isMinioNotFound(err) {
+		return nil, nil
 	}
+	if err != nil {
+		return nil, err
+	}
+	meta := &FSMeta{}
+	if err = json.Unmarshal(data, meta); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", metadataKey(prefix), err)
+	}
+	return meta, nil
+}
 
-	glog.Warningf("removeObjects failed with: %s, will try removeObjectsOneByOne", err)
+func (client *s3ClientMinio) RemovePrefix(ctx context.Context, bucketName string, prefix string) error {
+	if _, err := client.AbortMultipartUploads(ctx, bucketName, prefix, time.Time{}); err != nil {
+		return err
+	}
 
-	if err = client.removeObjectsOneByOne(bucketName, prefix); err == nil {
-		return client.minio.RemoveObject(client.ctx, bucketName, prefix, minio.RemoveObjectOptions{})
+	var err error
+	if !supportsMultiObjectDelete(client.config.Endpoint) {
+		err = client.removeObjectsOneByOne(ctx, bucketName, objectPrefix(prefix))
+	} else if err = client.removeObjects(ctx, bucketName, objectPrefix(prefix)); err != nil && !isMinioNotFound(err) && ctx.Err() == nil {
+		glog.Warningf("removeObjects failed with: %s, will try removeObjectsOneByOne", err)
+		err = client.removeObjectsOneByOne(ctx, bucketName, objectPrefix(prefix))
 	}
 
+	if isMinioNotFound(err) {
+		return nil
+	}
 	return err
 }
 
-func (client *s3ClientMinio) RemoveBucket(bucketName string) error {
-	var err error
-
-	if err = client.removeObjects(bucketName, ""); err == nil {
-		return client.minio.RemoveBucket(client.ctx, bucketName)
+func (client *s3ClientMinio) RemoveBucket(ctx context.Context, bucketName string) error {
+	if _, err := client.AbortMultipartUploads(ctx, bucketName, "", time.Time{}); err != nil {
+		return err
 	}
 
-	glog.Warningf("removeObjects failed with: %s, will try removeObjectsOneByOne", err)
-
-	if err = client.removeObjectsOneByOne(bucketName, ""); err == nil {
-		return client.minio.RemoveBucket(client.ctx, bucketName)
+	var err error
+	if !supportsMultiObjectDelete(client.config.Endpoint) {
+		err = client.removeObjectsOneByOne(ctx, bucketName, "")
+	} else if err = client.removeObjects(ctx, bucketName, ""); err != nil && !isMinioNotFound(err) && ctx.Err() == nil {
+		glog.Warningf("removeObjects failed with: %s, will try removeObjectsOneByOne", err)
+		err = client.removeObjectsOneByOne(ctx, bucketName, "")
+	}
+	if err == nil {
+		err = client.minio.RemoveBucket(ctx, bucketName)
 	}
 
+	if isMinioNotFound(err) {
+		return nil
+	}
 	return err
 }
 
-func (client *s3ClientMinio) removeObjects(bucketName, prefix string) error {
-	objectsCh := make(chan minio.ObjectInfo)
-	var listErr error
-
-	go func() {
-		defer close(objectsCh)
-
-		for object := range client.minio.ListObjects(
-			client.ctx,
-			bucketName,
-			minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
-			if object.Err != nil {
-				listErr = object.Err
-				return
+// Multipart upload listings return at most this many uploads
+const minioUploadsPageSize = 1000
+
+func (client *s3ClientMinio) AbortMultipartUploads(ctx context.Context, bucketName string, prefix string, initiatedBefore time.Time) (int, error) {
+	// ListIncompleteUploads lists the parts of every upload, the core API doesn't
+	core := minio.Core{Client: client.minio}
+	aborted, err := abortUploads(ctx, bucketName, initiatedBefore,
+		func(emit func(upload multipartUpload) error) error {
+			keyMarker, uploadIDMarker := "", ""
+			for {
+				result, err := core.ListMultipartUploads(ctx, bucketName, objectPrefix(prefix),
+					keyMarker, uploadIDMarker, "", minioUploadsPageSize)
+				if err != nil {
+					return err
+				}
+				for _, u := range result.Uploads {
+					if err = emit(multipartUpload{Key: u.Key, UploadID: u.UploadID, Initiated: u.Initiated}); err != nil {
+						return err
+					}
+				}
+				if !result.IsTruncated {
+					return nil
+				}
+				keyMarker, uploadIDMarker = result.NextKeyMarker, result.NextUploadIDMarker
 			}
-			objectsCh <- object
-		}
-	}()
+		},
+		func(ctx context.Context, upload multipartUpload) error {
+			return core.AbortMultipartUpload(ctx, bucketName, upload.Key, upload.UploadID)
+		})
+	if isMinioNotFound(err) {
+		return aborted, nil
+	}
+	return aborted, err
+}
 
-	if listErr != nil {
-		glog.Error("Error listing objects", listErr)
-		return listErr
+func (client *s3ClientMinio) GetBucketPolicy(ctx context.Context, bucketName string) (string, error) {
+	return client.minio.GetBucketPolicy(ctx, bucketName)
+}
+
+func (client *s3ClientMinio) ListBuckets(ctx context.Context) ([]string, error) {
+	buckets, err := client.minio.ListBuckets(ctx)
+	if err != nil {
+		return nil, err
 	}
+	names := make([]string, 0, len(buckets))
+	for _, b := range buckets {
+		names = append(names, b.Name)
+	}
+	return names, nil
+}
 
-	select {
-	default:
-		opts := minio.RemoveObjectsOptions{
-			GovernanceBypass: true,
-		}
-		errorCh := client.minio.RemoveObjects(client.ctx, bucketName, objectsCh, opts)
-		haveErrWhenRemoveObjects := false
-		for e := range errorCh {
-			glog.Errorf("Failed to remove object %s, error: %s", e.ObjectName, e.Err)
-			haveErrWhenRemoveObjects = true
+func (client *s3ClientMinio) ListPrefixes(ctx context.Context, bucketName string, prefix string) ([]string, error) {
+	var prefixes []string
+	for object := range client.minio.ListObjects(ctx, bucketName, minio.ListObjectsOptions{Prefix: prefix}) {
+		if object.Err != nil {
+			return nil, object.Err
 		}
-		if haveErrWhenRemoveObjects {
-			return fmt.Errorf("Failed to remove all objects of bucket %s", bucketName)
+		// without Recursive prefixes are listed as keys ending with "/"
+		if strings.HasSuffix(object.Key, "/") {
+			prefixes = append(prefixes, strings.TrimSuffix(object.Key, "/"))
 		}
 	}
+	return prefixes, nil
+}
 
-	return nil
+func (client *s3ClientMinio) SetBucketPolicy(ctx context.Context, bucketName string, policy string) error {
+	return client.minio.SetBucketPolicy(ctx, bucketName, policy)
 }
 
-// will delete files one by one without file lock
-func (client *s3ClientMinio) removeObjectsOneByOne(bucketName, prefix string) error {
-	parallelism := 16
-	objectsCh := make(chan minio.ObjectInfo, 1)
-	guardCh := make(chan int, parallelism)
-	var listErr error
-	totalObjects := 0
-	removeErrors := 0
+// isMinioNotFound checks if the bucket or the object doesn't exist
+func isMinioNotFound(err error) bool {
+	switch minio.ToErrorResponse(err).Code {
+	case "NoSuchBucket", "NoSuchKey", "NotFound":
+		return true
+	}
+	return false
+}
 
-	go func() {
-		defer close(objectsCh)
+func (client *s3ClientMinio) removeObjects(ctx context.Context, bucketName, prefix string) error {
+	// minio-go loses the version ID marker between pages of a version listing,
+	// so the remaining versions of the key at a page boundary are skipped.
+	// Repeat until nothing is listed anymore.
+	for {
+		listed, err := client.removeListedObjects(ctx, bucketName, prefix, minioDeleteBatchSize, client.removeBatch)
+		if err != nil || listed == 0 {
+			return err
+		}
+	}
+}
 
-		for object := range client.minio.ListObjects(client.ctx, bucketName,
-			minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+// Multi-object delete requests remove at most this many objects
+const minioDeleteBatchSize = 1000
+
+// removeListedObjects lists the objects once and removes them in batches
+// of batchSize with remove. It returns the number of listed objects.
+func (client *s3ClientMinio) removeListedObjects(ctx context.Context, bucketName, prefix string,
+	batchSize int, remove deleteBatchFunc) (int, error) {
+	listed := 0
+	d := newDeleter(ctx, bucketName, client.config.Delete, remove)
+	_, err := d.run(ctx, func(emit func([]objectVersion) bool) error {
+		// stop the listing when the deleter stops
+		listCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		var batch []objectVersion
+		for object := range client.minio.ListObjects(listCtx, bucketName,
+			minio.ListObjectsOptions{Prefix: prefix, Recursive: true, WithVersions: true}) {
 			if object.Err != nil {
-				listErr = object.Err
-				return
+				return object.Err
+			}
+			listed++
+			batch = append(batch, objectVersion{Key: object.Key, VersionID: object.VersionID})
+			if len(batch) == batchSize {
+				if !emit(batch) {
+					return nil
+				}
+				batch = nil
 			}
-			totalObjects++
-			objectsCh <- object
 		}
-	}()
+		if len(batch) > 0 {
+			emit(batch)
+		}
+		return nil
+	})
+	return listed, err
+}
 
-	if listErr != nil {
-		glog.Error("Error listing objects", listErr)
-		return listErr
+// removeBatch removes objects with a multi-object delete request
+func (client *s3ClientMinio) removeBatch(ctx context.Context, bucketName string, objects []objectVersion) (int, error) {
+	objectsCh := make(chan minio.ObjectInfo, len(objects))
+	for _, object := range objects {
+		objectsCh <- minio.ObjectInfo{Key: object.Key, VersionID: object.VersionID}
 	}
+	close(objectsCh)
 
-	for object := range objectsCh {
-		guardCh <- 1
-		go func() {
-			err := client.minio.RemoveObject(client.ctx, bucketName, object.Key,
-				minio.RemoveObjectOptions{VersionID: object.VersionID})
-			if err != nil {
-				glog.Errorf("Failed to remove object %s, error: %s", object.Key, err)
-				removeErrors++
-			}
-			<-guardCh
-		}()
-	}
-	for i := 0; i < parallelism; i++ {
-		guardCh <- 1
+	failed := 0
+	var firstErr error
+	opts := minio.RemoveObjectsOptions{
+		GovernanceBypass: true,
 	}
-	for i := 0; i < parallelism; i++ {
-		<-guardCh
-	}
-
-	if removeErrors > 0 {
-		return fmt.Errorf("Failed to remove %v objects out of total %v of path %s", removeErrors, totalObjects, bucketName)
+	for e := range client.minio.RemoveObjects(ctx, bucketName, objectsCh, opts) {
+		glog.Errorf("Failed to remove object %s, error: %s", e.ObjectName, e.Err)
+		failed++
+		if firstErr == nil {
+			firstErr = e.Err
+		}
 	}
+	return failed, firstErr
+}
 
-	return nil
+// removeObjectsOneByOne removes objects with a request per object,
+// for S3 implementations without multi-object delete
+func (client *s3ClientMinio) removeObjectsOneByOne(ctx context.Context, bucketName, prefix string) error {
+	_, err := client.removeListedObjects(ctx, bucketName, prefix, 1,
+		func(ctx context.Context, bucketName string, objects []objectVersion) (int, error) {
+			err := client.minio.RemoveObject(ctx, bucketName, objects[0].Key,
+				minio.RemoveObjectOptions{VersionID: objects[0].VersionID})
+			if err != nil {
+				return 1, err
+			}
+			return 0, nil
+		})
+	return err
 }
@@ -0,0 +1,293 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/yandex-cloud/k8s-csi-s3/pkg/s3/s3test"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var clients = map[string]func(cfg *Config) (Client, error){
+	ClientAws: func(cfg *Config) (Client, error) {
+		return NewClientAws(cfg)
+	},
+	ClientMinio: func(cfg *Config) (Client, error) {
+		return NewClientMinio(cfg)
+	},
+}
+
+var _ = Describe("NewClientFromSecret", func() {
+	ctx := context.Background()
+
+	secret := map[string]string{
+		"accessKeyID":     "access",
+		"secretAccessKey": "secret",
+		"endpoint":        "http://127.0.0.1:9000",
+	}
+
+	It("uses the minio client for static keys by default", func() {
+		client, err := NewClientFromSecret(ctx, secret)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(client.(*retryClient).Client).To(BeAssignableToTypeOf(&s3ClientMinio{}))
+	})
+
+	It("uses the client selected in the secret", func() {
+		withClient := map[string]string{"client": ClientAws}
+		for k, v := range secret {
+			withClient[k] = v
+		}
+		client, err := NewClientFromSecret(ctx, withClient)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(client.(*retryClient).Client).To(BeAssignableToTypeOf(&s3ClientAws{}))
+	})
+
+	It("rejects unknown clients", func() {
+		_, err := NewClientFromSecret(ctx, map[string]string{"client": "boto"})
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("Client conformance", func() {
+	ctx := context.Background()
+
+	for name, newClient := range clients {
+		name, newClient := name, newClient
+
+		Context(name, func() {
+			var (
+				fake   *s3test.Server
+				client Client
+			)
+
+			BeforeEach(func() {
+				fake = s3test.NewServer()
+				// make every removal span several listing pages
+				fake.PageSize = 3
+				var err error
+				client, err = newClient(fakeConfig(fake))
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			AfterEach(func() {
+				fake.Close()
+			})
+
+			fillPrefix := func(bucket, prefix string, n int) {
+				for i := 0; i < n; i++ {
+					fake.PutObject(bucket, fmt.Sprintf("%s/file%d", prefix, i))
+				}
+			}
+
+			It("reports missing buckets without an error", func() {
+				status, err := client.GetBucketStatus(ctx, "missing")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(status).To(Equal(BucketNotFound))
+			})
+
+			It("reports forbidden buckets as inaccessible", func() {
+				fake.CreateBucket("bucket", false)
+				fake.Buckets["bucket"].Forbidden = true
+				status, err := client.GetBucketStatus(ctx, "bucket")
+				Expect(err).To(HaveOccurred())
+				Expect(status).To(Equal(BucketInaccessible))
+			})
+
+			It("reports buckets behind an unreachable endpoint as inaccessible", func() {
+				fake.Close()
+				status, err := client.GetBucketStatus(ctx, "bucket")
+				Expect(err).To(HaveOccurred())
+				Expect(status).To(Equal(BucketInaccessible))
+			})
+
+			It("creates buckets idempotently", func() {
+				Expect(client.CreateBucket(ctx, "bucket")).To(Succeed())
+				Expect(client.GetBucketStatus(ctx, "bucket")).To(Equal(BucketFound))
+				Expect(client.CreateBucket(ctx, "bucket")).To(Succeed())
+			})
+
+			It("creates a directory object for the prefix", func() {
+				fake.CreateBucket("bucket", false)
+				Expect(client.CreatePrefix(ctx, "bucket", "pvc")).To(Succeed())
+				Expect(fake.Keys("bucket")).To(Equal([]string{"pvc/"}))
+			})
+
+			It("removes only objects below the prefix", func() {
+				fake.CreateBucket("bucket", false)
+				fake.PutObject("bucket", "pvc/")
+				fillPrefix("bucket", "pvc", 10)
+				fillPrefix("bucket", "pvc/sub", 4)
+				fake.PutObject("bucket", "pvc-other/file")
+				fake.PutObject("bucket", "pvcfile")
+				Expect(client.RemovePrefix(ctx, "bucket", "pvc")).To(Succeed())
+				Expect(fake.Keys("bucket")).To(Equal([]string{"pvc-other/file", "pvcfile"}))
+			})
+
+			It("removes every version and delete marker below the prefix", func() {
+				fake.CreateBucket("bucket", true)
+				fillPrefix("bucket", "pvc", 5)
+				fillPrefix("bucket", "pvc", 5)
+				fake.DeleteObject("bucket", "pvc/file1")
+				fake.PutObject("bucket", "other")
+				Expect(client.RemovePrefix(ctx, "bucket", "pvc")).To(Succeed())
+				Expect(fake.Keys("bucket")).To(Equal([]string{"other"}))
+			})
+
+			It("removes non-empty versioned buckets", func() {
+				fake.CreateBucket("bucket", true)
+				fillPrefix("bucket", "pvc", 7)
+				fake.DeleteObject("bucket", "pvc/file3")
+				Expect(client.RemoveBucket(ctx, "bucket")).To(Succeed())
+				Expect(fake.HasBucket("bucket")).To(BeFalse())
+			})
+
+			It("aborts incomplete uploads below the prefix when removing it", func() {
+				fake.CreateBucket("bucket", false)
+				for i := 0; i < 5; i++ {
+					fake.CreateUpload("bucket", fmt.Sprintf("pvc/upload%d", i), time.Now())
+				}
+				fake.CreateUpload("bucket", "pvc-other/upload", time.Now())
+				Expect(client.RemovePrefix(ctx, "bucket", "pvc")).To(Succeed())
+				Expect(fake.UploadKeys("bucket")).To(Equal([]string{"pvc-other/upload"}))
+			})
+
+			It("aborts incomplete uploads when removing the bucket", func() {
+				fake.CreateBucket("bucket", false)
+				fillPrefix("bucket", "pvc", 2)
+				fake.CreateUpload("bucket", "pvc/upload", time.Now())
+				Expect(client.RemoveBucket(ctx, "bucket")).To(Succeed())
+				Expect(fake.HasBucket("bucket")).To(BeFalse())
+			})
+
+			It("aborts only uploads initiated before the given time", func() {
+				fake.CreateBucket("bucket", false)
+				for i := 0; i < 4; i++ {
+					fake.CreateUpload("bucket", fmt.Sprintf("pvc/old%d", i), time.Now().Add(-48*time.Hour))
+				}
+				fake.CreateUpload("bucket", "pvc/new", time.Now())
+				aborted, err := client.AbortMultipartUploads(ctx, "bucket", "pvc", time.Now().Add(-24*time.Hour))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(aborted).To(Equal(4))
+				Expect(fake.UploadKeys("bucket")).To(Equal([]string{"pvc/new"}))
+			})
+
+			It("removes prefixes if multipart uploads aren't implemented", func() {
+				fake.CreateBucket("bucket", false)
+				fillPrefix("bucket", "pvc", 2)
+				fake.Fault = func(r *http.Request) int {
+					if _, ok := r.URL.Query()["uploads"]; ok {
+						return http.StatusNotImplemented
+					}
+					return 0
+				}
+				Expect(client.RemovePrefix(ctx, "bucket", "pvc")).To(Succeed())
+				Expect(fake.Keys("bucket")).To(BeEmpty())
+			})
+
+			It("writes and reads the metadata of volumes", func() {
+				fake.CreateBucket("bucket", false)
+				meta := &FSMeta{BucketName: "bucket", Prefix: "pvc", Mounter: "geesefs", CapacityBytes: 1024}
+				Expect(client.SetFSMeta(ctx, meta)).To(Succeed())
+				Expect(fake.Keys("bucket")).To(Equal([]string{"pvc/.metadata.json"}))
+				Expect(client.GetFSMeta(ctx, "bucket", "pvc")).To(Equal(meta))
+				Expect(client.GetFSMeta(ctx, "bucket", "")).To(BeNil())
+				Expect(client.GetFSMeta(ctx, "missing", "")).To(BeNil())
+			})
+
+			It("lists buckets", func() {
+				fake.CreateBucket("pvc-1", false)
+				fake.CreateBucket("other", false)
+				Expect(client.ListBuckets(ctx)).To(ConsistOf("pvc-1", "other"))
+			})
+
+			It("lists the top-level prefixes which start with the prefix", func() {
+				fake.CreateBucket("bucket", false)
+				for _, prefix := range []string{"pvc-1", "pvc-2", "pvc-3", "pvc-4", "other"} {
+					fake.PutObject("bucket", prefix+"/")
+					fillPrefix("bucket", prefix, 4)
+				}
+				fake.PutObject("bucket", "pvc-file")
+				Expect(client.ListPrefixes(ctx, "bucket", "pvc-")).To(Equal([]string{"pvc-1", "pvc-2", "pvc-3", "pvc-4"}))
+			})
+
+			It("sets and removes bucket policies", func() {
+				fake.CreateBucket("bucket", false)
+				policy, err := client.GetBucketPolicy(ctx, "bucket")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(policy).To(BeEmpty())
+				doc := `{"Version":"2012-10-17","Statement":[]}`
+				Expect(client.SetBucketPolicy(ctx, "bucket", doc)).To(Succeed())
+				policy, err = client.GetBucketPolicy(ctx, "bucket")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(policy).To(MatchJSON(doc))
+				Expect(client.SetBucketPolicy(ctx, "bucket", "")).To(Succeed())
+				policy, err = client.GetBucketPolicy(ctx, "bucket")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(policy).To(BeEmpty())
+			})
+
+			It("sends unsigned requests in anonymous mode", func() {
+				fake.CreateBucket("public", false)
+				signed := 0
+				fake.Fault = func(r *http.Request) int {
+					if r.Header.Get("Authorization") != "" || r.URL.Query().Get("X-Amz-Signature") != "" {
+						signed++
+					}
+					return 0
+				}
+				anonymous, err := newClient(&Config{Endpoint: fake.URL, Anonymous: true})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(anonymous.GetBucketStatus(ctx, "public")).To(Equal(BucketFound))
+				Expect(signed).To(BeZero())
+			})
+
+			It("stops requests when the deadline expires", func() {
+				fake.CreateBucket("bucket", false)
+				fake.Fault = func(r *http.Request) int {
+					// minio-go looks up bucket locations without the context
+					if _, ok := r.URL.Query()["location"]; ok {
+						return 0
+					}
+					select {
+					case <-r.Context().Done():
+					case <-time.After(5 * time.Second):
+					}
+					return 0
+				}
+				short, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+				defer cancel()
+				start := time.Now()
+				_, err := client.GetBucketStatus(short, "bucket")
+				Expect(errors.Is(err, context.DeadlineExceeded)).To(BeTrue(), "%v", err)
+				Expect(time.Since(start)).To(BeNumerically("<", 2*time.Second))
+			})
+
+			It("stops removing objects when the context is cancelled", func() {
+				fake.CreateBucket("bucket", false)
+				fillPrefix("bucket", "pvc", 10)
+				cancelled, cancel := context.WithCancel(ctx)
+				fake.Fault = func(r *http.Request) int {
+					// cancel while listing the first page
+					if r.URL.Query().Get("prefix") != "" {
+						cancel()
+					}
+					return 0
+				}
+				Expect(client.RemovePrefix(cancelled, "bucket", "pvc")).NotTo(Succeed())
+				Expect(fake.Keys("bucket")).NotTo(BeEmpty())
+			})
+
+			It("ignores removal of missing buckets and prefixes", func() {
+				Expect(client.RemoveBucket(ctx, "missing")).To(Succeed())
+				Expect(client.RemovePrefix(ctx, "missing", "pvc")).To(Succeed())
+				fake.CreateBucket("bucket", false)
+				Expect(client.RemovePrefix(ctx, "bucket", "pvc")).To(Succeed())
+			})
+		})
+	}
+})
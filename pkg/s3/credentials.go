@@ -0,0 +1,291 @@
+package s3
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/yandex-cloud/k8s-csi-s3/pkg/errdefs"
+)
+
+const (
+	// CredentialsSecret takes the keys from the CSI secret itself
+	CredentialsSecret = "secret"
+	// CredentialsFile reads the keys from files in a directory mounted into the driver
+	CredentialsFile = "file"
+	// CredentialsEnv takes the keys from the environment of the driver
+	CredentialsEnv = "env"
+	// CredentialsVault fetches the keys from HashiCorp Vault
+	CredentialsVault = "vault"
+
+	// Directories of the file provider must be below this one
+	defaultCredentialsFilesDir = "/etc/csi-s3/credentials"
+)
+
+// CredentialsProvider supplies the S3 keys of a volume. The CSI secret
+// selects the provider with the "credentialsProvider" key and holds its
+// parameters, so that the keys themselves don't have to be stored in
+// Kubernetes secrets.
+type CredentialsProvider interface {
+	// Retrieve sets the keys in cfg using the provider parameters from secret
+	Retrieve(ctx context.Context, secret map[string]string, cfg *Config) error
+}
+
+var credentialsProviders = map[string]CredentialsProvider{
+	CredentialsSecret: secretProvider{},
+	CredentialsFile:   fileProvider{},
+	CredentialsEnv:    envProvider{},
+	CredentialsVault:  &vaultProvider{},
+}
+
+// ProviderSettings limit what secrets may ask the credentials providers for.
+// They are set by the driver, secrets only select from them.
+type ProviderSettings struct {
+	// Providers are the providers secrets may select, only "secret" if empty
+	Providers []string
+	// EnvPrefixes are the values "credentialsEnvPrefix" may have. Without
+	// prefixes only the variables without a prefix are allowed.
+	EnvPrefixes []string
+	// FilePaths are the directories below CREDENTIALS_FILES_DIR which
+	// "credentialsPath" may select
+	FilePaths []string
+	// VaultAddress is the Vault URL, VAULT_ADDR of the driver by default
+	VaultAddress string
+}
+
+var (
+	providerSettingsMu sync.RWMutex
+	providerSettings   ProviderSettings
+)
+
+// ConfigureProviders replaces the settings of the credentials providers
+func ConfigureProviders(s ProviderSettings) {
+	providerSettingsMu.Lock()
+	defer providerSettingsMu.Unlock()
+	providerSettings = s
+}
+
+func currentProviderSettings() ProviderSettings {
+	providerSettingsMu.RLock()
+	defer providerSettingsMu.RUnlock()
+	return providerSettings
+}
+
+// Validate checks that the settings only name known providers
+func (s ProviderSettings) Validate() error {
+	for _, name := range s.Providers {
+		if credentialsProviders[name] == nil {
+			return fmt.Errorf("unknown credentials provider %q", name)
+		}
+	}
+	for _, path := range s.FilePaths {
+		if filepath.Clean("/"+path) == "/" {
+			return fmt.Errorf("credentials file path %q must be a directory below the base directory", path)
+		}
+	}
+	return nil
+}
+
+// check returns an error if secret selects something the settings don't allow
+func (s ProviderSettings) check(name string, secret map[string]string) error {
+	if name != CredentialsSecret && !contains(s.Providers, name) {
+		return fmt.Errorf("credentials provider %q is not allowed by the driver", name)
+	}
+	switch name {
+	case CredentialsEnv:
+		prefix := secret["credentialsEnvPrefix"]
+		if prefix != "" && !contains(s.EnvPrefixes, prefix) {
+			return fmt.Errorf("credentialsEnvPrefix %q is not allowed by the driver", prefix)
+		}
+	case CredentialsFile:
+		path := filepath.Clean("/" + secret["credentialsPath"])
+		allowed := false
+		for _, p := range s.FilePaths {
+			allowed = allowed || filepath.Clean("/"+p) == path
+		}
+		if !allowed {
+			return fmt.Errorf("credentialsPath %q is not allowed by the driver", secret["credentialsPath"])
+		}
+	case CredentialsVault:
+		if secret["vaultAddress"] != "" {
+			return fmt.Errorf("vaultAddress is set by the driver, not in secrets")
+		}
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadConfig reads the driver configuration from CSI secrets and obtains
+// the keys from the credentials provider selected in them
+func LoadConfig(ctx context.Context, secret map[string]string) (*Config, error) {
+	name := secret["credentialsProvider"]
+	if name == "" {
+		name = CredentialsSecret
+	}
+	provider, ok := credentialsProviders[name]
+	if !ok {
+		return nil, errdefs.New(errdefs.InvalidArgument, "unknown credentials provider %q", name)
+	}
+	cfg, err := settingsFromSecret(secret)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Anonymous {
+		// public buckets don't need any keys
+		return &Config{
+			Region:           cfg.Region,
+			Endpoint:         cfg.Endpoint,
+			Endpoints:        cfg.Endpoints,
+			AddressingStyle:  cfg.AddressingStyle,
+			SignatureVersion: cfg.SignatureVersion,
+			Client:           cfg.Client,
+			Anonymous:        true,
+			Transport:        cfg.Transport,
+			Retry:            cfg.Retry,
+			Mounter:          cfg.Mounter,
+		}, nil
+	}
+	if err := currentProviderSettings().check(name, secret); err != nil {
+		return nil, errdefs.Wrap(errdefs.InvalidArgument, err)
+	}
+	if err := provider.Retrieve(ctx, secret, cfg); err != nil {
+		return nil, fmt.Errorf("failed to get credentials from %s provider: %w", name, err)
+	}
+	return cfg, nil
+}
+
+// settingsFromSecret reads and validates the settings of secret without the keys
+func settingsFromSecret(secret map[string]string) (*Config, error) {
+	cfg := configFromSecret(secret)
+	if err := cfg.Transport.Validate(); err != nil {
+		return nil, errdefs.Wrap(errdefs.InvalidArgument, err)
+	}
+	if err := checkEndpointOptions(cfg); err != nil {
+		return nil, errdefs.Wrap(errdefs.InvalidArgument, err)
+	}
+	var err error
+	if cfg.Retry, err = retryPolicyFromSecret(secret); err != nil {
+		return nil, errdefs.Wrap(errdefs.InvalidArgument, err)
+	}
+	if cfg.Delete, err = deleteOptionsFromSecret(secret); err != nil {
+		return nil, errdefs.Wrap(errdefs.InvalidArgument, err)
+	}
+	return cfg, nil
+}
+
+// ValidateSettings checks the settings of a secret, or of defaults for
+// secrets, without obtaining any keys
+func ValidateSettings(secret map[string]string) error {
+	if name := secret["credentialsProvider"]; name != "" && credentialsProviders[name] == nil {
+		return errdefs.New(errdefs.InvalidArgument, "unknown credentials provider %q", name)
+	}
+	cfg, err := settingsFromSecret(secret)
+	if err != nil {
+		return err
+	}
+	if _, err = clientConstructor(cfg); err != nil {
+		return errdefs.Wrap(errdefs.InvalidArgument, err)
+	}
+	switch cfg.ScopedCredentials {
+	case "", ScopedMinio, ScopedRgw:
+		return nil
+	}
+	return unknownScopedCredentials(cfg.ScopedCredentials)
+}
+
+// secretProvider takes the keys from the secret, or the IRSA role from
+// the environment of the driver if the secret has neither keys nor a role
+type secretProvider struct{}
+
+func (secretProvider) Retrieve(ctx context.Context, secret map[string]string, cfg *Config) error {
+	if cfg.AccessKeyID == "" && cfg.AwsRoleArn == "" {
+		cfg.AwsRoleArn = os.Getenv("AWS_ROLE_ARN")
+		if cfg.WebIdentityTokenFile == "" {
+			cfg.WebIdentityTokenFile = os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE")
+		}
+	}
+	return nil
+}
+
+// fileProvider reads the keys from the files accessKeyID, secretAccessKey and
+// optionally sessionToken in the directory "credentialsPath" which is relative
+// to CREDENTIALS_FILES_DIR and one of the allowed FilePaths. Secret volumes or
+// a secrets store CSI driver can provide these files, and updates of them are
+// picked up on the next request.
+type fileProvider struct{}
+
+func (fileProvider) Retrieve(ctx context.Context, secret map[string]string, cfg *Config) error {
+	baseDir := os.Getenv("CREDENTIALS_FILES_DIR")
+	if baseDir == "" {
+		baseDir = defaultCredentialsFilesDir
+	}
+	rel := filepath.Clean("/" + secret["credentialsPath"])
+	if rel == "/" {
+		return fmt.Errorf("credentialsPath is not set")
+	}
+	dir := filepath.Join(baseDir, rel)
+	read := func(name string, optional bool) (string, error) {
+		content, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			if optional && os.IsNotExist(err) {
+				return "", nil
+			}
+			return "", err
+		}
+		return strings.TrimSpace(string(content)), nil
+	}
+	var err error
+	keys := &Config{}
+	if keys.AccessKeyID, err = read("accessKeyID", false); err != nil {
+		return err
+	}
+	if keys.SecretAccessKey, err = read("secretAccessKey", false); err != nil {
+		return err
+	}
+	if keys.SessionToken, err = read("sessionToken", true); err != nil {
+		return err
+	}
+	setKeys(cfg, keys)
+	return nil
+}
+
+// envProvider takes the keys from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+// AWS_SESSION_TOKEN in the environment of the driver. With "credentialsEnvPrefix"
+// set to one of the allowed EnvPrefixes, e.g. "TEAM_A_", it reads
+// TEAM_A_AWS_ACCESS_KEY_ID and so on instead, so that the driver can hold keys
+// for several StorageClasses.
+type envProvider struct{}
+
+func (envProvider) Retrieve(ctx context.Context, secret map[string]string, cfg *Config) error {
+	prefix := secret["credentialsEnvPrefix"]
+	keys := &Config{
+		AccessKeyID:     os.Getenv(prefix + "AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv(prefix + "AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv(prefix + "AWS_SESSION_TOKEN"),
+	}
+	if keys.AccessKeyID == "" || keys.SecretAccessKey == "" {
+		return fmt.Errorf("%sAWS_ACCESS_KEY_ID or %sAWS_SECRET_ACCESS_KEY is not set", prefix, prefix)
+	}
+	setKeys(cfg, keys)
+	return nil
+}
+
+// setKeys replaces the keys in cfg with keys from a provider
+func setKeys(cfg *Config, keys *Config) {
+	cfg.AccessKeyID = keys.AccessKeyID
+	cfg.SecretAccessKey = keys.SecretAccessKey
+	cfg.SessionToken = keys.SessionToken
+	cfg.Expires = keys.Expires
+}
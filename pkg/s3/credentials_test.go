@@ -0,0 +1,335 @@
+package s3
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/yandex-cloud/k8s-csi-s3/pkg/errdefs"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Credentials providers", func() {
+	It("takes the keys from the secret by default", func() {
+		cfg, err := LoadConfig(context.Background(), map[string]string{
+			"accessKeyID":     "id",
+			"secretAccessKey": "secret",
+			"endpoint":        "http://s3",
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cfg.AccessKeyID).To(Equal("id"))
+		Expect(cfg.SecretAccessKey).To(Equal("secret"))
+		Expect(cfg.Endpoint).To(Equal("http://s3"))
+	})
+
+	It("drops all keys of anonymous volumes", func() {
+		cfg, err := LoadConfig(context.Background(), map[string]string{
+			"anonymous":           "true",
+			"endpoint":            "http://s3",
+			"accessKeyID":         "id",
+			"awsRoleArn":          "arn:aws:iam::123456789012:role/app",
+			"credentialsProvider": CredentialsVault,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cfg).To(Equal(&Config{Endpoint: "http://s3", Anonymous: true, Retry: DefaultRetryPolicy}))
+	})
+
+	It("rejects unknown providers", func() {
+		_, err := LoadConfig(context.Background(), map[string]string{"credentialsProvider": "keychain"})
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("only allows providers selected by the driver", func() {
+		os.Setenv("AWS_ACCESS_KEY_ID", "driver-id")
+		os.Setenv("AWS_SECRET_ACCESS_KEY", "driver-secret")
+		defer os.Unsetenv("AWS_ACCESS_KEY_ID")
+		defer os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+		_, err := LoadConfig(context.Background(), map[string]string{"credentialsProvider": CredentialsEnv})
+		Expect(errdefs.KindOf(err)).To(Equal(errdefs.InvalidArgument))
+	})
+
+	It("validates provider settings", func() {
+		Expect(ProviderSettings{Providers: []string{CredentialsVault}, FilePaths: []string{"team-a"}}.Validate()).To(Succeed())
+		Expect(ProviderSettings{Providers: []string{"keychain"}}.Validate()).NotTo(Succeed())
+		Expect(ProviderSettings{FilePaths: []string{"../"}}.Validate()).NotTo(Succeed())
+	})
+
+	It("validates settings without keys", func() {
+		Expect(ValidateSettings(map[string]string{
+			"endpoint":         "https://storage.example.com",
+			"retryMaxAttempts": "3",
+		})).To(Succeed())
+		Expect(ValidateSettings(map[string]string{"credentialsProvider": "keychain"})).NotTo(Succeed())
+		Expect(ValidateSettings(map[string]string{"client": "boto"})).NotTo(Succeed())
+		Expect(ValidateSettings(map[string]string{"retryMaxAttempts": "many"})).NotTo(Succeed())
+	})
+
+	Context("file", func() {
+		var dir string
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "csi-s3-files")
+			Expect(err).NotTo(HaveOccurred())
+			os.Setenv("CREDENTIALS_FILES_DIR", dir)
+			ConfigureProviders(ProviderSettings{Providers: []string{CredentialsFile}, FilePaths: []string{"team-a"}})
+			Expect(os.MkdirAll(filepath.Join(dir, "team-a"), 0700)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(dir, "team-a", "accessKeyID"), []byte("id\n"), 0600)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(dir, "team-a", "secretAccessKey"), []byte("secret\n"), 0600)).To(Succeed())
+		})
+
+		AfterEach(func() {
+			os.Unsetenv("CREDENTIALS_FILES_DIR")
+			ConfigureProviders(ProviderSettings{})
+			os.RemoveAll(dir)
+		})
+
+		It("reads the keys from the directory", func() {
+			cfg, err := LoadConfig(context.Background(), map[string]string{
+				"credentialsProvider": CredentialsFile,
+				"credentialsPath":     "team-a",
+				// keys in the secret are ignored
+				"accessKeyID": "other",
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cfg.AccessKeyID).To(Equal("id"))
+			Expect(cfg.SecretAccessKey).To(Equal("secret"))
+			Expect(cfg.SessionToken).To(BeEmpty())
+		})
+
+		It("doesn't leave the base directory", func() {
+			Expect(ioutil.WriteFile(filepath.Join(filepath.Dir(dir), "accessKeyID"), []byte("id"), 0600)).To(Succeed())
+			defer os.Remove(filepath.Join(filepath.Dir(dir), "accessKeyID"))
+			_, err := LoadConfig(context.Background(), map[string]string{
+				"credentialsProvider": CredentialsFile,
+				"credentialsPath":     "../",
+			})
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("only reads the allowed directories", func() {
+			Expect(os.MkdirAll(filepath.Join(dir, "team-b"), 0700)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(dir, "team-b", "accessKeyID"), []byte("id"), 0600)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(dir, "team-b", "secretAccessKey"), []byte("secret"), 0600)).To(Succeed())
+			_, err := LoadConfig(context.Background(), map[string]string{
+				"credentialsProvider": CredentialsFile,
+				"credentialsPath":     "team-b",
+			})
+			Expect(errdefs.KindOf(err)).To(Equal(errdefs.InvalidArgument))
+		})
+	})
+
+	Context("env", func() {
+		BeforeEach(func() {
+			ConfigureProviders(ProviderSettings{Providers: []string{CredentialsEnv}, EnvPrefixes: []string{"TEAM_A_", "TEAM_B_"}})
+		})
+
+		AfterEach(func() {
+			ConfigureProviders(ProviderSettings{})
+			os.Unsetenv("TEAM_A_AWS_ACCESS_KEY_ID")
+			os.Unsetenv("TEAM_A_AWS_SECRET_ACCESS_KEY")
+		})
+
+		It("reads prefixed variables", func() {
+			os.Setenv("TEAM_A_AWS_ACCESS_KEY_ID", "id")
+			os.Setenv("TEAM_A_AWS_SECRET_ACCESS_KEY", "secret")
+			cfg, err := LoadConfig(context.Background(), map[string]string{
+				"credentialsProvider":  CredentialsEnv,
+				"credentialsEnvPrefix": "TEAM_A_",
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cfg.AccessKeyID).To(Equal("id"))
+			Expect(cfg.SecretAccessKey).To(Equal("secret"))
+		})
+
+		It("fails without keys", func() {
+			_, err := LoadConfig(context.Background(), map[string]string{
+				"credentialsProvider":  CredentialsEnv,
+				"credentialsEnvPrefix": "TEAM_B_",
+			})
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("only reads the allowed prefixes", func() {
+			os.Setenv("TEAM_A_AWS_ACCESS_KEY_ID", "id")
+			os.Setenv("TEAM_A_AWS_SECRET_ACCESS_KEY", "secret")
+			_, err := LoadConfig(context.Background(), map[string]string{
+				"credentialsProvider":  CredentialsEnv,
+				"credentialsEnvPrefix": "TEAM_A",
+			})
+			Expect(errdefs.KindOf(err)).To(Equal(errdefs.InvalidArgument))
+		})
+	})
+
+	Context("vault", func() {
+		var (
+			vault     *httptest.Server
+			tokenFile string
+			provider  *vaultProvider
+			requests  []string
+			leases    int
+			revoked   chan string
+		)
+
+		reply := func(w http.ResponseWriter, status int, v interface{}) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(v)
+		}
+
+		BeforeEach(func() {
+			requests = nil
+			leases = 0
+			revoked = make(chan string, 10)
+			vault = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests = append(requests, r.Method+" "+r.URL.Path)
+				if r.URL.Path == "/v1/auth/kubernetes/login" {
+					var login map[string]string
+					json.NewDecoder(r.Body).Decode(&login)
+					if login["role"] != "csi-s3" || login["jwt"] != "sa-token" {
+						reply(w, http.StatusForbidden, map[string]interface{}{"errors": []string{"permission denied"}})
+						return
+					}
+					reply(w, http.StatusOK, map[string]interface{}{"auth": map[string]string{"client_token": "vault-token"}})
+					return
+				}
+				if r.Header.Get("X-Vault-Token") != "vault-token" {
+					reply(w, http.StatusForbidden, map[string]interface{}{"errors": []string{"permission denied"}})
+					return
+				}
+				switch r.URL.Path {
+				case "/v1/secret/data/s3":
+					reply(w, http.StatusOK, map[string]interface{}{
+						"data": map[string]interface{}{
+							"data":     map[string]string{"accessKeyID": "kv2-id", "secretAccessKey": "kv2-secret"},
+							"metadata": map[string]interface{}{"version": 3},
+						},
+					})
+				case "/v1/kv/s3":
+					reply(w, http.StatusOK, map[string]interface{}{
+						"data": map[string]string{"accessKeyID": "kv1-id", "secretAccessKey": "kv1-secret"},
+					})
+				case "/v1/aws/creds/s3":
+					leases++
+					reply(w, http.StatusOK, map[string]interface{}{
+						"lease_id":       fmt.Sprintf("aws/creds/s3/%d", leases),
+						"lease_duration": 3600,
+						"data": map[string]string{
+							"access_key": "aws-id", "secret_key": "aws-secret", "security_token": "aws-token",
+						},
+					})
+				case "/v1/sys/leases/revoke":
+					var revoke map[string]string
+					json.NewDecoder(r.Body).Decode(&revoke)
+					revoked <- revoke["lease_id"]
+					w.WriteHeader(http.StatusNoContent)
+				default:
+					reply(w, http.StatusNotFound, map[string]interface{}{"errors": []string{}})
+				}
+			}))
+			dir, err := ioutil.TempDir("", "csi-s3-vault")
+			Expect(err).NotTo(HaveOccurred())
+			tokenFile = filepath.Join(dir, "token")
+			Expect(ioutil.WriteFile(tokenFile, []byte("sa-token"), 0600)).To(Succeed())
+			provider = &vaultProvider{tokenFile: tokenFile}
+			ConfigureProviders(ProviderSettings{Providers: []string{CredentialsVault}, VaultAddress: vault.URL})
+		})
+
+		AfterEach(func() {
+			ConfigureProviders(ProviderSettings{})
+			vault.Close()
+			os.RemoveAll(filepath.Dir(tokenFile))
+		})
+
+		It("reads KV version 2 secrets after a Kubernetes login", func() {
+			cfg := &Config{}
+			Expect(provider.Retrieve(context.Background(), map[string]string{
+				"vaultPath": "secret/data/s3",
+				"vaultRole": "csi-s3",
+			}, cfg)).To(Succeed())
+			Expect(cfg.AccessKeyID).To(Equal("kv2-id"))
+			Expect(cfg.SecretAccessKey).To(Equal("kv2-secret"))
+			Expect(cfg.Expires.IsZero()).To(BeTrue())
+			Expect(requests).To(Equal([]string{"POST /v1/auth/kubernetes/login", "GET /v1/secret/data/s3"}))
+		})
+
+		It("reads KV version 1 secrets with a token", func() {
+			cfg := &Config{}
+			Expect(provider.Retrieve(context.Background(), map[string]string{
+				"vaultPath":  "kv/s3",
+				"vaultToken": "vault-token",
+			}, cfg)).To(Succeed())
+			Expect(cfg.AccessKeyID).To(Equal("kv1-id"))
+			Expect(cfg.SecretAccessKey).To(Equal("kv1-secret"))
+		})
+
+		It("gets expiring keys from the AWS secrets engine", func() {
+			cfg := &Config{}
+			Expect(provider.Retrieve(context.Background(), map[string]string{
+				"vaultPath":   "aws/creds/s3",
+				"vaultEngine": vaultEngineAWS,
+				"vaultRole":   "csi-s3",
+			}, cfg)).To(Succeed())
+			Expect(cfg.AccessKeyID).To(Equal("aws-id"))
+			Expect(cfg.SecretAccessKey).To(Equal("aws-secret"))
+			Expect(cfg.SessionToken).To(Equal("aws-token"))
+			Expect(cfg.Expires).To(BeTemporally("~", time.Now().Add(time.Hour), time.Minute))
+		})
+
+		It("reuses AWS secrets engine leases and revokes superseded ones", func() {
+			secret := map[string]string{
+				"vaultPath":   "aws/creds/s3",
+				"vaultEngine": vaultEngineAWS,
+				"vaultRole":   "csi-s3",
+			}
+			provider.revokeDelay = time.Millisecond
+			for i := 0; i < 3; i++ {
+				Expect(provider.Retrieve(context.Background(), secret, &Config{})).To(Succeed())
+			}
+			Expect(leases).To(Equal(1))
+			Consistently(revoked, 100*time.Millisecond).ShouldNot(Receive())
+
+			for _, lease := range provider.leases {
+				lease.renew = time.Now()
+			}
+			cfg := &Config{}
+			Expect(provider.Retrieve(context.Background(), secret, cfg)).To(Succeed())
+			Expect(leases).To(Equal(2))
+			Expect(cfg.Expires).To(BeTemporally("~", time.Now().Add(time.Hour), time.Minute))
+			Eventually(revoked).Should(Receive(Equal("aws/creds/s3/1")))
+		})
+
+		It("reports Vault errors", func() {
+			cfg := &Config{}
+			err := provider.Retrieve(context.Background(), map[string]string{
+				"vaultPath": "secret/data/s3",
+				"vaultRole": "other",
+			}, cfg)
+			Expect(err).To(MatchError(ContainSubstring("permission denied")))
+			err = provider.Retrieve(context.Background(), map[string]string{
+				"vaultPath":  "secret/data/missing",
+				"vaultToken": "vault-token",
+			}, cfg)
+			Expect(err).To(MatchError(ContainSubstring("404")))
+		})
+
+		It("doesn't take the address from the secret", func() {
+			_, err := LoadConfig(context.Background(), map[string]string{
+				"credentialsProvider": CredentialsVault,
+				"vaultAddress":        "https://vault.example.com",
+				"vaultPath":           "secret/data/s3",
+				"vaultRole":           "csi-s3",
+			})
+			Expect(errdefs.KindOf(err)).To(Equal(errdefs.InvalidArgument))
+			Expect(requests).To(BeEmpty())
+		})
+	})
+})
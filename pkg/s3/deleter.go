@@ -0,0 +1,191 @@
+package s3
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// DeleteOptions configure how RemovePrefix and RemoveBucket remove objects
+type DeleteOptions struct {
+	// Concurrency is the number of delete requests sent in parallel
+	Concurrency int
+	// RequestsPerSecond limits the rate of delete requests, 0 means no limit
+	RequestsPerSecond float64
+}
+
+// DefaultDeleteOptions are used for every value which isn't set in the secret
+var DefaultDeleteOptions = DeleteOptions{
+	Concurrency: 16,
+}
+
+// deleteOptionsFromSecret reads the deleteConcurrency and deleteRequestsPerSecond keys
+func deleteOptionsFromSecret(secret map[string]string) (DeleteOptions, error) {
+	opts := DefaultDeleteOptions
+	if v := secret["deleteConcurrency"]; v != "" {
+		concurrency, err := strconv.Atoi(v)
+		if err != nil || concurrency < 1 {
+			return opts, fmt.Errorf("deleteConcurrency must be a positive number, got %q", v)
+		}
+		opts.Concurrency = concurrency
+	}
+	if v := secret["deleteRequestsPerSecond"]; v != "" {
+		rate, err := strconv.ParseFloat(v, 64)
+		if err != nil || rate < 0 {
+			return opts, fmt.Errorf("deleteRequestsPerSecond must be a non-negative number, got %q", v)
+		}
+		opts.RequestsPerSecond = rate
+	}
+	return opts, nil
+}
+
+type deleteProgressKey struct{}
+
+// WithDeleteProgress returns a context which makes RemovePrefix and
+// RemoveBucket call progress with the number of objects removed so far
+// after every delete request. Calls don't overlap.
+func WithDeleteProgress(ctx context.Context, progress func(removed int)) context.Context {
+	return context.WithValue(ctx, deleteProgressKey{}, progress)
+}
+
+// objectVersion is a version of an object or a delete marker to remove
+type objectVersion struct {
+	Key       string
+	VersionID string
+}
+
+// DeleteError aggregates the failures of removing the objects of a bucket
+type DeleteError struct {
+	Bucket string
+	// Failed is the number of objects which weren't removed
+	Failed int
+	// Errs are the first errors, the first one is the cause of the DeleteError
+	Errs []error
+}
+
+// Only this many errors are kept in a DeleteError
+const maxDeleteErrors = 5
+
+func (e *DeleteError) Error() string {
+	msgs := make([]string, len(e.Errs))
+	for i, err := range e.Errs {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("failed to remove %d objects of bucket %s: %s", e.Failed, e.Bucket, strings.Join(msgs, "; "))
+}
+
+func (e *DeleteError) Unwrap() error {
+	return e.Errs[0]
+}
+
+// deleteBatchFunc removes objects of the bucket and returns the number
+// of objects which weren't removed with the first error
+type deleteBatchFunc func(ctx context.Context, bucketName string, objects []objectVersion) (int, error)
+
+// deleter removes listed objects with a bounded pool of workers
+type deleter struct {
+	bucket   string
+	opts     DeleteOptions
+	remove   deleteBatchFunc
+	progress func(removed int)
+
+	mu      sync.Mutex
+	removed int
+	err     *DeleteError
+}
+
+func newDeleter(ctx context.Context, bucket string, opts DeleteOptions, remove deleteBatchFunc) *deleter {
+	if opts.Concurrency < 1 {
+		opts.Concurrency = DefaultDeleteOptions.Concurrency
+	}
+	progress, _ := ctx.Value(deleteProgressKey{}).(func(int))
+	return &deleter{bucket: bucket, opts: opts, remove: remove, progress: progress}
+}
+
+// done records the result of a delete request
+func (d *deleter) done(objects, failed int, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.removed += objects - failed
+	if err != nil {
+		if d.err == nil {
+			d.err = &DeleteError{Bucket: d.bucket}
+		}
+		d.err.Failed += failed
+		if len(d.err.Errs) < maxDeleteErrors {
+			d.err.Errs = append(d.err.Errs, err)
+		}
+	}
+	if d.progress != nil {
+		d.progress(d.removed)
+	}
+}
+
+// run removes the batches of objects which list passes to emit. emit returns
+// false when list should stop because ctx is done. It returns the number
+// of removed objects and the error of listing or of removing objects.
+func (d *deleter) run(ctx context.Context, list func(emit func([]objectVersion) bool) error) (int, error) {
+	var limit <-chan time.Time
+	if d.opts.RequestsPerSecond > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / d.opts.RequestsPerSecond))
+		defer ticker.Stop()
+		limit = ticker.C
+	}
+
+	batches := make(chan []objectVersion)
+	var wg sync.WaitGroup
+	for i := 0; i < d.opts.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range batches {
+				if limit != nil {
+					select {
+					case <-limit:
+					case <-ctx.Done():
+					}
+				}
+				if ctx.Err() != nil {
+					continue
+				}
+				failed, err := d.remove(ctx, d.bucket, batch)
+				if err != nil {
+					glog.Errorf("Failed to remove %d objects of bucket %s: %v", failed, d.bucket, err)
+				}
+				d.done(len(batch), failed, err)
+			}
+		}()
+	}
+
+	listErr := list(func(batch []objectVersion) bool {
+		select {
+		case batches <- batch:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	})
+	close(batches)
+	wg.Wait()
+
+	// a cancelled listing may end without an error
+	if listErr == nil {
+		listErr = ctx.Err()
+	}
+	if listErr != nil {
+		glog.Errorf("Failed to list objects of bucket %s: %v", d.bucket, listErr)
+		if d.err == nil {
+			return d.removed, listErr
+		}
+		d.err.Errs = append([]error{listErr}, d.err.Errs...)
+	}
+	if d.err != nil {
+		return d.removed, d.err
+	}
+	return d.removed, nil
+}
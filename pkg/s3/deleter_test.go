@@ -0,0 +1,183 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yandex-cloud/k8s-csi-s3/pkg/s3/s3test"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Deleter", func() {
+	ctx := context.Background()
+
+	// listBatches emits n batches of size objects
+	listBatches := func(n, size int) func(emit func([]objectVersion) bool) error {
+		return func(emit func([]objectVersion) bool) error {
+			for i := 0; i < n; i++ {
+				batch := make([]objectVersion, size)
+				for j := range batch {
+					batch[j] = objectVersion{Key: fmt.Sprintf("file%d-%d", i, j)}
+				}
+				if !emit(batch) {
+					return nil
+				}
+			}
+			return nil
+		}
+	}
+
+	It("reads the options from the secret", func() {
+		opts, err := deleteOptionsFromSecret(map[string]string{"deleteConcurrency": "4", "deleteRequestsPerSecond": "2.5"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(opts).To(Equal(DeleteOptions{Concurrency: 4, RequestsPerSecond: 2.5}))
+		_, err = deleteOptionsFromSecret(map[string]string{"deleteConcurrency": "0"})
+		Expect(err).To(HaveOccurred())
+		_, err = deleteOptionsFromSecret(map[string]string{"deleteRequestsPerSecond": "fast"})
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("limits the number of parallel requests", func() {
+		var mu sync.Mutex
+		running, maxRunning := 0, 0
+		d := newDeleter(ctx, "bucket", DeleteOptions{Concurrency: 3},
+			func(ctx context.Context, bucketName string, objects []objectVersion) (int, error) {
+				mu.Lock()
+				running++
+				if running > maxRunning {
+					maxRunning = running
+				}
+				mu.Unlock()
+				time.Sleep(10 * time.Millisecond)
+				mu.Lock()
+				running--
+				mu.Unlock()
+				return 0, nil
+			})
+		removed, err := d.run(ctx, listBatches(12, 2))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(removed).To(Equal(24))
+		Expect(maxRunning).To(Equal(3))
+	})
+
+	It("limits the request rate", func() {
+		d := newDeleter(ctx, "bucket", DeleteOptions{Concurrency: 4, RequestsPerSecond: 100},
+			func(ctx context.Context, bucketName string, objects []objectVersion) (int, error) {
+				return 0, nil
+			})
+		start := time.Now()
+		_, err := d.run(ctx, listBatches(6, 1))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(time.Since(start)).To(BeNumerically(">=", 50*time.Millisecond))
+	})
+
+	It("aggregates the errors of all requests", func() {
+		d := newDeleter(ctx, "bucket", DeleteOptions{Concurrency: 8},
+			func(ctx context.Context, bucketName string, objects []objectVersion) (int, error) {
+				if strings.HasPrefix(objects[0].Key, "file1") {
+					return 1, errors.New("AccessDenied")
+				}
+				return 0, nil
+			})
+		removed, err := d.run(ctx, listBatches(20, 3))
+		var deleteErr *DeleteError
+		Expect(errors.As(err, &deleteErr)).To(BeTrue(), "%v", err)
+		// file1 and file10 to file19
+		Expect(deleteErr.Failed).To(Equal(11))
+		Expect(deleteErr.Errs).To(HaveLen(maxDeleteErrors))
+		Expect(removed).To(Equal(60 - 11))
+		Expect(errors.Unwrap(err).Error()).To(Equal("AccessDenied"))
+	})
+
+	It("reports listing errors", func() {
+		listErr := errors.New("NoSuchBucket")
+		d := newDeleter(ctx, "bucket", DeleteOptions{},
+			func(ctx context.Context, bucketName string, objects []objectVersion) (int, error) {
+				return 0, nil
+			})
+		removed, err := d.run(ctx, func(emit func([]objectVersion) bool) error {
+			emit([]objectVersion{{Key: "file"}})
+			return listErr
+		})
+		Expect(err).To(Equal(listErr))
+		Expect(removed).To(Equal(1))
+	})
+
+	It("reports the progress", func() {
+		var progress []int
+		progressCtx := WithDeleteProgress(ctx, func(removed int) {
+			progress = append(progress, removed)
+		})
+		d := newDeleter(progressCtx, "bucket", DeleteOptions{Concurrency: 4},
+			func(ctx context.Context, bucketName string, objects []objectVersion) (int, error) {
+				return 0, nil
+			})
+		_, err := d.run(progressCtx, listBatches(5, 2))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(progress).To(Equal([]int{2, 4, 6, 8, 10}))
+	})
+
+	for name, newClient := range clients {
+		name, newClient := name, newClient
+
+		Context(name, func() {
+			var fake *s3test.Server
+
+			BeforeEach(func() {
+				fake = s3test.NewServer()
+				fake.PageSize = 3
+				fake.CreateBucket("bucket", true)
+				for i := 0; i < 10; i++ {
+					fake.PutObject("bucket", fmt.Sprintf("pvc/file%d", i))
+				}
+			})
+
+			AfterEach(func() {
+				fake.Close()
+			})
+
+			It("removes objects with the configured concurrency and reports the progress", func() {
+				cfg := fakeConfig(fake)
+				cfg.Delete = DeleteOptions{Concurrency: 2}
+				client, err := newClient(cfg)
+				Expect(err).NotTo(HaveOccurred())
+				var mu sync.Mutex
+				last := 0
+				progressCtx := WithDeleteProgress(ctx, func(removed int) {
+					mu.Lock()
+					defer mu.Unlock()
+					last = removed
+				})
+				Expect(client.RemovePrefix(progressCtx, "bucket", "pvc")).To(Succeed())
+				Expect(fake.Keys("bucket")).To(BeEmpty())
+				Expect(last).To(Equal(10))
+			})
+		})
+	}
+
+	It("removes objects one by one without multi-object delete", func() {
+		fake := s3test.NewServer()
+		defer fake.Close()
+		fake.CreateBucket("bucket", false)
+		for i := 0; i < 20; i++ {
+			fake.PutObject("bucket", fmt.Sprintf("pvc/file%d", i))
+		}
+		fake.Fault = func(r *http.Request) int {
+			if _, ok := r.URL.Query()["delete"]; ok && r.Method == http.MethodPost {
+				return http.StatusNotImplemented
+			}
+			return 0
+		}
+		client, err := NewClientMinio(fakeConfig(fake))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(client.RemovePrefix(ctx, "bucket", "pvc")).To(Succeed())
+		Expect(fake.Keys("bucket")).To(BeEmpty())
+	})
+})
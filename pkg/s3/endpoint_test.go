@@ -0,0 +1,126 @@
+package s3
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	"github.com/yandex-cloud/k8s-csi-s3/pkg/s3/s3test"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Endpoint options", func() {
+	ctx := context.Background()
+
+	secret := func(extra map[string]string) map[string]string {
+		s := map[string]string{
+			"accessKeyID":     "access",
+			"secretAccessKey": "secret",
+			"endpoint":        "http://127.0.0.1:9000",
+		}
+		for k, v := range extra {
+			s[k] = v
+		}
+		return s
+	}
+
+	It("selects the client which supports them", func() {
+		client, err := NewClientFromSecret(ctx, secret(map[string]string{"signatureVersion": SignatureV2}))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(client.(*retryClient).Client).To(BeAssignableToTypeOf(&s3ClientMinio{}))
+		client, err = NewClientFromSecret(ctx, secret(map[string]string{"endpoint": "http://127.0.0.1:9000/s3/"}))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(client.(*retryClient).Client).To(BeAssignableToTypeOf(&s3ClientAws{}))
+	})
+
+	It("rejects unsupported combinations and unknown values", func() {
+		_, err := NewClientFromSecret(ctx, secret(map[string]string{"signatureVersion": SignatureV2, "client": ClientAws}))
+		Expect(err).To(HaveOccurred())
+		_, err = NewClientFromSecret(ctx, secret(map[string]string{"endpoint": "http://127.0.0.1:9000/s3", "client": ClientMinio}))
+		Expect(err).To(HaveOccurred())
+		_, err = LoadConfig(ctx, secret(map[string]string{"signatureVersion": "v3"}))
+		Expect(err).To(HaveOccurred())
+		_, err = LoadConfig(ctx, secret(map[string]string{"addressingStyle": "dns"}))
+		Expect(err).To(HaveOccurred())
+	})
+
+	Context("with a fake S3", func() {
+		var fake *s3test.Server
+
+		BeforeEach(func() {
+			fake = s3test.NewServer()
+			fake.CreateBucket("bucket", false)
+		})
+
+		AfterEach(func() {
+			fake.Close()
+		})
+
+		It("sends requests below the base path of the endpoint", func() {
+			gateway := httptest.NewServer(http.StripPrefix("/gateway/s3", fake.Config.Handler))
+			defer gateway.Close()
+			cfg := fakeConfig(fake)
+			cfg.Endpoint = gateway.URL + "/gateway/s3/"
+			client, err := NewClientAws(cfg)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(client.CreatePrefix(ctx, "bucket", "volume")).To(Succeed())
+			Expect(fake.Keys("bucket")).To(Equal([]string{"volume/"}))
+		})
+
+		It("signs with V2 using the minio client", func() {
+			var mu sync.Mutex
+			var auth []string
+			fake.Fault = func(r *http.Request) int {
+				mu.Lock()
+				defer mu.Unlock()
+				auth = append(auth, r.Header.Get("Authorization"))
+				return 0
+			}
+			cfg := fakeConfig(fake)
+			cfg.SignatureVersion = SignatureV2
+			client, err := NewClientMinio(cfg)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(client.GetBucketStatus(ctx, "bucket")).To(Equal(BucketFound))
+			Expect(auth).NotTo(BeEmpty())
+			for _, a := range auth {
+				Expect(a).To(HavePrefix("AWS access:"))
+			}
+		})
+
+		for name, newClient := range clients {
+			name, newClient := name, newClient
+
+			It("puts the bucket into the host name with virtual-hosted-style using the "+name+" client", func() {
+				// the fake doubles as a proxy, so that bucket host names don't need DNS
+				fake.VirtualHostDomain = "s3.test"
+				var mu sync.Mutex
+				var hosts []string
+				fake.Fault = func(r *http.Request) int {
+					mu.Lock()
+					defer mu.Unlock()
+					if _, ok := r.URL.Query()["location"]; !ok {
+						// minio looks the region up with a path-style request
+						hosts = append(hosts, r.Host)
+					}
+					return 0
+				}
+				cfg := fakeConfig(fake)
+				cfg.Endpoint = "http://s3.test"
+				cfg.AddressingStyle = AddressingVirtual
+				cfg.Transport.ProxyURL = fake.URL
+				client, err := newClient(cfg)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(client.CreatePrefix(ctx, "bucket", "volume")).To(Succeed())
+				Expect(fake.Keys("bucket")).To(Equal([]string{"volume/"}))
+				Expect(hosts).NotTo(BeEmpty())
+				for _, host := range hosts {
+					Expect(strings.HasPrefix(host, "bucket.s3.test")).To(BeTrue(), host)
+				}
+			})
+		}
+	})
+})
@@ -0,0 +1,76 @@
+package s3
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/aws/smithy-go"
+	"github.com/minio/minio-go/v7"
+	"github.com/yandex-cloud/k8s-csi-s3/pkg/errdefs"
+)
+
+var errorCodeKinds = map[string]errdefs.Kind{
+	"NoSuchBucket":         errdefs.NotFound,
+	"NoSuchKey":            errdefs.NotFound,
+	"NotFound":             errdefs.NotFound,
+	"NoSuchBucketPolicy":   errdefs.NotFound,
+	"NoSuchUpload":         errdefs.NotFound,
+	"AccessDenied":         errdefs.AccessDenied,
+	"AllAccessDisabled":    errdefs.AccessDenied,
+	"Forbidden":            errdefs.AccessDenied,
+	"BucketAlreadyExists":  errdefs.AlreadyExists,
+	"BucketNotEmpty":       errdefs.FailedPrecondition,
+	"OperationAborted":     errdefs.Conflict,
+	"InvalidBucketName":    errdefs.InvalidArgument,
+	"SlowDown":             errdefs.Throttled,
+	"Throttling":           errdefs.Throttled,
+	"ThrottlingException":  errdefs.Throttled,
+	"RequestLimitExceeded": errdefs.Throttled,
+	"TooManyRequests":      errdefs.Throttled,
+}
+
+// s3ErrorCode returns the S3 error code and the HTTP status of an error of either client
+func s3ErrorCode(err error) (string, int) {
+	var apiErr smithy.APIError
+	var respErr interface{ HTTPStatusCode() int }
+	var minioErr minio.ErrorResponse
+	code, status := "", 0
+	if errors.As(err, &apiErr) {
+		code = apiErr.ErrorCode()
+	}
+	if errors.As(err, &respErr) {
+		status = respErr.HTTPStatusCode()
+	}
+	if errors.As(err, &minioErr) {
+		code, status = minioErr.Code, minioErr.StatusCode
+	}
+	return code, status
+}
+
+// ClassifyError returns err as an errdefs.Error of the kind of the S3 error,
+// or err itself if it already has a kind or isn't known
+func ClassifyError(err error) error {
+	if err == nil || errdefs.KindOf(err) != errdefs.Unknown {
+		return err
+	}
+	code, status := s3ErrorCode(err)
+	if kind, ok := errorCodeKinds[code]; ok {
+		return errdefs.Wrap(kind, err)
+	}
+	if credentialsErrorCodes[code] {
+		return errdefs.Wrap(errdefs.AccessDenied, err)
+	}
+	switch {
+	case status == http.StatusNotFound:
+		return errdefs.Wrap(errdefs.NotFound, err)
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return errdefs.Wrap(errdefs.AccessDenied, err)
+	case status == http.StatusConflict:
+		return errdefs.Wrap(errdefs.Conflict, err)
+	case status == http.StatusTooManyRequests:
+		return errdefs.Wrap(errdefs.Throttled, err)
+	case isEndpointFailure(err) || IsRetryable(err):
+		return errdefs.Wrap(errdefs.Unavailable, err)
+	}
+	return err
+}
@@ -0,0 +1,91 @@
+package s3
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/yandex-cloud/k8s-csi-s3/pkg/errdefs"
+
+	"github.com/yandex-cloud/k8s-csi-s3/pkg/s3/s3test"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Error classification", func() {
+	ctx := context.Background()
+
+	for name, newClient := range clients {
+		name, newClient := name, newClient
+
+		Context(name, func() {
+			var (
+				fake   *s3test.Server
+				client Client
+			)
+
+			BeforeEach(func() {
+				fake = s3test.NewServer()
+				var err error
+				client, err = newClient(fakeConfig(fake))
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			AfterEach(func() {
+				fake.Close()
+			})
+
+			It("classifies S3 errors", func() {
+				err := client.CreatePrefix(ctx, "missing", "pvc")
+				Expect(errdefs.KindOf(ClassifyError(err))).To(Equal(errdefs.NotFound), "%v", err)
+
+				fake.CreateBucket("bucket", false)
+				fake.Buckets["bucket"].Forbidden = true
+				err = client.CreatePrefix(ctx, "bucket", "pvc")
+				Expect(errdefs.KindOf(ClassifyError(err))).To(Equal(errdefs.AccessDenied), "%v", err)
+				// errors wrapped by the driver keep their kind
+				err = ClassifyError(fmt.Errorf("failed to get policy of bucket: %w", err))
+				Expect(errdefs.KindOf(err)).To(Equal(errdefs.AccessDenied), "%v", err)
+
+				fake.Buckets["bucket"].Forbidden = false
+				fake.Fault = func(r *http.Request) int {
+					if _, ok := r.URL.Query()["location"]; ok {
+						return 0
+					}
+					return http.StatusServiceUnavailable
+				}
+				err = client.CreatePrefix(ctx, "bucket", "pvc")
+				Expect(errdefs.KindOf(ClassifyError(err))).To(Equal(errdefs.Throttled), "%v", err)
+				fake.FaultCode = "ServiceUnavailable"
+				err = client.CreatePrefix(ctx, "bucket", "pvc")
+				Expect(errdefs.KindOf(ClassifyError(err))).To(Equal(errdefs.Unavailable), "%v", err)
+			})
+
+			It("classifies bucket names of other accounts apart from concurrent operations", func() {
+				fake.Fault = func(r *http.Request) int {
+					return http.StatusConflict
+				}
+				fake.FaultCode = "BucketAlreadyExists"
+				err := client.CreateBucket(ctx, "taken")
+				Expect(errdefs.KindOf(ClassifyError(err))).To(Equal(errdefs.AlreadyExists), "%v", err)
+				fake.FaultCode = "OperationAborted"
+				err = client.CreateBucket(ctx, "taken")
+				Expect(errdefs.KindOf(ClassifyError(err))).To(Equal(errdefs.Conflict), "%v", err)
+			})
+
+			It("classifies unreachable endpoints as unavailable", func() {
+				fake.Close()
+				_, err := client.GetBucketStatus(ctx, "bucket")
+				Expect(errdefs.KindOf(ClassifyError(err))).To(Equal(errdefs.Unavailable), "%v", err)
+			})
+		})
+	}
+
+	It("classifies invalid configurations", func() {
+		_, err := LoadConfig(ctx, map[string]string{"retryMaxAttempts": "0"})
+		Expect(errdefs.KindOf(err)).To(Equal(errdefs.InvalidArgument))
+		_, err = LoadConfig(ctx, map[string]string{"credentialsProvider": "keychain"})
+		Expect(errdefs.KindOf(err)).To(Equal(errdefs.InvalidArgument))
+	})
+})
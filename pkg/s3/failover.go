@@ -0,0 +1,294 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/minio/minio-go/v7"
+)
+
+const (
+	// Health of an endpoint is checked again after this interval
+	endpointCheckInterval = 10 * time.Second
+	endpointCheckTimeout  = 5 * time.Second
+)
+
+var (
+	endpointsMu    sync.Mutex
+	endpointStates = make(map[string]*endpointState)
+)
+
+type endpointState struct {
+	healthy bool
+	checked time.Time
+}
+
+// endpointIsHealthy returns the last known health of the endpoint
+// and checks it again if it's older than endpointCheckInterval
+func endpointIsHealthy(ctx context.Context, cfg *Config, endpoint string) bool {
+	endpointsMu.Lock()
+	state, ok := endpointStates[endpoint]
+	endpointsMu.Unlock()
+	if ok && time.Since(state.checked) < endpointCheckInterval {
+		return state.healthy
+	}
+	healthy := checkEndpoint(ctx, cfg, endpoint)
+	setEndpointHealth(endpoint, healthy)
+	return healthy
+}
+
+func setEndpointHealth(endpoint string, healthy bool) {
+	endpointsMu.Lock()
+	defer endpointsMu.Unlock()
+	if state, ok := endpointStates[endpoint]; ok && state.healthy != healthy {
+		glog.Warningf("S3 endpoint %s is healthy: %v", endpoint, healthy)
+	}
+	endpointStates[endpoint] = &endpointState{healthy: healthy, checked: time.Now()}
+	value := int64(0)
+	if healthy {
+		value = 1
+	}
+	endpointHealth.Set(endpoint, intVar(value))
+}
+
+// checkEndpoint sends an unsigned request to the endpoint. Any response
+// but a gateway error means that the endpoint is up, even AccessDenied.
+func checkEndpoint(ctx context.Context, cfg *Config, endpoint string) bool {
+	client, err := httpClient(cfg)
+	if err != nil {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(ctx, endpointCheckTimeout)
+	defer cancel()
+	req, err := http.NewRequest(http.MethodHead, endpoint, nil)
+	if err != nil {
+		return false
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		glog.V(4).Infof("Health check of S3 endpoint %s failed: %v", endpoint, err)
+		return false
+	}
+	resp.Body.Close()
+	return !isUnavailableStatus(resp.StatusCode)
+}
+
+// HealthyEndpoint returns a copy of cfg with the first healthy one of
+// cfg.Endpoints as the endpoint. If none is healthy cfg is returned as is.
+func HealthyEndpoint(ctx context.Context, cfg *Config) *Config {
+	if len(cfg.Endpoints) < 2 {
+		return cfg
+	}
+	for _, endpoint := range cfg.Endpoints {
+		if endpointIsHealthy(ctx, cfg, endpoint) {
+			healthy := *cfg
+			healthy.Endpoint = endpoint
+			return &healthy
+		}
+	}
+	glog.Warningf("None of the S3 endpoints %v is healthy", cfg.Endpoints)
+	return cfg
+}
+
+// isEndpointFailure returns true if the error means that the endpoint is
+// down or can't reach the backend, so that another endpoint may succeed
+func isEndpointFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	status := minio.ToErrorResponse(err).StatusCode
+	var respErr interface{ HTTPStatusCode() int }
+	if errors.As(err, &respErr) {
+		status = respErr.HTTPStatusCode()
+	}
+	return isUnavailableStatus(status)
+}
+
+func isUnavailableStatus(status int) bool {
+	switch status {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// failoverClient sends requests to the first healthy one of several
+// endpoints of the same S3 cluster and fails over to the next healthy one
+// when an endpoint fails
+type failoverClient struct {
+	config    *Config
+	newClient func(cfg *Config) (Client, error)
+
+	mu      sync.Mutex
+	current string
+	clients map[string]Client
+}
+
+func newFailoverClient(ctx context.Context, cfg *Config, newClient func(cfg *Config) (Client, error)) (*failoverClient, error) {
+	client := &failoverClient{
+		config:    cfg,
+		newClient: newClient,
+		current:   HealthyEndpoint(ctx, cfg).Endpoint,
+		clients:   make(map[string]Client),
+	}
+	// report configuration errors right away
+	if _, err := client.endpointClient(client.current); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+func (client *failoverClient) endpointClient(endpoint string) (Client, error) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if c, ok := client.clients[endpoint]; ok {
+		return c, nil
+	}
+	cfg := *client.config
+	cfg.Endpoint = endpoint
+	c, err := client.newClient(&cfg)
+	if err != nil {
+		return nil, err
+	}
+	client.clients[endpoint] = c
+	return c, nil
+}
+
+// do runs op with the current endpoint and the other healthy ones after it
+// until it doesn't fail because of the endpoint
+func (client *failoverClient) do(ctx context.Context, op func(c Client) error) error {
+	client.mu.Lock()
+	current := client.current
+	client.mu.Unlock()
+	start := 0
+	for i, endpoint := range client.config.Endpoints {
+		if endpoint == current {
+			start = i
+		}
+	}
+	var err error
+	for i := range client.config.Endpoints {
+		endpoint := client.config.Endpoints[(start+i)%len(client.config.Endpoints)]
+		if i > 0 && !endpointIsHealthy(ctx, client.config, endpoint) {
+			continue
+		}
+		c, cerr := client.endpointClient(endpoint)
+		if cerr != nil {
+			return cerr
+		}
+		// a cancelled request says nothing about the endpoint
+		if err = op(c); !isEndpointFailure(err) || ctx.Err() != nil {
+			client.mu.Lock()
+			client.current = endpoint
+			client.mu.Unlock()
+			return err
+		}
+		glog.Warningf("S3 endpoint %s failed: %v", endpoint, err)
+		setEndpointHealth(endpoint, false)
+	}
+	return err
+}
+
+// Config returns the configuration with the current endpoint
+func (client *failoverClient) Config() *Config {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	cfg := *client.config
+	cfg.Endpoint = client.current
+	return &cfg
+}
+
+func (client *failoverClient) GetBucketStatus(ctx context.Context, bucketName string) (status BucketStatus, err error) {
+	err = client.do(ctx, func(c Client) error {
+		status, err = c.GetBucketStatus(ctx, bucketName)
+		return err
+	})
+	return status, err
+}
+
+func (client *failoverClient) CreateBucket(ctx context.Context, bucketName string) error {
+	return client.do(ctx, func(c Client) error {
+		return c.CreateBucket(ctx, bucketName)
+	})
+}
+
+func (client *failoverClient) SetFSMeta(ctx context.Context, meta *FSMeta) error {
+	return client.do(ctx, func(c Client) error {
+		return c.SetFSMeta(ctx, meta)
+	})
+}
+
+func (client *failoverClient) GetFSMeta(ctx context.Context, bucketName string, prefix string) (meta *FSMeta, err error) {
+	err = client.do(ctx, func(c Client) error {
+		meta, err = c.GetFSMeta(ctx, bucketName, prefix)
+		return err
+	})
+	return meta, err
+}
+
+func (client *failoverClient) CreatePrefix(ctx context.Context, bucketName string, prefix string) error {
+	return client.do(ctx, func(c Client) error {
+		return c.CreatePrefix(ctx, bucketName, prefix)
+	})
+}
+
+func (client *failoverClient) RemovePrefix(ctx context.Context, bucketName string, prefix string) error {
+	return client.do(ctx, func(c Client) error {
+		return c.RemovePrefix(ctx, bucketName, prefix)
+	})
+}
+
+func (client *failoverClient) RemoveBucket(ctx context.Context, bucketName string) error {
+	return client.do(ctx, func(c Client) error {
+		return c.RemoveBucket(ctx, bucketName)
+	})
+}
+
+func (client *failoverClient) AbortMultipartUploads(ctx context.Context, bucketName string, prefix string, initiatedBefore time.Time) (aborted int, err error) {
+	err = client.do(ctx, func(c Client) error {
+		var n int
+		n, err = c.AbortMultipartUploads(ctx, bucketName, prefix, initiatedBefore)
+		aborted += n
+		return err
+	})
+	return aborted, err
+}
+
+func (client *failoverClient) ListBuckets(ctx context.Context) (names []string, err error) {
+	err = client.do(ctx, func(c Client) error {
+		names, err = c.ListBuckets(ctx)
+		return err
+	})
+	return names, err
+}
+
+func (client *failoverClient) ListPrefixes(ctx context.Context, bucketName string, prefix string) (prefixes []string, err error) {
+	err = client.do(ctx, func(c Client) error {
+		prefixes, err = c.ListPrefixes(ctx, bucketName, prefix)
+		return err
+	})
+	return prefixes, err
+}
+
+func (client *failoverClient) GetBucketPolicy(ctx context.Context, bucketName string) (policy string, err error) {
+	err = client.do(ctx, func(c Client) error {
+		policy, err = c.GetBucketPolicy(ctx, bucketName)
+		return err
+	})
+	return policy, err
+}
+
+func (client *failoverClient) SetBucketPolicy(ctx context.Context, bucketName string, policy string) error {
+	return client.do(ctx, func(c Client) error {
+		return c.SetBucketPolicy(ctx, bucketName, policy)
+	})
+}
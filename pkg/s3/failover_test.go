@@ -0,0 +1,92 @@
+package s3
+
+import (
+	"context"
+	"expvar"
+	"net/http"
+
+	"github.com/yandex-cloud/k8s-csi-s3/pkg/s3/s3test"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func resetEndpointStates() {
+	endpointsMu.Lock()
+	defer endpointsMu.Unlock()
+	endpointStates = make(map[string]*endpointState)
+}
+
+var _ = Describe("Endpoint failover", func() {
+	var (
+		ctx      = context.Background()
+		down, up *s3test.Server
+		secret   map[string]string
+	)
+
+	BeforeEach(func() {
+		resetEndpointStates()
+		down = s3test.NewServer()
+		up = s3test.NewServer()
+		up.CreateBucket("bucket", false)
+		secret = map[string]string{
+			"accessKeyID":     "access",
+			"secretAccessKey": "secret",
+			"endpoints":       down.URL + ", " + up.URL,
+			"client":          ClientAws,
+		}
+	})
+
+	AfterEach(func() {
+		down.Close()
+		up.Close()
+	})
+
+	It("reads the endpoint list", func() {
+		cfg, err := LoadConfig(ctx, secret)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cfg.Endpoints).To(Equal([]string{down.URL, up.URL}))
+		Expect(cfg.Endpoint).To(Equal(down.URL))
+	})
+
+	It("uses the first healthy endpoint", func() {
+		down.Close()
+		client, err := NewClientFromSecret(ctx, secret)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(client.Config().Endpoint).To(Equal(up.URL))
+		Expect(client.GetBucketStatus(ctx, "bucket")).To(Equal(BucketFound))
+		Expect(expvar.Get("csi_s3_endpoint_healthy").(*expvar.Map).Get(down.URL).String()).To(Equal("0"))
+		Expect(expvar.Get("csi_s3_endpoint_healthy").(*expvar.Map).Get(up.URL).String()).To(Equal("1"))
+
+		cfg, err := LoadConfig(ctx, secret)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(HealthyEndpoint(ctx, cfg).Endpoint).To(Equal(up.URL))
+	})
+
+	It("fails over when the current endpoint fails", func() {
+		client, err := NewClientFromSecret(ctx, secret)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(client.Config().Endpoint).To(Equal(down.URL))
+		down.Fault = func(r *http.Request) int {
+			return http.StatusServiceUnavailable
+		}
+		Expect(client.CreatePrefix(ctx, "bucket", "volume")).To(Succeed())
+		Expect(up.Keys("bucket")).To(Equal([]string{"volume/"}))
+		Expect(client.Config().Endpoint).To(Equal(up.URL))
+	})
+
+	It("doesn't fail over on S3 errors", func() {
+		client, err := NewClientFromSecret(ctx, secret)
+		Expect(err).NotTo(HaveOccurred())
+		// the bucket only exists behind the second endpoint
+		Expect(client.CreatePrefix(ctx, "bucket", "volume")).NotTo(Succeed())
+		Expect(client.Config().Endpoint).To(Equal(down.URL))
+	})
+
+	It("tracks endpoints of volumes", func() {
+		SetVolumeEndpoint("bucket/volume", up.URL)
+		Expect(volumeEndpoints.Get("bucket/volume").String()).To(Equal(`"` + up.URL + `"`))
+		ForgetVolumeEndpoint("bucket/volume")
+		Expect(volumeEndpoints.Get("bucket/volume")).To(BeNil())
+	})
+})
@@ -0,0 +1,14 @@
+package s3
+
+import (
+	"github.com/yandex-cloud/k8s-csi-s3/pkg/s3/s3test"
+)
+
+// fakeConfig returns the configuration of a client of the fake server
+func fakeConfig(fake *s3test.Server) *Config {
+	return &Config{
+		AccessKeyID:     "access",
+		SecretAccessKey: "secret",
+		Endpoint:        fake.URL,
+	}
+}
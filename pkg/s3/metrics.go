@@ -0,0 +1,86 @@
+package s3
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Metrics are published with expvar at /debug/vars of the metrics listener,
+// and in the Prometheus text format by MetricsHandler
+var (
+	// endpointHealth is 1 for healthy and 0 for failed endpoints
+	endpointHealth = expvar.NewMap("csi_s3_endpoint_healthy")
+	// volumeEndpoints holds the endpoint used by every volume
+	volumeEndpoints = expvar.NewMap("csi_s3_volume_endpoint")
+	// capabilitiesMetric holds 1 or 0 for every probed feature of every endpoint
+	capabilitiesMetric = expvar.NewMap("csi_s3_endpoint_capabilities")
+)
+
+func intVar(value int64) *expvar.Int {
+	v := &expvar.Int{}
+	v.Set(value)
+	return v
+}
+
+// SetVolumeEndpoint records the endpoint used by the volume
+func SetVolumeEndpoint(volumeID, endpoint string) {
+	v := &expvar.String{}
+	v.Set(endpoint)
+	volumeEndpoints.Set(volumeID, v)
+}
+
+// ForgetVolumeEndpoint removes the volume from the metrics
+func ForgetVolumeEndpoint(volumeID string) {
+	volumeEndpoints.Delete(volumeID)
+}
+
+// MetricsHandler serves the metrics in the Prometheus text format
+func MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writeMetrics(w)
+	})
+}
+
+func writeMetrics(w io.Writer) {
+	var lines []string
+	endpointHealth.Do(func(kv expvar.KeyValue) {
+		lines = append(lines, fmt.Sprintf("csi_s3_endpoint_healthy{endpoint=%s} %s",
+			labelValue(kv.Key), kv.Value))
+	})
+	writeGauge(w, "csi_s3_endpoint_healthy", "Whether the S3 endpoint is healthy (1) or failed (0).", lines)
+
+	lines = nil
+	volumeEndpoints.Do(func(kv expvar.KeyValue) {
+		lines = append(lines, fmt.Sprintf("csi_s3_volume_endpoint{volume=%s,endpoint=%s} 1",
+			labelValue(kv.Key), labelValue(kv.Value.(*expvar.String).Value())))
+	})
+	writeGauge(w, "csi_s3_volume_endpoint", "The S3 endpoint used by the volume.", lines)
+
+	lines = nil
+	capabilitiesMetric.Do(func(endpoint expvar.KeyValue) {
+		endpoint.Value.(*expvar.Map).Do(func(feature expvar.KeyValue) {
+			lines = append(lines, fmt.Sprintf("csi_s3_endpoint_capabilities{endpoint=%s,feature=%s} %s",
+				labelValue(endpoint.Key), labelValue(feature.Key), feature.Value))
+		})
+	})
+	writeGauge(w, "csi_s3_endpoint_capabilities", "Whether the S3 endpoint supports the feature (1) or not (0).", lines)
+}
+
+func writeGauge(w io.Writer, name, help string, lines []string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	sort.Strings(lines)
+	for _, line := range lines {
+		fmt.Fprintln(w, line)
+	}
+}
+
+// labelValue quotes a label value of the Prometheus text format
+func labelValue(s string) string {
+	s = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+	return `"` + s + `"`
+}
@@ -0,0 +1,41 @@
+package s3
+
+import (
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Metrics", func() {
+	AfterEach(func() {
+		endpointHealth.Delete("https://metrics.example")
+		ForgetVolumeEndpoint("bucket/metrics")
+		capabilitiesMetric.Delete("https://metrics.example")
+	})
+
+	It("serves the metrics in the Prometheus text format", func() {
+		endpointHealth.Set("https://metrics.example", intVar(1))
+		SetVolumeEndpoint("bucket/metrics", `https://metrics.example/"quoted"`)
+		setCapabilities("https://metrics.example", Capabilities{Tagging: true})
+		defer func() {
+			capabilitiesMu.Lock()
+			delete(endpointCapabilities, "https://metrics.example")
+			capabilitiesMu.Unlock()
+		}()
+
+		rec := httptest.NewRecorder()
+		MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+		Expect(rec.Header().Get("Content-Type")).To(HavePrefix("text/plain; version=0.0.4"))
+		lines := strings.Split(rec.Body.String(), "\n")
+		Expect(lines).To(ContainElement("# TYPE csi_s3_endpoint_healthy gauge"))
+		Expect(lines).To(ContainElement(`csi_s3_endpoint_healthy{endpoint="https://metrics.example"} 1`))
+		Expect(lines).To(ContainElement(
+			`csi_s3_volume_endpoint{volume="bucket/metrics",endpoint="https://metrics.example/\"quoted\""} 1`))
+		Expect(lines).To(ContainElement(
+			`csi_s3_endpoint_capabilities{endpoint="https://metrics.example",feature="tagging"} 1`))
+		Expect(lines).To(ContainElement(
+			`csi_s3_endpoint_capabilities{endpoint="https://metrics.example",feature="objectLock"} 0`))
+	})
+})
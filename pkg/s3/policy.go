@@ -0,0 +1,362 @@
+package s3
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const policyVersion = "2012-10-17"
+
+// policyDocument is an S3 bucket or IAM policy. Statements are kept as raw
+// JSON so that statements which aren't managed by the driver stay as they are.
+type policyDocument struct {
+	Version   string            `json:"Version"`
+	ID        string            `json:"Id,omitempty"`
+	Statement []json.RawMessage `json:"Statement"`
+}
+
+type policyStatement struct {
+	Sid       string                           `json:"Sid,omitempty"`
+	Effect    string                           `json:"Effect"`
+	Principal map[string]stringList            `json:"Principal,omitempty"`
+	Action    stringList                       `json:"Action"`
+	Resource  stringList                       `json:"Resource"`
+	Condition map[string]map[string]stringList `json:"Condition,omitempty"`
+}
+
+// stringList is a policy value which may also be a single string
+type stringList []string
+
+func (l *stringList) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*l = stringList{s}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(l))
+}
+
+// volumeSid returns the prefix of Sids of all policy statements of the volume.
+// Sids may only contain letters and digits.
+func volumeSid(bucketName, prefix string) string {
+	h := sha1.Sum([]byte(bucketName + "/" + prefix))
+	return "CsiS3" + hex.EncodeToString(h[:])
+}
+
+// volumePolicyStatements allows principal (any principal if nil, as in
+// session policies) to work with objects of the volume. Listing the bucket
+// is allowed without restrictions because mounters list and probe keys
+// outside of the prefix, so object names of other volumes stay visible.
+func volumePolicyStatements(bucketName, prefix string, principal []string) []policyStatement {
+	objects := "arn:aws:s3:::" + bucketName + "/*"
+	if prefix != "" {
+		objects = "arn:aws:s3:::" + bucketName + "/" + objectPrefix(prefix) + "*"
+	}
+	sid := volumeSid(bucketName, prefix)
+	statements := []policyStatement{
+		{
+			Sid:      sid + "Bucket",
+			Effect:   "Allow",
+			Action:   []string{"s3:GetBucketLocation", "s3:ListBucket", "s3:ListBucketMultipartUploads"},
+			Resource: []string{"arn:aws:s3:::" + bucketName},
+		},
+		{
+			Sid:    sid + "Objects",
+			Effect: "Allow",
+			Action: []string{
+				"s3:GetObject", "s3:PutObject", "s3:DeleteObject",
+				"s3:AbortMultipartUpload", "s3:ListMultipartUploadParts",
+			},
+			Resource: []string{objects},
+		},
+	}
+	if principal != nil {
+		for i := range statements {
+			statements[i].Principal = map[string]stringList{"AWS": principal}
+		}
+	}
+	return statements
+}
+
+func marshalPolicy(statements []policyStatement) (string, error) {
+	doc := policyDocument{Version: policyVersion}
+	for _, st := range statements {
+		raw, err := json.Marshal(&st)
+		if err != nil {
+			return "", err
+		}
+		doc.Statement = append(doc.Statement, raw)
+	}
+	policy, err := json.Marshal(&doc)
+	return string(policy), err
+}
+
+// replacePolicyStatements removes statements with Sids starting with sid from
+// the policy and adds statements. It returns an empty policy if no statements are left.
+func replacePolicyStatements(policy, sid string, statements []policyStatement) (string, error) {
+	doc := policyDocument{Version: policyVersion}
+	if policy != "" {
+		if err := json.Unmarshal([]byte(policy), &doc); err != nil {
+			return "", fmt.Errorf("failed to parse policy: %v", err)
+		}
+	}
+	var kept []json.RawMessage
+	for _, raw := range doc.Statement {
+		var st struct{ Sid string }
+		if err := json.Unmarshal(raw, &st); err != nil {
+			return "", fmt.Errorf("failed to parse policy statement: %v", err)
+		}
+		if !strings.HasPrefix(st.Sid, sid) {
+			kept = append(kept, raw)
+		}
+	}
+	for _, st := range statements {
+		raw, err := json.Marshal(&st)
+		if err != nil {
+			return "", err
+		}
+		kept = append(kept, raw)
+	}
+	if len(kept) == 0 {
+		return "", nil
+	}
+	doc.Statement = kept
+	result, err := json.Marshal(&doc)
+	return string(result), err
+}
+
+var (
+	// S3 has no conditional writes of bucket policies, so updates are
+	// verified by reading the policy again and retried with this delay
+	policyRetryDelay    = time.Second
+	policyUpdateRetries = 5
+
+	bucketPolicyMu    sync.Mutex
+	bucketPolicyLocks = make(map[string]*sync.Mutex)
+)
+
+func bucketPolicyLock(bucketName string) *sync.Mutex {
+	bucketPolicyMu.Lock()
+	defer bucketPolicyMu.Unlock()
+	lock, ok := bucketPolicyLocks[bucketName]
+	if !ok {
+		lock = &sync.Mutex{}
+		bucketPolicyLocks[bucketName] = lock
+	}
+	return lock
+}
+
+// updateBucketPolicy replaces the statements of the volume in the bucket policy.
+// Updates of the same bucket by the driver are serialized. Other writers may
+// still change the policy between reading and writing it, so the result is
+// read back and the update is repeated until the policy has the statements.
+func updateBucketPolicy(ctx context.Context, client Client, bucketName, sid string, statements []policyStatement) error {
+	lock := bucketPolicyLock(bucketName)
+	lock.Lock()
+	defer lock.Unlock()
+
+	policy, err := client.GetBucketPolicy(ctx, bucketName)
+	if err != nil {
+		return fmt.Errorf("failed to get policy of bucket %s: %w", bucketName, err)
+	}
+	for attempt := 1; ; attempt++ {
+		done, err := hasPolicyStatements(policy, sid, statements)
+		if err != nil {
+			return fmt.Errorf("failed to parse policy of bucket %s: %v", bucketName, err)
+		}
+		if done {
+			return nil
+		}
+		if attempt > policyUpdateRetries {
+			return fmt.Errorf("policy of bucket %s keeps changing concurrently, giving up after %d attempts",
+				bucketName, policyUpdateRetries)
+		}
+		if attempt > 1 {
+			glog.Warningf("Policy of bucket %s was changed concurrently, updating it again", bucketName)
+			select {
+			case <-time.After(time.Duration(attempt-1) * policyRetryDelay):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		updated, err := replacePolicyStatements(policy, sid, statements)
+		if err != nil {
+			return fmt.Errorf("failed to update policy of bucket %s: %v", bucketName, err)
+		}
+		if err = client.SetBucketPolicy(ctx, bucketName, updated); err != nil {
+			return fmt.Errorf("failed to set policy of bucket %s: %w", bucketName, err)
+		}
+		if policy, err = client.GetBucketPolicy(ctx, bucketName); err != nil {
+			return fmt.Errorf("failed to get policy of bucket %s: %w", bucketName, err)
+		}
+	}
+}
+
+// accountRootArn matches the ARN of the root of an AWS account in any partition
+var accountRootArn = regexp.MustCompile(`^arn:[a-z-]+:iam::([0-9]{12}):root$`)
+
+// normalizedPrincipal returns the principal in a canonical form. AWS stores
+// an account ID as the ARN of the account root, so both forms are equal.
+func normalizedPrincipal(principal string) string {
+	if m := accountRootArn.FindStringSubmatch(principal); m != nil {
+		return m[1]
+	}
+	return principal
+}
+
+// normalized returns the statement in a canonical form: lists are sorted
+// without duplicates and principals are normalized, so that statements which
+// only differ in the order of values, in single values instead of lists or
+// in the form of account principals are equal
+func (st policyStatement) normalized() policyStatement {
+	sorted := func(l stringList) stringList {
+		if len(l) == 0 {
+			return nil
+		}
+		l = append(stringList{}, l...)
+		sort.Strings(l)
+		unique := l[:1]
+		for _, s := range l[1:] {
+			if s != unique[len(unique)-1] {
+				unique = append(unique, s)
+			}
+		}
+		return unique
+	}
+	sortedMap := func(m map[string]stringList) map[string]stringList {
+		if len(m) == 0 {
+			return nil
+		}
+		result := make(map[string]stringList, len(m))
+		for k, l := range m {
+			result[k] = sorted(l)
+		}
+		return result
+	}
+	if aws, ok := st.Principal["AWS"]; ok {
+		principal := make(map[string]stringList, len(st.Principal))
+		for k, l := range st.Principal {
+			principal[k] = l
+		}
+		normalized := make(stringList, len(aws))
+		for i, p := range aws {
+			normalized[i] = normalizedPrincipal(p)
+		}
+		principal["AWS"] = normalized
+		st.Principal = principal
+	}
+	st.Principal = sortedMap(st.Principal)
+	st.Action = sorted(st.Action)
+	st.Resource = sorted(st.Resource)
+	if len(st.Condition) == 0 {
+		st.Condition = nil
+	} else {
+		conditions := make(map[string]map[string]stringList, len(st.Condition))
+		for op, values := range st.Condition {
+			conditions[op] = sortedMap(values)
+		}
+		st.Condition = conditions
+	}
+	return st
+}
+
+// canonicalStatements returns the normalized statements as sorted JSON
+func canonicalStatements(statements []policyStatement) ([]string, error) {
+	result := make([]string, 0, len(statements))
+	for _, st := range statements {
+		raw, err := json.Marshal(st.normalized())
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, string(raw))
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// hasPolicyStatements checks if the statements with Sids starting with sid
+// are equal to statements. S3 implementations may return the policy with
+// values and statements reordered, with single values instead of lists, or
+// with account IDs rewritten to ARNs, so statements are compared in the
+// canonical form.
+func hasPolicyStatements(policy, sid string, statements []policyStatement) (bool, error) {
+	var current []policyStatement
+	if policy != "" {
+		var doc policyDocument
+		if err := json.Unmarshal([]byte(policy), &doc); err != nil {
+			return false, err
+		}
+		for _, raw := range doc.Statement {
+			var st policyStatement
+			if err := json.Unmarshal(raw, &st); err != nil {
+				// not a statement of the driver, e.g. with "Principal": "*"
+				continue
+			}
+			if strings.HasPrefix(st.Sid, sid) {
+				current = append(current, st)
+			}
+		}
+	}
+	if len(current) != len(statements) {
+		return false, nil
+	}
+	have, err := canonicalStatements(current)
+	if err != nil {
+		return false, err
+	}
+	want, err := canonicalStatements(statements)
+	if err != nil {
+		return false, err
+	}
+	for i := range want {
+		if have[i] != want[i] {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// GrantVolumeAccess adds bucket policy statements which allow the principals
+// of the volume to access its bucket or prefix: PolicyPrincipals of the
+// config and the RGW user of the volume with RGW scoped credentials.
+// PolicyPrincipals are the same for every volume of the secret, so they get
+// access to all of these volumes, only the RGW users are limited to their own.
+func GrantVolumeAccess(ctx context.Context, client Client, bucketName, prefix string) error {
+	principals := volumePrincipals(client.Config(), bucketName, prefix)
+	if len(principals) == 0 {
+		return nil
+	}
+	return updateBucketPolicy(ctx, client, bucketName, volumeSid(bucketName, prefix),
+		volumePolicyStatements(bucketName, prefix, principals))
+}
+
+// RevokeVolumeAccess removes the bucket policy statements of the volume
+func RevokeVolumeAccess(ctx context.Context, client Client, bucketName, prefix string) error {
+	if len(volumePrincipals(client.Config(), bucketName, prefix)) == 0 || prefix == "" {
+		// a removed bucket takes its policy with it
+		return nil
+	}
+	err := updateBucketPolicy(ctx, client, bucketName, volumeSid(bucketName, prefix), nil)
+	if isNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func volumePrincipals(cfg *Config, bucketName, prefix string) []string {
+	principals := append([]string{}, cfg.PolicyPrincipals...)
+	if cfg.ScopedCredentials == ScopedRgw {
+		principals = append(principals, rgwUserArn(rgwUserID(bucketName, prefix)))
+	}
+	return principals
+}
@@ -0,0 +1,210 @@
+package s3
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yandex-cloud/k8s-csi-s3/pkg/s3/s3test"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Bucket policy statements", func() {
+	foreign := `{"Sid":"Public","Effect":"Allow","Principal":"*","Action":"s3:GetObject","Resource":"arn:aws:s3:::bucket/public/*"}`
+
+	It("replaces only statements of the volume", func() {
+		sid := volumeSid("bucket", "pvc-1")
+		policy, err := replacePolicyStatements(`{"Version":"2012-10-17","Statement":[`+foreign+`]}`, sid,
+			volumePolicyStatements("bucket", "pvc-1", []string{"arn:aws:iam:::user/u1"}))
+		Expect(err).NotTo(HaveOccurred())
+		policy, err = replacePolicyStatements(policy, sid,
+			volumePolicyStatements("bucket", "pvc-1", []string{"arn:aws:iam:::user/u2"}))
+		Expect(err).NotTo(HaveOccurred())
+
+		var doc policyDocument
+		Expect(json.Unmarshal([]byte(policy), &doc)).To(Succeed())
+		Expect(doc.Statement).To(HaveLen(3))
+		Expect(string(doc.Statement[0])).To(MatchJSON(foreign))
+		Expect(policy).To(ContainSubstring("arn:aws:iam:::user/u2"))
+		Expect(policy).NotTo(ContainSubstring("arn:aws:iam:::user/u1"))
+		Expect(policy).To(ContainSubstring("arn:aws:s3:::bucket/pvc-1/*"))
+
+		policy, err = replacePolicyStatements(policy, sid, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(policy).To(MatchJSON(`{"Version":"2012-10-17","Statement":[` + foreign + `]}`))
+	})
+
+	It("removes the policy without statements", func() {
+		sid := volumeSid("bucket", "pvc-1")
+		policy, err := replacePolicyStatements("", sid, volumePolicyStatements("bucket", "pvc-1", nil))
+		Expect(err).NotTo(HaveOccurred())
+		policy, err = replacePolicyStatements(policy, sid, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(policy).To(BeEmpty())
+	})
+
+	It("doesn't touch statements of volumes with a longer prefix", func() {
+		Expect(volumeSid("bucket", "pvc-1")).NotTo(Equal(volumeSid("bucket", "pvc-10")))
+	})
+})
+
+var _ = Describe("Volume access", func() {
+	var (
+		fake   *s3test.Server
+		client Client
+		ctx    = context.Background()
+	)
+	role := "arn:aws:iam::123456789012:role/app"
+	foreign := `{"Version":"2012-10-17","Statement":[{"Sid":"Public","Effect":"Allow","Principal":"*",` +
+		`"Action":"s3:GetObject","Resource":"arn:aws:s3:::bucket/public/*"}]}`
+
+	BeforeEach(func() {
+		policyRetryDelay = time.Millisecond
+		fake = s3test.NewServer()
+		fake.CreateBucket("bucket", false)
+		cfg := fakeConfig(fake)
+		cfg.PolicyPrincipals = []string{role}
+		var err error
+		client, err = NewClientAws(cfg)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		fake.Close()
+		policyRetryDelay = time.Second
+	})
+
+	It("does nothing without principals", func() {
+		client, err := NewClientAws(fakeConfig(fake))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(GrantVolumeAccess(ctx, client, "bucket", "pvc")).To(Succeed())
+		Expect(RevokeVolumeAccess(ctx, client, "bucket", "pvc")).To(Succeed())
+		Expect(fake.Requests).NotTo(HaveKey(http.MethodPut))
+	})
+
+	It("limits principals to the prefix of the volume", func() {
+		Expect(GrantVolumeAccess(ctx, client, "bucket", "pvc")).To(Succeed())
+		policy := fake.Buckets["bucket"].Policy
+		ok, err := hasPolicyStatements(policy, volumeSid("bucket", "pvc"),
+			volumePolicyStatements("bucket", "pvc", []string{role}))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ok).To(BeTrue())
+
+		// nothing to do the second time
+		puts := fake.Requests[http.MethodPut]
+		Expect(GrantVolumeAccess(ctx, client, "bucket", "pvc")).To(Succeed())
+		Expect(fake.Requests[http.MethodPut]).To(Equal(puts))
+
+		Expect(RevokeVolumeAccess(ctx, client, "bucket", "pvc")).To(Succeed())
+		Expect(fake.Buckets["bucket"].Policy).To(BeEmpty())
+	})
+
+	It("accepts policies with single values instead of lists", func() {
+		statements := volumePolicyStatements("bucket", "pvc", []string{role})
+		policy, err := marshalPolicy(statements)
+		Expect(err).NotTo(HaveOccurred())
+		policy = strings.Replace(policy, `["arn:aws:s3:::bucket"]`, `"arn:aws:s3:::bucket"`, 1)
+		ok, err := hasPolicyStatements(policy, volumeSid("bucket", "pvc"), statements)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ok).To(BeTrue())
+	})
+
+	It("accepts account IDs rewritten to ARNs by the server", func() {
+		statements := volumePolicyStatements("bucket", "pvc", []string{"123456789012", role})
+		policy, err := marshalPolicy(volumePolicyStatements("bucket", "pvc",
+			[]string{role, "arn:aws:iam::123456789012:root"}))
+		Expect(err).NotTo(HaveOccurred())
+		ok, err := hasPolicyStatements(policy, volumeSid("bucket", "pvc"), statements)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ok).To(BeTrue())
+	})
+
+	It("accepts policies reordered by the server", func() {
+		// MinIO returns statements and their values in its own order, with
+		// single values instead of lists
+		reorder := func(policy string) string {
+			var doc struct {
+				Version   string
+				Statement []map[string]interface{}
+			}
+			Expect(json.Unmarshal([]byte(policy), &doc)).To(Succeed())
+			for i, j := 0, len(doc.Statement)-1; i < j; i, j = i+1, j-1 {
+				doc.Statement[i], doc.Statement[j] = doc.Statement[j], doc.Statement[i]
+			}
+			for _, st := range doc.Statement {
+				actions := st["Action"].([]interface{})
+				for i, j := 0, len(actions)-1; i < j; i, j = i+1, j-1 {
+					actions[i], actions[j] = actions[j], actions[i]
+				}
+				if resources := st["Resource"].([]interface{}); len(resources) == 1 {
+					st["Resource"] = resources[0]
+				}
+				st["Principal"] = map[string]interface{}{"AWS": role}
+			}
+			reordered, err := json.Marshal(&doc)
+			Expect(err).NotTo(HaveOccurred())
+			return string(reordered)
+		}
+		fake.Fault = func(r *http.Request) int {
+			if _, ok := r.URL.Query()["policy"]; ok && r.Method == http.MethodGet && fake.Buckets["bucket"].Policy != "" {
+				fake.Buckets["bucket"].Policy = reorder(fake.Buckets["bucket"].Policy)
+			}
+			return 0
+		}
+		Expect(GrantVolumeAccess(ctx, client, "bucket", "pvc")).To(Succeed())
+		Expect(fake.Requests[http.MethodPut]).To(Equal(1))
+		Expect(fake.Buckets["bucket"].Policy).NotTo(ContainSubstring(`"Resource":[`))
+	})
+
+	It("keeps statements of concurrent volume operations", func() {
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer GinkgoRecover()
+				defer wg.Done()
+				Expect(GrantVolumeAccess(ctx, client, "bucket", fmt.Sprintf("pvc-%d", i))).To(Succeed())
+			}(i)
+		}
+		wg.Wait()
+		var doc policyDocument
+		Expect(json.Unmarshal([]byte(fake.Buckets["bucket"].Policy), &doc)).To(Succeed())
+		Expect(doc.Statement).To(HaveLen(20))
+	})
+
+	It("updates the policy again if another writer replaced it", func() {
+		fake.Buckets["bucket"].Policy = foreign
+		overwrites := 0
+		fake.Fault = func(r *http.Request) int {
+			// replace the policy right after the driver wrote it
+			if _, ok := r.URL.Query()["policy"]; ok && r.Method == http.MethodGet && overwrites < 2 &&
+				strings.Contains(fake.Buckets["bucket"].Policy, "CsiS3") {
+				fake.Buckets["bucket"].Policy = foreign
+				overwrites++
+			}
+			return 0
+		}
+		Expect(GrantVolumeAccess(ctx, client, "bucket", "pvc")).To(Succeed())
+		Expect(overwrites).To(Equal(2))
+		policy := fake.Buckets["bucket"].Policy
+		Expect(policy).To(ContainSubstring(`"Sid":"Public"`))
+		Expect(policy).To(ContainSubstring(role))
+	})
+
+	It("gives up if the policy keeps changing", func() {
+		fake.Fault = func(r *http.Request) int {
+			if _, ok := r.URL.Query()["policy"]; ok && r.Method == http.MethodGet {
+				fake.Buckets["bucket"].Policy = foreign
+			}
+			return 0
+		}
+		Expect(GrantVolumeAccess(ctx, client, "bucket", "pvc")).NotTo(Succeed())
+		Expect(fake.Requests[http.MethodPut]).To(Equal(policyUpdateRetries))
+	})
+})
@@ -0,0 +1,251 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/aws/smithy-go"
+	"github.com/golang/glog"
+	"github.com/minio/minio-go/v7"
+)
+
+// RetryPolicy retries S3 operations which fail with a transient error, like
+// 503 SlowDown or a reset connection. Retries wait for an exponentially
+// growing delay with full jitter. The clients themselves don't retry, so that
+// the policy is the only one deciding about retries.
+type RetryPolicy struct {
+	// MaxAttempts is the number of attempts of an operation, 1 disables retries
+	MaxAttempts int
+	// InitialBackoff is the maximum delay before the first retry,
+	// it doubles with every retry up to MaxBackoff
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// Budget is the time an operation may take with all its retries.
+	// No retry is started if its delay would exceed the budget.
+	Budget time.Duration
+}
+
+// DefaultRetryPolicy is used for every value which isn't set in the secret
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    5,
+	InitialBackoff: 200 * time.Millisecond,
+	MaxBackoff:     10 * time.Second,
+	Budget:         30 * time.Second,
+}
+
+// retryPolicyFromSecret reads the retry policy from the retryMaxAttempts,
+// retryInitialBackoff, retryMaxBackoff and retryBudget keys
+func retryPolicyFromSecret(secret map[string]string) (RetryPolicy, error) {
+	policy := DefaultRetryPolicy
+	if v := secret["retryMaxAttempts"]; v != "" {
+		attempts, err := strconv.Atoi(v)
+		if err != nil || attempts < 1 {
+			return policy, fmt.Errorf("retryMaxAttempts must be a positive number, got %q", v)
+		}
+		policy.MaxAttempts = attempts
+	}
+	for key, d := range map[string]*time.Duration{
+		"retryInitialBackoff": &policy.InitialBackoff,
+		"retryMaxBackoff":     &policy.MaxBackoff,
+		"retryBudget":         &policy.Budget,
+	} {
+		v := secret[key]
+		if v == "" {
+			continue
+		}
+		duration, err := time.ParseDuration(v)
+		if err != nil || duration <= 0 {
+			return policy, fmt.Errorf("%s must be a positive duration like 500ms, got %q", key, v)
+		}
+		*d = duration
+	}
+	if policy.MaxBackoff < policy.InitialBackoff {
+		return policy, fmt.Errorf("retryMaxBackoff %v is less than retryInitialBackoff %v",
+			policy.MaxBackoff, policy.InitialBackoff)
+	}
+	return policy, nil
+}
+
+// backoff returns the random delay before the retry after attempt
+func (policy *RetryPolicy) backoff(attempt int) time.Duration {
+	limit := policy.MaxBackoff
+	if attempt < 32 && policy.InitialBackoff<<uint(attempt-1) < limit {
+		limit = policy.InitialBackoff << uint(attempt-1)
+	}
+	return time.Duration(rand.Int63n(int64(limit) + 1))
+}
+
+// do runs op until it succeeds, fails with an error which isn't retryable
+// or the attempts or the budget are used up
+func (policy *RetryPolicy) do(ctx context.Context, op func() error) error {
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil || !IsRetryable(err) || ctx.Err() != nil || attempt >= policy.MaxAttempts {
+			return err
+		}
+		delay := policy.backoff(attempt)
+		if time.Since(start)+delay > policy.Budget {
+			glog.Warningf("Retry budget of %v is used up: %v", policy.Budget, err)
+			return err
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(delay).After(deadline) {
+			return err
+		}
+		glog.Warningf("S3 request failed, retrying in %v (attempt %d of %d): %v",
+			delay, attempt, policy.MaxAttempts, err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+var retryableErrorCodes = map[string]bool{
+	"SlowDown":             true,
+	"ServiceUnavailable":   true,
+	"InternalError":        true,
+	"RequestTimeout":       true,
+	"OperationAborted":     true,
+	"Throttling":           true,
+	"ThrottlingException":  true,
+	"RequestLimitExceeded": true,
+	"TooManyRequests":      true,
+}
+
+// IsRetryable returns true if the error is transient, so that
+// the same request may succeed later. Other errors are terminal.
+func IsRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+		return true
+	}
+	// minio-go replaces io.EOF of closed connections with its own error
+	if strings.Contains(err.Error(), "Connection closed by foreign host") {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && retryableErrorCodes[apiErr.ErrorCode()] {
+		return true
+	}
+	resp := minio.ToErrorResponse(err)
+	if retryableErrorCodes[resp.Code] {
+		return true
+	}
+	status := resp.StatusCode
+	var respErr interface{ HTTPStatusCode() int }
+	if errors.As(err, &respErr) {
+		status = respErr.HTTPStatusCode()
+	}
+	return status == http.StatusTooManyRequests || status == http.StatusInternalServerError ||
+		isUnavailableStatus(status)
+}
+
+// retryClient retries the operations of a client with its retry policy
+type retryClient struct {
+	Client
+	policy RetryPolicy
+}
+
+func (client *retryClient) GetBucketStatus(ctx context.Context, bucketName string) (status BucketStatus, err error) {
+	err = client.policy.do(ctx, func() error {
+		status, err = client.Client.GetBucketStatus(ctx, bucketName)
+		return err
+	})
+	return status, err
+}
+
+func (client *retryClient) CreateBucket(ctx context.Context, bucketName string) error {
+	return client.policy.do(ctx, func() error {
+		return client.Client.CreateBucket(ctx, bucketName)
+	})
+}
+
+func (client *retryClient) SetFSMeta(ctx context.Context, meta *FSMeta) error {
+	return client.policy.do(ctx, func() error {
+		return client.Client.SetFSMeta(ctx, meta)
+	})
+}
+
+func (client *retryClient) GetFSMeta(ctx context.Context, bucketName string, prefix string) (meta *FSMeta, err error) {
+	err = client.policy.do(ctx, func() error {
+		meta, err = client.Client.GetFSMeta(ctx, bucketName, prefix)
+		return err
+	})
+	return meta, err
+}
+
+func (client *retryClient) CreatePrefix(ctx context.Context, bucketName string, prefix string) error {
+	return client.policy.do(ctx, func() error {
+		return client.Client.CreatePrefix(ctx, bucketName, prefix)
+	})
+}
+
+func (client *retryClient) RemovePrefix(ctx context.Context, bucketName string, prefix string) error {
+	return client.policy.do(ctx, func() error {
+		return client.Client.RemovePrefix(ctx, bucketName, prefix)
+	})
+}
+
+func (client *retryClient) RemoveBucket(ctx context.Context, bucketName string) error {
+	return client.policy.do(ctx, func() error {
+		return client.Client.RemoveBucket(ctx, bucketName)
+	})
+}
+
+func (client *retryClient) AbortMultipartUploads(ctx context.Context, bucketName string, prefix string, initiatedBefore time.Time) (aborted int, err error) {
+	err = client.policy.do(ctx, func() error {
+		var n int
+		n, err = client.Client.AbortMultipartUploads(ctx, bucketName, prefix, initiatedBefore)
+		aborted += n
+		return err
+	})
+	return aborted, err
+}
+
+func (client *retryClient) ListBuckets(ctx context.Context) (names []string, err error) {
+	err = client.policy.do(ctx, func() error {
+		names, err = client.Client.ListBuckets(ctx)
+		return err
+	})
+	return names, err
+}
+
+func (client *retryClient) ListPrefixes(ctx context.Context, bucketName string, prefix string) (prefixes []string, err error) {
+	err = client.policy.do(ctx, func() error {
+		prefixes, err = client.Client.ListPrefixes(ctx, bucketName, prefix)
+		return err
+	})
+	return prefixes, err
+}
+
+func (client *retryClient) GetBucketPolicy(ctx context.Context, bucketName string) (policy string, err error) {
+	err = client.policy.do(ctx, func() error {
+		policy, err = client.Client.GetBucketPolicy(ctx, bucketName)
+		return err
+	})
+	return policy, err
+}
+
+func (client *retryClient) SetBucketPolicy(ctx context.Context, bucketName string, policy string) error {
+	return client.policy.do(ctx, func() error {
+		return client.Client.SetBucketPolicy(ctx, bucketName, policy)
+	})
+}
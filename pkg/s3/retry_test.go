@@ -0,0 +1,163 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/aws/smithy-go"
+	"github.com/minio/minio-go/v7"
+
+	"github.com/yandex-cloud/k8s-csi-s3/pkg/s3/s3test"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Retry policy", func() {
+	ctx := context.Background()
+
+	It("reads the policy from the secret", func() {
+		policy, err := retryPolicyFromSecret(map[string]string{"retryMaxAttempts": "3", "retryBudget": "1m"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(policy).To(Equal(RetryPolicy{
+			MaxAttempts:    3,
+			InitialBackoff: DefaultRetryPolicy.InitialBackoff,
+			MaxBackoff:     DefaultRetryPolicy.MaxBackoff,
+			Budget:         time.Minute,
+		}))
+		for _, invalid := range []map[string]string{
+			{"retryMaxAttempts": "0"},
+			{"retryMaxAttempts": "many"},
+			{"retryBudget": "30"},
+			{"retryInitialBackoff": "-1s"},
+			{"retryInitialBackoff": "1m", "retryMaxBackoff": "1s"},
+		} {
+			_, err = retryPolicyFromSecret(invalid)
+			Expect(err).To(HaveOccurred(), "%v", invalid)
+		}
+	})
+
+	It("classifies errors", func() {
+		reset := fmt.Errorf("read: %w", &os.SyscallError{Syscall: "read", Err: syscall.ECONNRESET})
+		for _, err := range []error{
+			reset,
+			&smithy.GenericAPIError{Code: "SlowDown"},
+			minio.ErrorResponse{Code: "SlowDown", StatusCode: http.StatusServiceUnavailable},
+			minio.ErrorResponse{StatusCode: http.StatusInternalServerError},
+		} {
+			Expect(IsRetryable(err)).To(BeTrue(), "%v", err)
+		}
+		for _, err := range []error{
+			nil,
+			context.Canceled,
+			fmt.Errorf("request: %w", context.DeadlineExceeded),
+			&smithy.GenericAPIError{Code: "AccessDenied"},
+			minio.ErrorResponse{Code: "NoSuchBucket", StatusCode: http.StatusNotFound},
+			errors.New("Failed to remove 1 objects"),
+		} {
+			Expect(IsRetryable(err)).To(BeFalse(), "%v", err)
+		}
+	})
+
+	It("keeps the backoff below the exponential limit", func() {
+		policy := RetryPolicy{MaxAttempts: 10, InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+		for attempt := 1; attempt < 40; attempt++ {
+			limit := time.Second
+			if attempt < 5 {
+				limit = 100 * time.Millisecond << uint(attempt-1)
+			}
+			Expect(policy.backoff(attempt)).To(BeNumerically("<=", limit))
+		}
+	})
+
+	It("doesn't retry after the budget is used up", func() {
+		policy := RetryPolicy{MaxAttempts: 5, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond, Budget: time.Millisecond}
+		attempts := 0
+		err := policy.do(ctx, func() error {
+			attempts++
+			time.Sleep(5 * time.Millisecond)
+			return &smithy.GenericAPIError{Code: "SlowDown"}
+		})
+		Expect(err).To(HaveOccurred())
+		Expect(attempts).To(Equal(1))
+	})
+
+	for _, name := range []string{ClientAws, ClientMinio} {
+		name := name
+
+		Context(name, func() {
+			var (
+				fake     *s3test.Server
+				client   Client
+				attempts int
+			)
+
+			// failFirst fails the first n requests to the bucket with status
+			failFirst := func(n, status int) {
+				fake.Fault = func(r *http.Request) int {
+					// minio-go looks up the bucket location once
+					if _, ok := r.URL.Query()["location"]; ok {
+						return 0
+					}
+					attempts++
+					if attempts <= n {
+						return status
+					}
+					return 0
+				}
+			}
+
+			BeforeEach(func() {
+				fake = s3test.NewServer()
+				fake.CreateBucket("bucket", false)
+				attempts = 0
+				var err error
+				client, err = NewClientFromSecret(ctx, map[string]string{
+					"accessKeyID":         "access",
+					"secretAccessKey":     "secret",
+					"endpoint":            fake.URL,
+					"client":              name,
+					"retryMaxAttempts":    "3",
+					"retryInitialBackoff": "10ms",
+					"retryMaxBackoff":     "50ms",
+				})
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			AfterEach(func() {
+				fake.Close()
+			})
+
+			It("retries SlowDown", func() {
+				failFirst(2, http.StatusServiceUnavailable)
+				fake.FaultCode = "SlowDown"
+				Expect(client.CreatePrefix(ctx, "bucket", "pvc")).To(Succeed())
+				Expect(fake.Keys("bucket")).To(Equal([]string{"pvc/"}))
+				Expect(attempts).To(Equal(3))
+			})
+
+			It("retries reset connections", func() {
+				failFirst(2, s3test.FaultReset)
+				Expect(client.GetBucketStatus(ctx, "bucket")).To(Equal(BucketFound))
+			})
+
+			It("gives up after the last attempt", func() {
+				failFirst(10, http.StatusServiceUnavailable)
+				_, err := client.GetBucketStatus(ctx, "bucket")
+				Expect(err).To(HaveOccurred())
+				Expect(attempts).To(Equal(3))
+			})
+
+			It("doesn't retry terminal errors", func() {
+				failFirst(10, http.StatusForbidden)
+				Expect(client.CreatePrefix(ctx, "bucket", "pvc")).NotTo(Succeed())
+				Expect(attempts).To(Equal(1))
+			})
+		})
+	}
+})
@@ -0,0 +1,847 @@
+// Package s3test provides a local stand-in for S3 servers in tests.
+package s3test
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server is a minimal local stand-in for an S3 server. It implements just
+// enough of the API for both clients, with path-style addressing only and
+// without checking signatures.
+type Server struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	Buckets map[string]*Bucket
+	// PageSize limits the number of keys in every listing
+	PageSize   int
+	versionSeq int
+	// Fault is called for every request, a non-zero status code fails it
+	// and FaultReset closes the connection without a response
+	Fault func(r *http.Request) int
+	// FaultCode is the error code of failed requests instead of the default one of the status
+	FaultCode string
+	// Requests counts requests by method
+	Requests map[string]int
+	// Users are RGW users created with the admin API by ID
+	Users map[string]*User
+	// Sessions are session policies of MinIO STS keys by access key
+	Sessions map[string]string
+	// VirtualHostDomain makes requests to <bucket>.<VirtualHostDomain>
+	// address the bucket by the host name
+	VirtualHostDomain string
+	// IgnoreConditions makes PUT requests ignore If-Match
+	IgnoreConditions bool
+}
+
+// User is an RGW user
+type User struct {
+	displayName string
+	// Keys are the secret keys by access key
+	Keys map[string]string
+}
+
+// Bucket holds the objects, uploads and the policy of a bucket
+type Bucket struct {
+	Versioning bool
+	// Forbidden makes every request to the bucket fail with AccessDenied
+	Forbidden bool
+	objects   map[string][]*fakeVersion
+	Policy    string
+	// uploads are incomplete multipart uploads by upload ID
+	uploads map[string]*fakeUpload
+}
+
+type fakeUpload struct {
+	key       string
+	initiated time.Time
+}
+
+// fakeVersion is a version of an object, the latest version is the last one
+type fakeVersion struct {
+	id           string
+	data         []byte
+	deleteMarker bool
+}
+
+// FaultReset is the fault status which resets the connection
+const FaultReset = -1
+
+// NewServer starts a server which serves HTTP
+func NewServer() *Server {
+	fake := newUnstartedServer()
+	fake.Start()
+	return fake
+}
+
+// NewTLSServer starts a server which serves HTTPS with a self-signed certificate, fields
+// of tlsConfig like ClientAuth are copied into the server configuration
+func NewTLSServer(tlsConfig *tls.Config) *Server {
+	fake := newUnstartedServer()
+	fake.TLS = tlsConfig
+	fake.StartTLS()
+	return fake
+}
+
+func newUnstartedServer() *Server {
+	fake := &Server{
+		Buckets:  make(map[string]*Bucket),
+		PageSize: 1000,
+		Requests: make(map[string]int),
+		Users:    make(map[string]*User),
+		Sessions: make(map[string]string),
+	}
+	fake.Server = httptest.NewUnstartedServer(http.HandlerFunc(fake.handle))
+	return fake
+}
+
+// CreateBucket creates the bucket, with versioning enabled if versioning is set
+func (fake *Server) CreateBucket(name string, versioning bool) *Bucket {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	b := &Bucket{Versioning: versioning, objects: make(map[string][]*fakeVersion)}
+	fake.Buckets[name] = b
+	return b
+}
+
+// HasBucket tells if the bucket exists
+func (fake *Server) HasBucket(name string) bool {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	return fake.Buckets[name] != nil
+}
+
+// putObject stores a new version of the object
+func (fake *Server) PutObject(bucket, key string) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	fake.putLocked(fake.Buckets[bucket], key, nil)
+}
+
+// deleteObject deletes the object like a DELETE request without a version ID
+func (fake *Server) DeleteObject(bucket, key string) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	fake.deleteLocked(fake.Buckets[bucket], key, "")
+}
+
+// keys returns all keys with at least one version, including delete markers
+func (fake *Server) Keys(bucket string) []string {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	var keys []string
+	for key := range fake.Buckets[bucket].objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// createUpload starts a multipart upload of the object and returns its ID
+func (fake *Server) CreateUpload(bucket, key string, initiated time.Time) string {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	b := fake.Buckets[bucket]
+	if b.uploads == nil {
+		b.uploads = make(map[string]*fakeUpload)
+	}
+	fake.versionSeq++
+	uploadID := fmt.Sprintf("u%06d", fake.versionSeq)
+	b.uploads[uploadID] = &fakeUpload{key: key, initiated: initiated}
+	return uploadID
+}
+
+// uploadKeys returns the keys of the incomplete multipart uploads
+func (fake *Server) UploadKeys(bucket string) []string {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	var keys []string
+	for _, u := range fake.Buckets[bucket].uploads {
+		keys = append(keys, u.key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (fake *Server) putLocked(b *Bucket, key string, data []byte) {
+	v := &fakeVersion{id: "null", data: data}
+	if b.Versioning {
+		fake.versionSeq++
+		v.id = fmt.Sprintf("v%06d", fake.versionSeq)
+		b.objects[key] = append(b.objects[key], v)
+	} else {
+		b.objects[key] = []*fakeVersion{v}
+	}
+}
+
+func (fake *Server) deleteLocked(b *Bucket, key, versionID string) {
+	if versionID == "" {
+		if b.Versioning {
+			fake.versionSeq++
+			marker := &fakeVersion{id: fmt.Sprintf("v%06d", fake.versionSeq), deleteMarker: true}
+			b.objects[key] = append(b.objects[key], marker)
+		} else {
+			delete(b.objects, key)
+		}
+		return
+	}
+	versions := b.objects[key]
+	for i, v := range versions {
+		if v.id == versionID {
+			versions = append(versions[0:i], versions[i+1:]...)
+			break
+		}
+	}
+	if len(versions) == 0 {
+		delete(b.objects, key)
+	} else {
+		b.objects[key] = versions
+	}
+}
+
+func (fake *Server) sortedKeys(b *Bucket, prefix string) []string {
+	var keys []string
+	for key := range b.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type fakeError struct {
+	XMLName    xml.Name `xml:"Error"`
+	Code       string
+	Message    string
+	BucketName string `xml:",omitempty"`
+	RequestID  string `xml:"RequestId"`
+}
+
+var fakeErrorMessages = map[string]string{
+	"NoSuchBucket":            "The specified bucket does not exist",
+	"NoSuchKey":               "The specified key does not exist.",
+	"BucketNotEmpty":          "The bucket you tried to delete is not empty",
+	"BucketAlreadyOwnedByYou": "Your previous request to create the named bucket succeeded and you already own it.",
+	"AccessDenied":            "Access Denied",
+	"SlowDown":                "Please reduce your request rate.",
+	"InternalError":           "We encountered an internal error. Please try again.",
+	"NotImplemented":          "A header you provided implies functionality that is not implemented",
+	"NoSuchBucketPolicy":      "The bucket policy does not exist",
+	"NoSuchUpload":            "The specified multipart upload does not exist.",
+	"NoSuchTagSet":            "The TagSet does not exist",
+	"PreconditionFailed":      "At least one of the pre-conditions you specified did not hold",
+
+	"ObjectLockConfigurationNotFoundError": "Object Lock configuration does not exist for this bucket",
+}
+
+var fakeStatusCodes = map[int]string{
+	http.StatusForbidden:           "AccessDenied",
+	http.StatusInternalServerError: "InternalError",
+	http.StatusNotImplemented:      "NotImplemented",
+	http.StatusServiceUnavailable:  "SlowDown",
+}
+
+func writeXML(w http.ResponseWriter, status int, v interface{}) {
+	body, err := xml.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	w.Write([]byte(xml.Header))
+	w.Write(body)
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, status int, code, bucket string) {
+	if r.Method == http.MethodHead {
+		w.WriteHeader(status)
+		return
+	}
+	writeXML(w, status, &fakeError{Code: code, Message: fakeErrorMessages[code], BucketName: bucket, RequestID: "fake"})
+}
+
+func (fake *Server) handle(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("x-amz-request-id", "fake")
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	if host := strings.Split(r.Host, ":")[0]; fake.VirtualHostDomain != "" && strings.HasSuffix(host, "."+fake.VirtualHostDomain) {
+		path = strings.TrimSuffix(host, "."+fake.VirtualHostDomain) + "/" + path
+	}
+	bucketName, key := path, ""
+	if i := strings.Index(path, "/"); i >= 0 {
+		bucketName, key = path[0:i], path[i+1:]
+	}
+	query := r.URL.Query()
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	fake.Requests[r.Method]++
+	if fake.Fault != nil {
+		if status := fake.Fault(r); status == FaultReset {
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err == nil {
+				conn.Close()
+			}
+			return
+		} else if status != 0 {
+			code := fake.FaultCode
+			if code == "" {
+				code = fakeStatusCodes[status]
+			}
+			writeError(w, r, status, code, bucketName)
+			return
+		}
+	}
+
+	if bucketName == "" && r.Method == http.MethodPost {
+		fake.assumeRole(w, r)
+		return
+	}
+	if bucketName == "admin" {
+		fake.handleAdmin(w, r, key)
+		return
+	}
+	if bucketName == "" && r.Method == http.MethodGet {
+		fake.listBuckets(w)
+		return
+	}
+	if bucketName == "" {
+		writeError(w, r, http.StatusNotImplemented, "NotImplemented", "")
+		return
+	}
+	b := fake.Buckets[bucketName]
+	if b != nil && b.Forbidden {
+		writeError(w, r, http.StatusForbidden, "AccessDenied", bucketName)
+		return
+	}
+	if b == nil && !(r.Method == http.MethodPut && key == "" && len(query) == 0) {
+		writeError(w, r, http.StatusNotFound, "NoSuchBucket", bucketName)
+		return
+	}
+
+	if key == "" {
+		fake.handleBucket(w, r, bucketName, b)
+	} else {
+		fake.handleObject(w, r, bucketName, b, key)
+	}
+}
+
+func (fake *Server) handleBucket(w http.ResponseWriter, r *http.Request, bucketName string, b *Bucket) {
+	query := r.URL.Query()
+	switch {
+	case r.Method == http.MethodHead:
+		w.WriteHeader(http.StatusOK)
+	case r.Method == http.MethodPut && len(query) == 0:
+		if b != nil {
+			writeError(w, r, http.StatusConflict, "BucketAlreadyOwnedByYou", bucketName)
+			return
+		}
+		fake.Buckets[bucketName] = &Bucket{objects: make(map[string][]*fakeVersion)}
+		w.Header().Set("Location", "/"+bucketName)
+		w.WriteHeader(http.StatusOK)
+	case r.Method == http.MethodDelete && len(query) == 0:
+		// like some S3 implementations, incomplete uploads keep the bucket
+		if len(b.objects) > 0 || len(b.uploads) > 0 {
+			writeError(w, r, http.StatusConflict, "BucketNotEmpty", bucketName)
+			return
+		}
+		delete(fake.Buckets, bucketName)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodGet && has(query, "policy"):
+		if b.Policy == "" {
+			writeError(w, r, http.StatusNotFound, "NoSuchBucketPolicy", bucketName)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(b.Policy))
+	case r.Method == http.MethodPut && has(query, "policy"):
+		body, _ := ioutil.ReadAll(r.Body)
+		b.Policy = string(body)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodDelete && has(query, "policy"):
+		b.Policy = ""
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodGet && has(query, "location"):
+		writeXML(w, http.StatusOK, &struct {
+			XMLName xml.Name `xml:"LocationConstraint"`
+		}{})
+	case r.Method == http.MethodGet && has(query, "versioning"):
+		status := ""
+		if b.Versioning {
+			status = "Enabled"
+		}
+		writeXML(w, http.StatusOK, &struct {
+			XMLName xml.Name `xml:"VersioningConfiguration"`
+			Status  string   `xml:",omitempty"`
+		}{Status: status})
+	case r.Method == http.MethodGet && has(query, "tagging"):
+		writeError(w, r, http.StatusNotFound, "NoSuchTagSet", bucketName)
+	case r.Method == http.MethodGet && has(query, "object-lock"):
+		writeError(w, r, http.StatusNotFound, "ObjectLockConfigurationNotFoundError", bucketName)
+	case r.Method == http.MethodGet && has(query, "uploads"):
+		fake.listUploads(w, r, bucketName, b)
+	case r.Method == http.MethodGet && has(query, "versions"):
+		fake.listVersions(w, r, bucketName, b)
+	case r.Method == http.MethodGet && query.Get("list-type") == "2":
+		fake.listObjects(w, r, bucketName, b)
+	case r.Method == http.MethodPost && has(query, "delete"):
+		fake.deleteObjects(w, r, b)
+	default:
+		writeError(w, r, http.StatusNotImplemented, "NotImplemented", bucketName)
+	}
+}
+
+func (fake *Server) handleObject(w http.ResponseWriter, r *http.Request, bucketName string, b *Bucket, key string) {
+	switch r.Method {
+	case http.MethodPut:
+		if etag := r.Header.Get("If-Match"); etag != "" && !fake.IgnoreConditions {
+			versions := b.objects[key]
+			if len(versions) == 0 || versions[len(versions)-1].deleteMarker {
+				writeError(w, r, http.StatusNotFound, "NoSuchKey", bucketName)
+				return
+			}
+			if etag != `"d41d8cd98f00b204e9800998ecf8427e"` {
+				writeError(w, r, http.StatusPreconditionFailed, "PreconditionFailed", bucketName)
+				return
+			}
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		if strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+			body = decodeChunks(body)
+		}
+		fake.putLocked(b, key, body)
+		if b.Versioning {
+			versions := b.objects[key]
+			w.Header().Set("x-amz-version-id", versions[len(versions)-1].id)
+		}
+		w.Header().Set("ETag", `"d41d8cd98f00b204e9800998ecf8427e"`)
+		w.WriteHeader(http.StatusOK)
+	case http.MethodHead, http.MethodGet:
+		versions := b.objects[key]
+		if len(versions) == 0 || versions[len(versions)-1].deleteMarker {
+			writeError(w, r, http.StatusNotFound, "NoSuchKey", bucketName)
+			return
+		}
+		data := versions[len(versions)-1].data
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(data)))
+		w.Header().Set("ETag", `"d41d8cd98f00b204e9800998ecf8427e"`)
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	case http.MethodDelete:
+		if uploadID := r.URL.Query().Get("uploadId"); uploadID != "" {
+			if b.uploads[uploadID] == nil || b.uploads[uploadID].key != key {
+				writeError(w, r, http.StatusNotFound, "NoSuchUpload", bucketName)
+				return
+			}
+			delete(b.uploads, uploadID)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		fake.deleteLocked(b, key, r.URL.Query().Get("versionId"))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, r, http.StatusNotImplemented, "NotImplemented", bucketName)
+	}
+}
+
+// decodeChunks returns the data of a body with aws-chunked content encoding,
+// which minio-go uses to upload objects without TLS
+func decodeChunks(body []byte) []byte {
+	var data []byte
+	for {
+		i := bytes.Index(body, []byte("\r\n"))
+		if i < 0 {
+			return data
+		}
+		size, err := strconv.ParseInt(strings.SplitN(string(body[:i]), ";", 2)[0], 16, 64)
+		if err != nil || size == 0 || int64(len(body)) < int64(i+2)+size {
+			return data
+		}
+		body = body[i+2:]
+		data = append(data, body[:size]...)
+		body = bytes.TrimPrefix(body[size:], []byte("\r\n"))
+	}
+}
+
+type fakeObject struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int
+	StorageClass string
+}
+
+type fakeBucketEntry struct {
+	Name         string
+	CreationDate string
+}
+
+func (fake *Server) listBuckets(w http.ResponseWriter) {
+	var names []string
+	for name := range fake.Buckets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	result := struct {
+		XMLName xml.Name `xml:"ListAllMyBucketsResult"`
+		Owner   struct {
+			ID          string
+			DisplayName string
+		}
+		Buckets []fakeBucketEntry `xml:"Buckets>Bucket"`
+	}{}
+	for _, name := range names {
+		result.Buckets = append(result.Buckets, fakeBucketEntry{
+			Name:         name,
+			CreationDate: time.Now().UTC().Format(time.RFC3339),
+		})
+	}
+	writeXML(w, http.StatusOK, &result)
+}
+
+type fakeCommonPrefix struct {
+	Prefix string
+}
+
+func (fake *Server) listObjects(w http.ResponseWriter, r *http.Request, bucketName string, b *Bucket) {
+	query := r.URL.Query()
+	prefix := query.Get("prefix")
+	delimiter := query.Get("delimiter")
+	after := query.Get("continuation-token")
+	if after == "" {
+		after = query.Get("start-after")
+	}
+	result := struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Name                  string
+		Prefix                string
+		KeyCount              int
+		MaxKeys               int
+		IsTruncated           bool
+		ContinuationToken     string `xml:",omitempty"`
+		NextContinuationToken string `xml:",omitempty"`
+		Contents              []fakeObject
+		CommonPrefixes        []fakeCommonPrefix
+	}{Name: bucketName, Prefix: prefix, MaxKeys: fake.PageSize, ContinuationToken: query.Get("continuation-token")}
+	last := ""
+	for _, key := range fake.sortedKeys(b, prefix) {
+		versions := b.objects[key]
+		latest := versions[len(versions)-1]
+		if key <= after || latest.deleteMarker {
+			continue
+		}
+		// keys below a delimiter are listed once as their common prefix
+		commonPrefix := ""
+		if i := strings.Index(key[len(prefix):], delimiter); delimiter != "" && i >= 0 {
+			commonPrefix = key[:len(prefix)+i+len(delimiter)]
+			if commonPrefix == last || strings.HasPrefix(after, commonPrefix) {
+				continue
+			}
+		}
+		if len(result.Contents)+len(result.CommonPrefixes) == fake.PageSize {
+			result.IsTruncated = true
+			result.NextContinuationToken = last
+			break
+		}
+		if commonPrefix != "" {
+			result.CommonPrefixes = append(result.CommonPrefixes, fakeCommonPrefix{Prefix: commonPrefix})
+			last = commonPrefix
+			continue
+		}
+		last = key
+		result.Contents = append(result.Contents, fakeObject{
+			Key:          key,
+			LastModified: time.Now().UTC().Format(time.RFC3339),
+			ETag:         `"d41d8cd98f00b204e9800998ecf8427e"`,
+			Size:         len(latest.data),
+			StorageClass: "STANDARD",
+		})
+	}
+	result.KeyCount = len(result.Contents) + len(result.CommonPrefixes)
+	writeXML(w, http.StatusOK, &result)
+}
+
+type fakeVersionEntry struct {
+	XMLName      xml.Name
+	Key          string
+	VersionID    string `xml:"VersionId"`
+	IsLatest     bool
+	LastModified string
+	ETag         string `xml:",omitempty"`
+	Size         int    `xml:",omitempty"`
+}
+
+func (fake *Server) listVersions(w http.ResponseWriter, r *http.Request, bucketName string, b *Bucket) {
+	query := r.URL.Query()
+	prefix := query.Get("prefix")
+	keyMarker := query.Get("key-marker")
+	versionMarker := query.Get("version-id-marker")
+
+	var entries []fakeVersionEntry
+	for _, key := range fake.sortedKeys(b, prefix) {
+		versions := b.objects[key]
+		// newest first
+		for i := len(versions) - 1; i >= 0; i-- {
+			v := versions[i]
+			e := fakeVersionEntry{
+				XMLName:      xml.Name{Local: "Version"},
+				Key:          key,
+				VersionID:    v.id,
+				IsLatest:     i == len(versions)-1,
+				LastModified: time.Now().UTC().Format(time.RFC3339),
+			}
+			if v.deleteMarker {
+				e.XMLName.Local = "DeleteMarker"
+			} else {
+				e.ETag = `"d41d8cd98f00b204e9800998ecf8427e"`
+				e.Size = len(v.data)
+			}
+			entries = append(entries, e)
+		}
+	}
+	// Versions of a key are listed newest first and version IDs grow, so the
+	// listing continues correctly even if the marker version was deleted
+	var rest []fakeVersionEntry
+	for _, e := range entries {
+		if keyMarker == "" || e.Key > keyMarker ||
+			e.Key == keyMarker && versionMarker != "" && e.VersionID < versionMarker {
+			rest = append(rest, e)
+		}
+	}
+	entries = rest
+
+	result := struct {
+		XMLName             xml.Name `xml:"ListVersionsResult"`
+		Name                string
+		Prefix              string
+		KeyMarker           string
+		VersionIDMarker     string `xml:"VersionIdMarker"`
+		MaxKeys             int
+		IsTruncated         bool
+		NextKeyMarker       string `xml:",omitempty"`
+		NextVersionIDMarker string `xml:"NextVersionIdMarker,omitempty"`
+		Entries             []fakeVersionEntry
+	}{Name: bucketName, Prefix: prefix, KeyMarker: keyMarker, VersionIDMarker: versionMarker, MaxKeys: fake.PageSize}
+	if len(entries) > fake.PageSize {
+		entries = entries[0:fake.PageSize]
+		result.IsTruncated = true
+		result.NextKeyMarker = entries[len(entries)-1].Key
+		result.NextVersionIDMarker = entries[len(entries)-1].VersionID
+	}
+	result.Entries = entries
+	writeXML(w, http.StatusOK, &result)
+}
+
+type fakeUploadEntry struct {
+	Key       string
+	UploadID  string `xml:"UploadId"`
+	Initiated string
+}
+
+func (fake *Server) listUploads(w http.ResponseWriter, r *http.Request, bucketName string, b *Bucket) {
+	query := r.URL.Query()
+	prefix := query.Get("prefix")
+	keyMarker := query.Get("key-marker")
+	uploadIDMarker := query.Get("upload-id-marker")
+
+	var entries []fakeUploadEntry
+	for uploadID, u := range b.uploads {
+		if !strings.HasPrefix(u.key, prefix) {
+			continue
+		}
+		if keyMarker != "" && (u.key < keyMarker || u.key == keyMarker && uploadID <= uploadIDMarker) {
+			continue
+		}
+		entries = append(entries, fakeUploadEntry{Key: u.key, UploadID: uploadID, Initiated: u.initiated.UTC().Format(time.RFC3339)})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Key != entries[j].Key {
+			return entries[i].Key < entries[j].Key
+		}
+		return entries[i].UploadID < entries[j].UploadID
+	})
+
+	result := struct {
+		XMLName            xml.Name `xml:"ListMultipartUploadsResult"`
+		Bucket             string
+		Prefix             string
+		KeyMarker          string
+		UploadIDMarker     string `xml:"UploadIdMarker"`
+		MaxUploads         int
+		IsTruncated        bool
+		NextKeyMarker      string            `xml:",omitempty"`
+		NextUploadIDMarker string            `xml:"NextUploadIdMarker,omitempty"`
+		Uploads            []fakeUploadEntry `xml:"Upload"`
+	}{Bucket: bucketName, Prefix: prefix, KeyMarker: keyMarker, UploadIDMarker: uploadIDMarker, MaxUploads: fake.PageSize}
+	if len(entries) > fake.PageSize {
+		entries = entries[0:fake.PageSize]
+		result.IsTruncated = true
+		result.NextKeyMarker = entries[len(entries)-1].Key
+		result.NextUploadIDMarker = entries[len(entries)-1].UploadID
+	}
+	result.Uploads = entries
+	writeXML(w, http.StatusOK, &result)
+}
+
+func (fake *Server) deleteObjects(w http.ResponseWriter, r *http.Request, b *Bucket) {
+	var req struct {
+		Quiet   bool
+		Objects []struct {
+			Key       string
+			VersionID string `xml:"VersionId"`
+		} `xml:"Object"`
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	if err := xml.Unmarshal(body, &req); err != nil {
+		writeError(w, r, http.StatusBadRequest, "MalformedXML", "")
+		return
+	}
+	type deleted struct {
+		Key       string
+		VersionID string `xml:"VersionId,omitempty"`
+	}
+	result := struct {
+		XMLName xml.Name  `xml:"DeleteResult"`
+		Deleted []deleted `xml:"Deleted"`
+	}{}
+	for _, obj := range req.Objects {
+		fake.deleteLocked(b, obj.Key, obj.VersionID)
+		if !req.Quiet {
+			result.Deleted = append(result.Deleted, deleted{Key: obj.Key, VersionID: obj.VersionID})
+		}
+	}
+	writeXML(w, http.StatusOK, &result)
+}
+
+func has(query map[string][]string, key string) bool {
+	_, ok := query[key]
+	return ok
+}
+
+// assumeRole implements MinIO STS AssumeRole
+func (fake *Server) assumeRole(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	if r.Form.Get("Action") != "AssumeRole" || !strings.Contains(r.Header.Get("Authorization"), "/sts/aws4_request") {
+		writeError(w, r, http.StatusBadRequest, "InvalidRequest", "")
+		return
+	}
+	duration, _ := strconv.Atoi(r.Form.Get("DurationSeconds"))
+	fake.versionSeq++
+	accessKey := fmt.Sprintf("STS%06d", fake.versionSeq)
+	fake.Sessions[accessKey] = r.Form.Get("Policy")
+	type stsCredentials struct {
+		AccessKeyID     string `xml:"AccessKeyId"`
+		SecretAccessKey string
+		SessionToken    string
+		Expiration      string
+	}
+	writeXML(w, http.StatusOK, &struct {
+		XMLName     xml.Name       `xml:"https://sts.amazonaws.com/doc/2011-06-15/ AssumeRoleResponse"`
+		Credentials stsCredentials `xml:"AssumeRoleResult>Credentials"`
+	}{
+		Credentials: stsCredentials{
+			AccessKeyID:     accessKey,
+			SecretAccessKey: "sts-secret",
+			SessionToken:    "sts-token",
+			Expiration:      time.Now().Add(time.Duration(duration) * time.Second).UTC().Format(time.RFC3339),
+		},
+	})
+}
+
+// handleAdmin implements users of the RGW admin operations API
+func (fake *Server) handleAdmin(w http.ResponseWriter, r *http.Request, resource string) {
+	query := r.URL.Query()
+	uid := query.Get("uid")
+	reply := func(status int, v interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(v)
+	}
+	if resource != "user" || uid == "" || query.Get("format") != "json" {
+		reply(http.StatusBadRequest, map[string]string{"Code": "InvalidArgument"})
+		return
+	}
+	user := fake.Users[uid]
+	if has(query, "key") {
+		fake.handleAdminKey(w, r, user)
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		if user != nil {
+			reply(http.StatusConflict, map[string]string{"Code": "UserAlreadyExists"})
+			return
+		}
+		fake.versionSeq++
+		user = &User{
+			displayName: query.Get("display-name"),
+			Keys:        map[string]string{fmt.Sprintf("RGW%06d", fake.versionSeq): "rgw-secret"},
+		}
+		fake.Users[uid] = user
+	case http.MethodGet:
+		if user == nil {
+			reply(http.StatusNotFound, map[string]string{"Code": "NoSuchUser"})
+			return
+		}
+	case http.MethodDelete:
+		if user == nil {
+			reply(http.StatusNotFound, map[string]string{"Code": "NoSuchUser"})
+			return
+		}
+		delete(fake.Users, uid)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	reply(http.StatusOK, map[string]interface{}{
+		"user_id":      uid,
+		"display_name": user.displayName,
+		"keys":         user.keyList(uid),
+	})
+}
+
+// handleAdminKey implements creating and removing keys of RGW users
+func (fake *Server) handleAdminKey(w http.ResponseWriter, r *http.Request, user *User) {
+	query := r.URL.Query()
+	w.Header().Set("Content-Type", "application/json")
+	if user == nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"Code": "NoSuchUser"})
+		return
+	}
+	accessKey := query.Get("access-key")
+	switch r.Method {
+	case http.MethodPut:
+		user.Keys[accessKey] = query.Get("secret-key")
+	case http.MethodDelete:
+		if _, ok := user.Keys[accessKey]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"Code": "InvalidAccessKeyId"})
+			return
+		}
+		delete(user.Keys, accessKey)
+	}
+	json.NewEncoder(w).Encode(user.keyList(query.Get("uid")))
+}
+
+func (user *User) keyList(uid string) []map[string]string {
+	var keys []map[string]string
+	for accessKey, secretKey := range user.Keys {
+		keys = append(keys, map[string]string{"user": uid, "access_key": accessKey, "secret_key": secretKey})
+	}
+	return keys
+}
@@ -0,0 +1,342 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/signer"
+	"github.com/yandex-cloud/k8s-csi-s3/pkg/errdefs"
+)
+
+const (
+	// ScopedMinio makes the node plugin get temporary keys limited to the
+	// volume with MinIO STS AssumeRole and an inline session policy
+	ScopedMinio = "minio"
+	// ScopedRgw makes the controller create a Ceph RGW user for every volume,
+	// allowed to access only the volume by the bucket policy
+	ScopedRgw = "rgw"
+
+	scopedSessionDuration = time.Hour
+	defaultRgwAdminPath   = "/admin"
+	scopedRequestTimeout  = 30 * time.Second
+)
+
+// CreateScopedCredentials creates the backend user of the volume if the
+// configuration of the client asks for scoped credentials. GrantVolumeAccess
+// gives the user access to the volume.
+func CreateScopedCredentials(ctx context.Context, client Client, bucketName, prefix string) error {
+	cfg := client.Config()
+	switch cfg.ScopedCredentials {
+	case "", ScopedMinio:
+		// session policies don't need any preparation
+		return nil
+	case ScopedRgw:
+		// GrantVolumeAccess allows the user to access the volume
+		return newRgwAdmin(cfg).createUser(ctx, rgwUserID(bucketName, prefix), "csi-s3 volume "+bucketName+"/"+prefix)
+	}
+	return unknownScopedCredentials(cfg.ScopedCredentials)
+}
+
+// RevokeScopedCredentials removes the backend user of the volume,
+// RevokeVolumeAccess removes its bucket policy statements. Temporary
+// MinIO keys can't be revoked, they expire within scopedSessionDuration.
+func RevokeScopedCredentials(ctx context.Context, client Client, bucketName, prefix string) error {
+	cfg := client.Config()
+	switch cfg.ScopedCredentials {
+	case "", ScopedMinio:
+		return nil
+	case ScopedRgw:
+		return newRgwAdmin(cfg).deleteUser(ctx, rgwUserID(bucketName, prefix))
+	}
+	return unknownScopedCredentials(cfg.ScopedCredentials)
+}
+
+// ScopeCredentials returns a copy of cfg with keys which only give access
+// to the volume, if cfg asks for scoped credentials. Every call obtains new
+// keys: MinIO session keys expire, RGW keys are added to the user of the
+// volume until ReleaseScopedCredentials removes them.
+func ScopeCredentials(ctx context.Context, cfg *Config, bucketName, prefix string) (*Config, error) {
+	var keys *Config
+	var err error
+	switch cfg.ScopedCredentials {
+	case "":
+		return cfg, nil
+	case ScopedMinio:
+		keys, err = assumeMinioRole(ctx, cfg, volumePolicyStatements(bucketName, prefix, nil))
+	case ScopedRgw:
+		keys, err = newRgwAdmin(cfg).createKey(ctx, rgwUserID(bucketName, prefix))
+	default:
+		err = unknownScopedCredentials(cfg.ScopedCredentials)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get scoped credentials of volume %s/%s: %w", bucketName, prefix, err)
+	}
+	scoped := *cfg
+	// keys of a role are already limited to the volume
+	scoped.AwsRoleArn = ""
+	scoped.WebIdentityTokenFile = ""
+	setKeys(&scoped, keys)
+	return &scoped, nil
+}
+
+// ReleaseScopedCredentials removes keys of the volume which ScopeCredentials
+// returned with cfg. MinIO session keys can't be removed, they expire.
+func ReleaseScopedCredentials(ctx context.Context, cfg *Config, bucketName, prefix, accessKeyID string) error {
+	switch cfg.ScopedCredentials {
+	case "", ScopedMinio:
+		return nil
+	case ScopedRgw:
+		return newRgwAdmin(cfg).deleteKey(ctx, rgwUserID(bucketName, prefix), accessKeyID)
+	}
+	return unknownScopedCredentials(cfg.ScopedCredentials)
+}
+
+func unknownScopedCredentials(mode string) error {
+	return errdefs.New(errdefs.InvalidArgument, "unknown scopedCredentials %q, must be %q or %q", mode, ScopedMinio, ScopedRgw)
+}
+
+func isNotFound(err error) bool {
+	return isAwsNotFound(err) || isMinioNotFound(err)
+}
+
+func signingRegion(cfg *Config) string {
+	if cfg.Region != "" {
+		return cfg.Region
+	}
+	return defaultRegion
+}
+
+func payloadHash(body []byte) string {
+	h := sha256.Sum256(body)
+	return hex.EncodeToString(h[:])
+}
+
+// assumeMinioRole gets temporary keys of the user of cfg, limited by the session policy
+func assumeMinioRole(ctx context.Context, cfg *Config, statements []policyStatement) (*Config, error) {
+	if cfg.AccessKeyID == "" || cfg.SessionToken != "" {
+		return nil, fmt.Errorf("MinIO scoped credentials need static keys")
+	}
+	policy, err := marshalPolicy(statements)
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{}
+	form.Set("Action", "AssumeRole")
+	form.Set("Version", "2011-06-15")
+	form.Set("DurationSeconds", strconv.Itoa(int(scopedSessionDuration/time.Second)))
+	form.Set("Policy", policy)
+	body := []byte(form.Encode())
+
+	u, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = endpointPath(cfg.Endpoint) + "/"
+	ctx, cancel := context.WithTimeout(ctx, scopedRequestTimeout)
+	defer cancel()
+	req, err := http.NewRequest(http.MethodPost, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash(body))
+	req = signer.SignV4STS(*req, cfg.AccessKeyID, cfg.SecretAccessKey, signingRegion(cfg))
+
+	client, err := httpClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("AssumeRole returned %s: %s", resp.Status, strings.TrimSpace(string(respBody)))
+	}
+	var result credentials.AssumeRoleResponse
+	if err = xml.Unmarshal(respBody, &result); err != nil {
+		return nil, fmt.Errorf("failed to parse AssumeRole response: %v", err)
+	}
+	creds := result.Result.Credentials
+	return &Config{
+		AccessKeyID:     creds.AccessKey,
+		SecretAccessKey: creds.SecretKey,
+		SessionToken:    creds.SessionToken,
+		Expires:         creds.Expiration,
+	}, nil
+}
+
+// rgwUserID returns the ID of the RGW user of the volume
+func rgwUserID(bucketName, prefix string) string {
+	h := sha1.Sum([]byte(bucketName + "/" + prefix))
+	return "csi-s3-" + hex.EncodeToString(h[:])
+}
+
+func rgwUserArn(uid string) string {
+	return "arn:aws:iam:::user/" + uid
+}
+
+// rgwAdmin is a client of the Ceph RGW admin operations API
+type rgwAdmin struct {
+	cfg      *Config
+	basePath string
+}
+
+func newRgwAdmin(cfg *Config) *rgwAdmin {
+	basePath := cfg.RgwAdminPath
+	if basePath == "" {
+		basePath = defaultRgwAdminPath
+	}
+	return &rgwAdmin{cfg: cfg, basePath: "/" + strings.Trim(basePath, "/")}
+}
+
+type rgwError struct {
+	Code string `json:"Code"`
+}
+
+func (admin *rgwAdmin) request(ctx context.Context, method, resource string, query url.Values) (int, []byte, error) {
+	u, err := url.Parse(admin.cfg.Endpoint)
+	if err != nil {
+		return 0, nil, err
+	}
+	u.Path = endpointPath(admin.cfg.Endpoint) + admin.basePath + "/" + resource
+	query.Set("format", "json")
+	u.RawQuery = query.Encode()
+	ctx, cancel := context.WithTimeout(ctx, scopedRequestTimeout)
+	defer cancel()
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash(nil))
+	req = signer.SignV4(*req, admin.cfg.AccessKeyID, admin.cfg.SecretAccessKey, admin.cfg.SessionToken, signingRegion(admin.cfg))
+	client, err := httpClient(admin.cfg)
+	if err != nil {
+		return 0, nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var rgwErr rgwError
+		json.Unmarshal(body, &rgwErr)
+		return resp.StatusCode, body, fmt.Errorf("RGW admin %s %s returned %s %s", method, resource, resp.Status, rgwErr.Code)
+	}
+	return resp.StatusCode, body, nil
+}
+
+func (admin *rgwAdmin) createUser(ctx context.Context, uid, displayName string) error {
+	status, _, err := admin.request(ctx, http.MethodPut, "user", url.Values{
+		"uid":          {uid},
+		"display-name": {displayName},
+		"generate-key": {"True"},
+	})
+	if status == http.StatusConflict {
+		// created by a previous attempt
+		return nil
+	}
+	if err == nil {
+		glog.V(4).Infof("Created RGW user %s", uid)
+	}
+	return err
+}
+
+// createKey adds new S3 keys to the user. The keys are generated here, so
+// that they don't have to be picked from the other keys of the user.
+func (admin *rgwAdmin) createKey(ctx context.Context, uid string) (*Config, error) {
+	accessKey, err := randomKey(rgwAccessKeyChars, 20)
+	if err != nil {
+		return nil, err
+	}
+	secretKey, err := randomKey(rgwSecretKeyChars, 40)
+	if err != nil {
+		return nil, err
+	}
+	_, _, err = admin.request(ctx, http.MethodPut, "user", url.Values{
+		"key":        {""},
+		"uid":        {uid},
+		"key-type":   {"s3"},
+		"access-key": {accessKey},
+		"secret-key": {secretKey},
+	})
+	if err != nil {
+		return nil, err
+	}
+	glog.V(4).Infof("Created key %s of RGW user %s", accessKey, uid)
+	return &Config{AccessKeyID: accessKey, SecretAccessKey: secretKey}, nil
+}
+
+func (admin *rgwAdmin) deleteKey(ctx context.Context, uid, accessKey string) error {
+	status, _, err := admin.request(ctx, http.MethodDelete, "user", url.Values{
+		"key":        {""},
+		"uid":        {uid},
+		"key-type":   {"s3"},
+		"access-key": {accessKey},
+	})
+	if status == http.StatusNotFound {
+		return nil
+	}
+	if err == nil {
+		glog.V(4).Infof("Deleted key %s of RGW user %s", accessKey, uid)
+	}
+	return err
+}
+
+const (
+	rgwAccessKeyChars = "ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	rgwSecretKeyChars = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
+)
+
+// randomKey returns n random characters of chars
+func randomKey(chars string, n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	for i := range b {
+		b[i] = chars[int(b[i])%len(chars)]
+	}
+	return string(b), nil
+}
+
+func (admin *rgwAdmin) deleteUser(ctx context.Context, uid string) error {
+	status, _, err := admin.request(ctx, http.MethodDelete, "user", url.Values{
+		"uid":        {uid},
+		"purge-data": {"False"},
+	})
+	if status == http.StatusNotFound {
+		return nil
+	}
+	if err == nil {
+		glog.V(4).Infof("Deleted RGW user %s", uid)
+	}
+	return err
+}
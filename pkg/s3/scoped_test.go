@@ -0,0 +1,108 @@
+package s3
+
+import (
+	"context"
+	"time"
+
+	"github.com/yandex-cloud/k8s-csi-s3/pkg/s3/s3test"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Scoped credentials", func() {
+	var (
+		fake *s3test.Server
+		ctx  = context.Background()
+	)
+
+	BeforeEach(func() {
+		fake = s3test.NewServer()
+		fake.CreateBucket("bucket", false)
+	})
+
+	AfterEach(func() {
+		fake.Close()
+	})
+
+	It("keeps the keys without scoped credentials", func() {
+		cfg := fakeConfig(fake)
+		scoped, err := ScopeCredentials(ctx, cfg, "bucket", "pvc")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(scoped).To(Equal(cfg))
+	})
+
+	It("gets MinIO session keys limited to the volume", func() {
+		cfg := fakeConfig(fake)
+		cfg.ScopedCredentials = ScopedMinio
+		client, err := NewClientMinio(cfg)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(CreateScopedCredentials(ctx, client, "bucket", "pvc")).To(Succeed())
+
+		scoped, err := ScopeCredentials(ctx, cfg, "bucket", "pvc")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(scoped.AccessKeyID).NotTo(Equal(cfg.AccessKeyID))
+		Expect(scoped.SessionToken).To(Equal("sts-token"))
+		Expect(scoped.Endpoint).To(Equal(cfg.Endpoint))
+		Expect(scoped.Expires).To(BeTemporally("~", time.Now().Add(scopedSessionDuration), time.Minute))
+		Expect(fake.Sessions[scoped.AccessKeyID]).To(ContainSubstring("arn:aws:s3:::bucket/pvc/*"))
+
+		Expect(RevokeScopedCredentials(ctx, client, "bucket", "pvc")).To(Succeed())
+	})
+
+	It("refuses to scope temporary MinIO keys", func() {
+		cfg := fakeConfig(fake)
+		cfg.ScopedCredentials = ScopedMinio
+		cfg.SessionToken = "token"
+		_, err := ScopeCredentials(ctx, cfg, "bucket", "pvc")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("creates and revokes an RGW user for the volume", func() {
+		cfg := fakeConfig(fake)
+		cfg.ScopedCredentials = ScopedRgw
+		client, err := NewClientAws(cfg)
+		Expect(err).NotTo(HaveOccurred())
+		for _, prefix := range []string{"pvc", "pvc", "other"} {
+			// CreateVolume may be retried
+			Expect(CreateScopedCredentials(ctx, client, "bucket", prefix)).To(Succeed())
+			Expect(GrantVolumeAccess(ctx, client, "bucket", prefix)).To(Succeed())
+		}
+		uid := rgwUserID("bucket", "pvc")
+		Expect(fake.Users).To(HaveKey(uid))
+		Expect(fake.Users).To(HaveLen(2))
+
+		scoped, err := ScopeCredentials(ctx, cfg, "bucket", "pvc")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(fake.Users[uid].Keys).To(HaveKeyWithValue(scoped.AccessKeyID, scoped.SecretAccessKey))
+		Expect(scoped.Expires.IsZero()).To(BeTrue())
+		// every node gets its own keys, which are removed when it unstages the volume
+		other, err := ScopeCredentials(ctx, cfg, "bucket", "pvc")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(other.AccessKeyID).NotTo(Equal(scoped.AccessKeyID))
+		for i := 0; i < 2; i++ {
+			Expect(ReleaseScopedCredentials(ctx, cfg, "bucket", "pvc", other.AccessKeyID)).To(Succeed())
+		}
+		Expect(fake.Users[uid].Keys).NotTo(HaveKey(other.AccessKeyID))
+		Expect(fake.Users[uid].Keys).To(HaveKey(scoped.AccessKeyID))
+		policy := fake.Buckets["bucket"].Policy
+		Expect(policy).To(ContainSubstring(rgwUserArn(uid)))
+		Expect(policy).To(ContainSubstring("arn:aws:s3:::bucket/pvc/*"))
+
+		for i := 0; i < 2; i++ {
+			Expect(RevokeVolumeAccess(ctx, client, "bucket", "pvc")).To(Succeed())
+			Expect(RevokeScopedCredentials(ctx, client, "bucket", "pvc")).To(Succeed())
+		}
+		Expect(fake.Users).NotTo(HaveKey(uid))
+		policy = fake.Buckets["bucket"].Policy
+		Expect(policy).NotTo(ContainSubstring(rgwUserArn(uid)))
+		Expect(policy).To(ContainSubstring(rgwUserArn(rgwUserID("bucket", "other"))))
+	})
+
+	It("rejects unknown modes", func() {
+		cfg := fakeConfig(fake)
+		cfg.ScopedCredentials = "iam"
+		_, err := ScopeCredentials(ctx, cfg, "bucket", "pvc")
+		Expect(err).To(HaveOccurred())
+	})
+})
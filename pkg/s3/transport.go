@@ -0,0 +1,128 @@
+package s3
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// TransportConfig configures connections to the S3 endpoint. The driver and
+// the mounters are configured the same way, so that they trust the same endpoint.
+type TransportConfig struct {
+	// CABundle holds PEM encoded certificates which are trusted instead of the system CAs
+	CABundle string
+	// ClientCert and ClientKey are a PEM encoded certificate and key for mutual TLS
+	ClientCert string
+	ClientKey  string
+	// InsecureSkipVerify disables verification of the endpoint certificate, for test setups only
+	InsecureSkipVerify bool
+	// ProxyURL is the proxy for all requests to the endpoint. By default
+	// HTTPS_PROXY, HTTP_PROXY and NO_PROXY of the driver are used.
+	ProxyURL string
+}
+
+// IsDefault returns true if the default transport can be used
+func (t *TransportConfig) IsDefault() bool {
+	return *t == TransportConfig{}
+}
+
+// Validate checks that the certificates, the key and the proxy URL can be parsed
+func (t *TransportConfig) Validate() error {
+	_, err := t.tlsConfig()
+	if err != nil {
+		return err
+	}
+	_, err = t.proxyURL()
+	return err
+}
+
+func (t *TransportConfig) tlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: t.InsecureSkipVerify}
+	if t.CABundle != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(t.CABundle)) {
+			return nil, fmt.Errorf("caBundle has no PEM encoded certificates")
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if (t.ClientCert == "") != (t.ClientKey == "") {
+		return nil, fmt.Errorf("clientCert and clientKey must be set together")
+	}
+	if t.ClientCert != "" {
+		cert, err := tls.X509KeyPair([]byte(t.ClientCert), []byte(t.ClientKey))
+		if err != nil {
+			return nil, fmt.Errorf("invalid clientCert or clientKey: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+func (t *TransportConfig) proxyURL() (*url.URL, error) {
+	if t.ProxyURL == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(t.ProxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxyURL: %v", err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("invalid proxyURL %q, the scheme must be http, https or socks5", t.ProxyURL)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid proxyURL %q, the host is missing", t.ProxyURL)
+	}
+	return u, nil
+}
+
+// newTransport returns a transport for the endpoint, based on the default transport
+func newTransport(t *TransportConfig) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if err := t.apply(transport); err != nil {
+		return nil, err
+	}
+	return transport, nil
+}
+
+func (t *TransportConfig) apply(transport *http.Transport) error {
+	tlsConfig, err := t.tlsConfig()
+	if err != nil {
+		return err
+	}
+	proxy, err := t.proxyURL()
+	if err != nil {
+		return err
+	}
+	transport.TLSClientConfig = tlsConfig
+	if proxy != nil {
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+	return nil
+}
+
+// httpClient returns the client for requests to the endpoint of cfg
+// which aren't made by the S3 clients, like STS and RGW admin requests
+func httpClient(cfg *Config) (*http.Client, error) {
+	if cfg.Transport.IsDefault() {
+		return http.DefaultClient, nil
+	}
+	transport, err := newTransport(&cfg.Transport)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{Transport: transport}, nil
+}
+
+func transportFromSecret(secret map[string]string) TransportConfig {
+	return TransportConfig{
+		CABundle:           secret["caBundle"],
+		ClientCert:         secret["clientCert"],
+		ClientKey:          secret["clientKey"],
+		InsecureSkipVerify: secret["insecureSkipVerify"] == "true",
+		ProxyURL:           secret["proxyURL"],
+	}
+}
@@ -0,0 +1,129 @@
+package s3
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"time"
+
+	"github.com/yandex-cloud/k8s-csi-s3/pkg/s3/s3test"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// newClientCert returns a self-signed PEM encoded client certificate and key
+func newClientCert() (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).NotTo(HaveOccurred())
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "csi-s3"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	Expect(err).NotTo(HaveOccurred())
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	Expect(err).NotTo(HaveOccurred())
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}))
+}
+
+func serverCA(fake *s3test.Server) string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: fake.Certificate().Raw}))
+}
+
+var _ = Describe("Transport", func() {
+	ctx := context.Background()
+
+	It("validates the configuration", func() {
+		cert, key := newClientCert()
+		Expect((&TransportConfig{CABundle: cert, ClientCert: cert, ClientKey: key, ProxyURL: "http://proxy:3128"}).Validate()).To(Succeed())
+		Expect((&TransportConfig{CABundle: "not a certificate"}).Validate()).NotTo(Succeed())
+		Expect((&TransportConfig{ClientCert: cert}).Validate()).NotTo(Succeed())
+		Expect((&TransportConfig{ClientCert: cert, ClientKey: cert}).Validate()).NotTo(Succeed())
+		Expect((&TransportConfig{ProxyURL: "ftp://proxy"}).Validate()).NotTo(Succeed())
+		Expect((&TransportConfig{ProxyURL: "proxy:3128"}).Validate()).NotTo(Succeed())
+	})
+
+	It("is configured by the secret", func() {
+		_, err := LoadConfig(ctx, map[string]string{"caBundle": "not a certificate"})
+		Expect(err).To(HaveOccurred())
+		cfg, err := LoadConfig(ctx, map[string]string{"insecureSkipVerify": "true", "proxyURL": "http://proxy:3128"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cfg.Transport).To(Equal(TransportConfig{InsecureSkipVerify: true, ProxyURL: "http://proxy:3128"}))
+	})
+
+	for name, newClient := range clients {
+		name, newClient := name, newClient
+
+		Context(name, func() {
+			var fake *s3test.Server
+
+			AfterEach(func() {
+				fake.Close()
+			})
+
+			bucketExists := func(cfg *Config) error {
+				client, err := newClient(cfg)
+				Expect(err).NotTo(HaveOccurred())
+				_, err = client.GetBucketStatus(ctx, "bucket")
+				return err
+			}
+
+			It("trusts the CA bundle", func() {
+				fake = s3test.NewTLSServer(nil)
+				fake.CreateBucket("bucket", false)
+				cfg := fakeConfig(fake)
+				Expect(bucketExists(cfg)).NotTo(Succeed())
+				cfg.Transport.CABundle = serverCA(fake)
+				Expect(bucketExists(cfg)).To(Succeed())
+			})
+
+			It("skips verification if asked to", func() {
+				fake = s3test.NewTLSServer(nil)
+				fake.CreateBucket("bucket", false)
+				cfg := fakeConfig(fake)
+				cfg.Transport.InsecureSkipVerify = true
+				Expect(bucketExists(cfg)).To(Succeed())
+			})
+
+			It("presents the client certificate", func() {
+				fake = s3test.NewTLSServer(&tls.Config{ClientAuth: tls.RequireAnyClientCert})
+				fake.CreateBucket("bucket", false)
+				cfg := fakeConfig(fake)
+				cfg.Transport.CABundle = serverCA(fake)
+				Expect(bucketExists(cfg)).NotTo(Succeed())
+				cfg.Transport.ClientCert, cfg.Transport.ClientKey = newClientCert()
+				Expect(bucketExists(cfg)).To(Succeed())
+			})
+
+			It("sends requests through the proxy", func() {
+				fake = s3test.NewServer()
+				fake.CreateBucket("bucket", false)
+				var proxied int32
+				proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					atomic.AddInt32(&proxied, 1)
+					fake.Config.Handler.ServeHTTP(w, r)
+				}))
+				defer proxy.Close()
+				cfg := fakeConfig(fake)
+				cfg.Transport.ProxyURL = proxy.URL
+				Expect(bucketExists(cfg)).To(Succeed())
+				Expect(atomic.LoadInt32(&proxied)).To(BeNumerically(">", 0))
+			})
+		})
+	}
+})
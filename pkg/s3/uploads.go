@@ -0,0 +1,45 @@
+package s3
+
+import (
+	"context"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// multipartUpload is an incomplete multipart upload
+type multipartUpload struct {
+	Key       string
+	UploadID  string
+	Initiated time.Time
+}
+
+// abortUploads aborts the uploads which list passes to emit if they were
+// initiated before initiatedBefore, or all of them if it's zero. Uploads
+// which are completed or aborted in the meantime are skipped. S3
+// implementations without multipart uploads have nothing to abort.
+func abortUploads(ctx context.Context, bucketName string, initiatedBefore time.Time,
+	list func(emit func(upload multipartUpload) error) error,
+	abort func(ctx context.Context, upload multipartUpload) error) (int, error) {
+	aborted := 0
+	err := list(func(upload multipartUpload) error {
+		if !initiatedBefore.IsZero() && !upload.Initiated.Before(initiatedBefore) {
+			return nil
+		}
+		err := abort(ctx, upload)
+		if code, _ := s3ErrorCode(err); code == "NoSuchUpload" {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		glog.V(4).Infof("Aborted multipart upload %s of object %s in bucket %s", upload.UploadID, upload.Key, bucketName)
+		aborted++
+		return nil
+	})
+	if code, _ := s3ErrorCode(err); code == "NotImplemented" {
+		glog.Warningf("Bucket %s doesn't support listing multipart uploads: %v", bucketName, err)
+		return aborted, nil
+	}
+	return aborted, err
+}
@@ -0,0 +1,298 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	vaultEngineKV  = "kv"
+	vaultEngineAWS = "aws"
+
+	defaultVaultAuthPath           = "kubernetes"
+	defaultServiceAccountTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	vaultRequestTimeout            = 30 * time.Second
+	// Mounters read their keys again at least this often, so superseded
+	// leases aren't used anymore after this delay
+	defaultVaultRevokeDelay = 5 * time.Minute
+)
+
+// vaultProvider fetches the keys from HashiCorp Vault at the VaultAddress of
+// the provider settings, or VAULT_ADDR of the driver. Parameters in the secret:
+//
+// vaultPath is the path of a KV secret (e.g. "secret/data/s3", KV version 1 and 2
+// are supported) with the keys accessKeyID, secretAccessKey and optionally
+// sessionToken, or of AWS secrets engine credentials (e.g. "aws/creds/s3").
+// vaultEngine is "kv" (default) or "aws".
+// vaultRole is the role to log in with the Kubernetes auth method mounted at
+// vaultAuthPath ("kubernetes" by default), using the service account token of
+// the driver. Without a role vaultToken or VAULT_TOKEN of the driver is used.
+// vaultNamespace is the Vault Enterprise namespace, if any.
+//
+// Keys of the AWS secrets engine expire with their lease and are renewed
+// by the node plugin like keys of an assumed role. Every lease is shared by
+// all volumes with the same parameters until half of its duration passed,
+// then a new lease is requested and the superseded one is revoked.
+type vaultProvider struct {
+	client      *http.Client
+	tokenFile   string
+	revokeDelay time.Duration
+
+	mu     sync.Mutex
+	leases map[string]*vaultLease
+}
+
+// vaultLease is a lease of AWS secrets engine keys
+type vaultLease struct {
+	id     string
+	secret map[string]string
+	keys   Config
+	renew  time.Time
+}
+
+type vaultResponse struct {
+	LeaseID       string          `json:"lease_id"`
+	LeaseDuration int             `json:"lease_duration"`
+	Data          json.RawMessage `json:"data"`
+	Auth          *struct {
+		ClientToken string `json:"client_token"`
+	} `json:"auth"`
+	Errors []string `json:"errors"`
+}
+
+func (p *vaultProvider) Retrieve(ctx context.Context, secret map[string]string, cfg *Config) error {
+	address := currentProviderSettings().VaultAddress
+	if address == "" {
+		address = os.Getenv("VAULT_ADDR")
+	}
+	if address == "" {
+		return fmt.Errorf("the Vault address of the driver is not set")
+	}
+	address = strings.TrimSuffix(address, "/")
+	path := strings.Trim(secret["vaultPath"], "/")
+	if path == "" {
+		return fmt.Errorf("vaultPath is not set")
+	}
+	engine := secret["vaultEngine"]
+	if engine == "" {
+		engine = vaultEngineKV
+	}
+	if engine != vaultEngineKV && engine != vaultEngineAWS {
+		return fmt.Errorf("unknown vaultEngine %q, must be %q or %q", engine, vaultEngineKV, vaultEngineAWS)
+	}
+
+	if engine == vaultEngineAWS {
+		return p.retrieveLease(ctx, address, path, secret, cfg)
+	}
+
+	resp, err := p.read(ctx, address, path, secret)
+	if err != nil {
+		return err
+	}
+	var data struct {
+		Data     map[string]interface{} `json:"data"`
+		Metadata map[string]interface{} `json:"metadata"`
+	}
+	if err = json.Unmarshal(resp.Data, &data); err != nil {
+		return fmt.Errorf("failed to parse secret %s: %v", path, err)
+	}
+	values := data.Data
+	if values == nil || data.Metadata == nil {
+		// KV version 1 has the values right in data
+		if err = json.Unmarshal(resp.Data, &values); err != nil {
+			return fmt.Errorf("failed to parse secret %s: %v", path, err)
+		}
+	}
+	keys := &Config{}
+	keys.AccessKeyID, _ = values["accessKeyID"].(string)
+	keys.SecretAccessKey, _ = values["secretAccessKey"].(string)
+	keys.SessionToken, _ = values["sessionToken"].(string)
+	if keys.AccessKeyID == "" || keys.SecretAccessKey == "" {
+		return fmt.Errorf("%s has no S3 keys", path)
+	}
+	setKeys(cfg, keys)
+	return nil
+}
+
+// retrieveLease sets the keys of the current lease of the AWS secrets engine
+// credentials at path, requesting a new lease if there's none or half of its
+// duration passed
+func (p *vaultProvider) retrieveLease(ctx context.Context, address, path string, secret map[string]string, cfg *Config) error {
+	key := secretHash(map[string]string{
+		"address":   address,
+		"path":      path,
+		"namespace": secret["vaultNamespace"],
+		"role":      secret["vaultRole"],
+		"authPath":  secret["vaultAuthPath"],
+		"token":     secret["vaultToken"],
+	})
+	p.mu.Lock()
+	lease, ok := p.leases[key]
+	p.mu.Unlock()
+	if ok && time.Now().Before(lease.renew) {
+		setKeys(cfg, &lease.keys)
+		return nil
+	}
+
+	resp, err := p.read(ctx, address, path, secret)
+	if err != nil {
+		return err
+	}
+	var data struct {
+		AccessKey     string `json:"access_key"`
+		SecretKey     string `json:"secret_key"`
+		SecurityToken string `json:"security_token"`
+	}
+	if err = json.Unmarshal(resp.Data, &data); err != nil {
+		return fmt.Errorf("failed to parse credentials from %s: %v", path, err)
+	}
+	if data.AccessKey == "" || data.SecretKey == "" {
+		return fmt.Errorf("%s has no S3 keys", path)
+	}
+	next := &vaultLease{
+		id:     resp.LeaseID,
+		secret: secret,
+		keys: Config{
+			AccessKeyID:     data.AccessKey,
+			SecretAccessKey: data.SecretKey,
+			SessionToken:    data.SecurityToken,
+		},
+	}
+	if resp.LeaseDuration > 0 {
+		duration := time.Duration(resp.LeaseDuration) * time.Second
+		next.keys.Expires = time.Now().Add(duration)
+		next.renew = time.Now().Add(duration / 2)
+	}
+
+	p.mu.Lock()
+	if p.leases == nil {
+		p.leases = make(map[string]*vaultLease)
+	}
+	prev := p.leases[key]
+	p.leases[key] = next
+	p.mu.Unlock()
+	if prev != nil && prev.id != "" {
+		p.revokeLater(address, prev)
+	}
+	setKeys(cfg, &next.keys)
+	return nil
+}
+
+// revokeLater revokes the superseded lease once mounters switched to the
+// keys of the new one
+func (p *vaultProvider) revokeLater(address string, lease *vaultLease) {
+	delay := p.revokeDelay
+	if delay == 0 {
+		delay = defaultVaultRevokeDelay
+	}
+	time.AfterFunc(delay, func() {
+		ctx := context.Background()
+		token, err := p.login(ctx, address, lease.secret)
+		if err == nil {
+			body, _ := json.Marshal(map[string]string{"lease_id": lease.id})
+			_, err = p.request(ctx, http.MethodPut, address+"/v1/sys/leases/revoke", token, lease.secret["vaultNamespace"], body)
+		}
+		if err != nil {
+			glog.Errorf("s3: failed to revoke Vault lease %s: %v", lease.id, err)
+		}
+	})
+}
+
+// read logs in and reads the secret at path
+func (p *vaultProvider) read(ctx context.Context, address, path string, secret map[string]string) (*vaultResponse, error) {
+	token, err := p.login(ctx, address, secret)
+	if err != nil {
+		return nil, err
+	}
+	return p.request(ctx, http.MethodGet, address+"/v1/"+path, token, secret["vaultNamespace"], nil)
+}
+
+// login returns the Vault token to read the keys with
+func (p *vaultProvider) login(ctx context.Context, address string, secret map[string]string) (string, error) {
+	role := secret["vaultRole"]
+	if role == "" {
+		token := secret["vaultToken"]
+		if token == "" {
+			token = os.Getenv("VAULT_TOKEN")
+		}
+		if token == "" {
+			return "", fmt.Errorf("neither vaultRole nor vaultToken is set")
+		}
+		return token, nil
+	}
+	tokenFile := p.tokenFile
+	if tokenFile == "" {
+		tokenFile = defaultServiceAccountTokenFile
+	}
+	jwt, err := ioutil.ReadFile(tokenFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read service account token: %v", err)
+	}
+	authPath := strings.Trim(secret["vaultAuthPath"], "/")
+	if authPath == "" {
+		authPath = defaultVaultAuthPath
+	}
+	body, err := json.Marshal(map[string]string{
+		"role": role,
+		"jwt":  strings.TrimSpace(string(jwt)),
+	})
+	if err != nil {
+		return "", err
+	}
+	resp, err := p.request(ctx, http.MethodPost, address+"/v1/auth/"+authPath+"/login", "", secret["vaultNamespace"], body)
+	if err != nil {
+		return "", err
+	}
+	if resp.Auth == nil || resp.Auth.ClientToken == "" {
+		return "", fmt.Errorf("Vault login with role %s returned no token", role)
+	}
+	return resp.Auth.ClientToken, nil
+}
+
+func (p *vaultProvider) request(ctx context.Context, method, url, token, namespace string, body []byte) (*vaultResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, vaultRequestTimeout)
+	defer cancel()
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if namespace != "" {
+		req.Header.Set("X-Vault-Namespace", namespace)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	client := p.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	httpResp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Vault request failed: %v", err)
+	}
+	defer httpResp.Body.Close()
+	var resp vaultResponse
+	if err = json.NewDecoder(httpResp.Body).Decode(&resp); err != nil && httpResp.StatusCode == http.StatusOK {
+		return nil, fmt.Errorf("failed to parse Vault response: %v", err)
+	}
+	// revoking leases returns no content
+	if httpResp.StatusCode != http.StatusOK && httpResp.StatusCode != http.StatusNoContent {
+		return nil, fmt.Errorf("Vault returned %s for %s %s: %s",
+			httpResp.Status, method, req.URL.Path, strings.Join(resp.Errors, "; "))
+	}
+	return &resp, nil
+}